@@ -3,6 +3,7 @@ package core
 import (
 	"errors"
 	"go-chain/types"
+	"math"
 	"sync"
 )
 
@@ -10,11 +11,15 @@ var (
 	AccountNotExistsErr = errors.New("no such account")
 	NotZeroAddrErr      = errors.New("not zero address")
 	InsufficientBalance = errors.New("insufficient balance")
+	InvalidNonceErr     = errors.New("invalid nonce")
+	CostOverflowErr     = errors.New("amount plus fee overflows")
 )
 
 type Account struct {
 	Address types.Address
 	Balance uint64
+	// Nonce 该账户下一笔交易应该使用的nonce 即已执行的交易数量
+	Nonce int64
 }
 
 type AccountState struct {
@@ -53,9 +58,47 @@ func (s *AccountState) GetBalance(address types.Address) (balance uint64) {
 	return account.Balance
 }
 
+// GetNonce 获取账户下一笔交易应该使用的nonce 账户不存在时为0
+func (s *AccountState) GetNonce(address types.Address) int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	account := s.accounts[address]
+	if account == nil {
+		return 0
+	}
+	return account.Nonce
+}
+
+// TransferWithNonce 校验nonce后转账并扣除手续费 成功后发送方的nonce加1
+// 手续费直接销毁
+func (s *AccountState) TransferWithNonce(from types.Address, to types.Address, amount uint64, fee uint64, nonce int64) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fromAccount := s.accounts[from]
+	if fromAccount != nil && fromAccount.Nonce != nonce {
+		return InvalidNonceErr
+	}
+	if amount > math.MaxUint64-fee {
+		return CostOverflowErr
+	}
+	if fromAccount != nil && fromAccount.Balance < amount+fee {
+		return InsufficientBalance
+	}
+	if err := s.transfer(from, to, amount); err != nil {
+		return err
+	}
+	fromAccount.Balance -= fee
+	fromAccount.Nonce++
+	return nil
+}
+
 func (s *AccountState) Transfer(from types.Address, to types.Address, amount uint64) (err error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	return s.transfer(from, to, amount)
+}
+
+func (s *AccountState) transfer(from types.Address, to types.Address, amount uint64) (err error) {
 	if from.IsZero() {
 		return NotZeroAddrErr
 	}
@@ -77,3 +120,55 @@ func (s *AccountState) Transfer(from types.Address, to types.Address, amount uin
 	return nil
 
 }
+
+// NewAccountStateFromAccounts 使用给定的账户列表创建账户状态 用于从快照恢复
+func NewAccountStateFromAccounts(accounts []*Account) *AccountState {
+	s := NewAccountState()
+	for _, account := range accounts {
+		copied := *account
+		s.accounts[account.Address] = &copied
+	}
+	return s
+}
+
+// Accounts 返回按地址排序的账户拷贝
+func (s *AccountState) Accounts() []*Account {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	accounts := make([]*Account, 0, len(s.accounts))
+	for _, account := range s.accounts {
+		copied := *account
+		accounts = append(accounts, &copied)
+	}
+	sortAccounts(accounts)
+	return accounts
+}
+
+// StateRoot 计算当前账户状态的状态根
+func (s *AccountState) StateRoot() types.Hash {
+	return CalculateStateRoot(s.Accounts())
+}
+
+// restoreAccount 把账户恢复为给定的状态 account为nil时删除账户
+func (s *AccountState) restoreAccount(address types.Address, account *Account) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if account == nil {
+		delete(s.accounts, address)
+		return
+	}
+	copied := *account
+	s.accounts[address] = &copied
+}
+
+// copyAccount 返回账户的拷贝 账户不存在时返回nil
+func (s *AccountState) copyAccount(address types.Address) *Account {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	account := s.accounts[address]
+	if account == nil {
+		return nil
+	}
+	copied := *account
+	return &copied
+}
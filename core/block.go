@@ -2,12 +2,15 @@ package core
 
 import (
 	"bytes"
+	"errors"
 	"go-chain/types"
 	"go-chain/utils"
 	"io"
 	"time"
 )
 
+var ErrInvalidHeaderChain = errors.New("区块头链无效")
+
 type BlockHeader struct {
 	Version       uint32
 	PrevBlockHash types.Hash
@@ -16,6 +19,8 @@ type BlockHeader struct {
 	Timestamp     int64
 	// nonce表示的是这个块的工作量 即矿工挖到的nonce
 	Nonce uint32
+	// StateRoot 执行完这个区块之后的状态根 为空表示区块没有承诺状态根
+	StateRoot types.Hash
 }
 
 type Block struct {
@@ -24,10 +29,14 @@ type Block struct {
 }
 
 func (b *Block) Encode(w io.Writer) error {
-	return utils.EncodeMessage(b, w)
+	bw := utils.NewBinaryWriter(w)
+	WriteBlock(bw, b)
+	return bw.Err()
 }
 func (b *Block) Decode(r io.Reader) error {
-	return utils.DecodeMessage(b, r)
+	br := utils.NewBinaryReader(r)
+	ReadBlock(br, b)
+	return br.Err()
 }
 
 // NewBlock 创建一个新的区块
@@ -59,6 +68,14 @@ func NewBlock(prevBlockHash types.Hash, height uint32, transactions []*Transacti
 	return block
 }
 
+// NewGenesisBlock 创建创世区块
+// 创世区块不包含交易 时间戳固定为0 所有节点得到的区块哈希都是一致的
+func NewGenesisBlock() *Block {
+	block := NewBlock(types.Hash{}, 0, []*Transaction{})
+	block.Header.Timestamp = 0
+	return block
+}
+
 // CalculateDataHash 计算区块中交易数据的哈希值
 func (b *Block) CalculateDataHash() (types.Hash, error) {
 	buf := &bytes.Buffer{}
@@ -70,6 +87,20 @@ func (b *Block) CalculateDataHash() (types.Hash, error) {
 	return types.HashFromBytes(utils.SHA256(buf.Bytes())), nil
 }
 
+// Hash 计算区块头的哈希 覆盖区块头的所有字段 包括DataHash和StateRoot
+// 区块之间通过PrevBlockHash引用前一个区块头的哈希相连 区块也以这个哈希作为标识
+func (h *BlockHeader) Hash() types.Hash {
+	buf := &bytes.Buffer{}
+	bw := utils.NewBinaryWriter(buf)
+	WriteBlockHeader(bw, h)
+	return types.HashFromBytes(utils.SHA256(buf.Bytes()))
+}
+
+// Hash 返回区块的标识 即区块头的哈希
+func (b *Block) Hash() types.Hash {
+	return b.Header.Hash()
+}
+
 func (b *Block) GetDataHash() types.Hash {
 	return b.Header.DataHash
 }
@@ -100,13 +131,18 @@ func (b *Block) Verify() bool {
 
 // verifyHeader 验证区块头
 func (b *Block) verifyHeader() bool {
+	return b.Header.Verify()
+}
+
+// Verify 验证区块头本身的字段 不检查与其他区块的关系
+func (h *BlockHeader) Verify() bool {
 	// 验证版本号
-	if b.Header.Version != 1 {
+	if h.Version != 1 {
 		return false
 	}
 
 	// 验证时间戳
-	if b.Header.Timestamp > time.Now().Unix() {
+	if h.Timestamp > time.Now().Unix() {
 		return false
 	}
 
@@ -115,6 +151,22 @@ func (b *Block) verifyHeader() bool {
 	return true
 }
 
+// VerifyHeaderChain 验证一组区块头是否首尾相连 每个区块头的PrevBlockHash必须是前一个区块头的哈希
+// parent不为nil时 第一个区块头必须接在parent之后
+func VerifyHeaderChain(parent *BlockHeader, headers []*BlockHeader) error {
+	prev := parent
+	for _, header := range headers {
+		if header == nil || !header.Verify() {
+			return ErrInvalidHeaderChain
+		}
+		if prev != nil && (header.Height != prev.Height+1 || header.PrevBlockHash != prev.Hash()) {
+			return ErrInvalidHeaderChain
+		}
+		prev = header
+	}
+	return nil
+}
+
 // verifyTransactions 验证区块中的所有交易
 func (b *Block) verifyTransactions() bool {
 	for _, tx := range b.Transactions {
@@ -135,7 +187,7 @@ func (b *Block) verifyDataHash() bool {
 }
 
 func (b *Block) PreOf(nxt *Block) bool {
-	return nxt.GetPrevBlockHash() == b.GetDataHash()
+	return nxt.GetPrevBlockHash() == b.Hash()
 }
 
 func (b *Block) Height() uint32 {
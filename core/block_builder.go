@@ -0,0 +1,119 @@
+package core
+
+import (
+	"bytes"
+	"go-chain/types"
+	"io"
+)
+
+const (
+	// 区块默认的最大字节数
+	DefaultMaxBlockBytes = 1 << 20
+	// 区块默认的最大执行额度
+	DefaultMaxBlockGas uint64 = 10_000_000
+	// 每笔交易固定消耗的执行额度
+	TxBaseGas uint64 = 21_000
+	// 交易数据每个字节消耗的执行额度
+	TxDataGas uint64 = 16
+)
+
+// BlockBuilder 从交易池中挑选交易生成新区块
+// 每笔交易都先在沙盒状态上模拟执行 执行失败或者超出区块限制的交易会被跳过
+// 因此生成的区块中的交易都能在链上成功执行
+type BlockBuilder struct {
+	chain    *Blockchain
+	pool     *TxPool
+	maxBytes int
+	maxGas   uint64
+}
+
+type BlockBuilderOption func(*BlockBuilder)
+
+// WithMaxBlockBytes 设置区块编码后的最大字节数
+func WithMaxBlockBytes(size int) BlockBuilderOption {
+	return func(b *BlockBuilder) {
+		b.maxBytes = size
+	}
+}
+
+// WithMaxBlockGas 设置区块中所有交易的执行额度之和的上限
+func WithMaxBlockGas(gas uint64) BlockBuilderOption {
+	return func(b *BlockBuilder) {
+		b.maxGas = gas
+	}
+}
+
+func NewBlockBuilder(chain *Blockchain, pool *TxPool, options ...BlockBuilderOption) *BlockBuilder {
+	b := &BlockBuilder{
+		chain:    chain,
+		pool:     pool,
+		maxBytes: DefaultMaxBlockBytes,
+		maxGas:   DefaultMaxBlockGas,
+	}
+	for _, option := range options {
+		option(b)
+	}
+	return b
+}
+
+// Build 基于最新区块生成下一个区块 交易按交易池的打包顺序挑选
+// 没有可以打包的交易时返回的区块不包含交易 由调用方决定是否出块
+func (b *BlockBuilder) Build() (*Block, error) {
+	parent := b.chain.GetLatestBlock()
+	height := parent.Height() + 1
+
+	// 在最新状态的拷贝上模拟执行 不影响链上的状态
+	sandbox := NewAccountStateFromAccounts(b.chain.GetAccountState().Accounts())
+
+	size, err := encodedSize(NewBlock(parent.Hash(), height, []*Transaction{}))
+	if err != nil {
+		return nil, err
+	}
+	var (
+		gas     uint64
+		txs     = make([]*Transaction, 0)
+		skipped = make(map[types.Address]bool)
+	)
+	for _, tx := range b.pool.GetPendingTxs() {
+		from := tx.From.Address()
+		// 发送者前面的交易被跳过后 后面的交易nonce不连续 也无法执行
+		if skipped[from] {
+			continue
+		}
+		txSize, err := encodedSize(tx)
+		if err != nil {
+			skipped[from] = true
+			continue
+		}
+		if size+txSize > b.maxBytes || gas+tx.Gas() > b.maxGas {
+			skipped[from] = true
+			continue
+		}
+		if tx.ExpiredAt(height) {
+			skipped[from] = true
+			continue
+		}
+		if err := applyTransaction(sandbox, b.chain.chainID, tx); err != nil {
+			skipped[from] = true
+			continue
+		}
+		size += txSize
+		gas += tx.Gas()
+		txs = append(txs, tx)
+	}
+
+	block := NewBlock(parent.Hash(), height, txs)
+	// 沙盒执行的结果就是区块上链后的状态 在区块头中承诺状态根
+	block.Header.StateRoot = sandbox.StateRoot()
+	return block, nil
+}
+
+// encodedSize 计算区块或交易编码后的字节数
+// 交易单独编码的结果和它在区块中的编码相同 空区块的大小加上所有交易的大小就是区块编码后的大小
+func encodedSize(v interface{ Encode(w io.Writer) error }) (int, error) {
+	buf := &bytes.Buffer{}
+	if err := v.Encode(buf); err != nil {
+		return 0, err
+	}
+	return buf.Len(), nil
+}
@@ -11,8 +11,11 @@ import (
 )
 
 var (
-	ErrBlockNotFound = errors.New("区块未找到")
-	ErrChainNotFound = errors.New("链未找到")
+	ErrBlockNotFound  = errors.New("区块未找到")
+	ErrChainNotFound  = errors.New("链未找到")
+	ErrBlockPruned    = errors.New("区块已被裁剪")
+	ErrTxVerifyFailed = errors.New("交易验证失败")
+	ErrStateRoot      = errors.New("区块头中的状态根与执行结果不一致")
 )
 
 // Blockchain 表示整个区块链
@@ -27,20 +30,67 @@ type Blockchain struct {
 	accountState *AccountState
 	stateLock    sync.RWMutex
 	validator    inter.Validator
+	// 每个高度的区块对账户状态的改动 下标为区块高度 被裁剪后为nil
+	diffs []*StateDiff
+	// 最低的拥有完整区块的高度 通过快照同步的节点不会保存快照之前的区块
+	lowest uint32
+	// 最低的可以还原账户状态的高度
+	stateLowest uint32
+	pruneConfig PruneConfig
+	// 每隔多少个区块生成一次状态快照 为0时不生成
+	snapshotInterval uint32
+	// 最多保留的快照数量
+	snapshotRetain int
+	snapshots      []*StateSnapshot
+	chainID        uint32
+}
+
+type BlockchainOption func(*Blockchain)
+
+func WithSnapshotInterval(interval uint32) BlockchainOption {
+	return func(bc *Blockchain) {
+		bc.snapshotInterval = interval
+	}
+}
+
+func WithSnapshotRetain(n int) BlockchainOption {
+	return func(bc *Blockchain) {
+		bc.snapshotRetain = n
+	}
+}
+
+func WithChainID(chainID uint32) BlockchainOption {
+	return func(bc *Blockchain) {
+		bc.chainID = chainID
+	}
+}
+
+func WithPruneConfig(config PruneConfig) BlockchainOption {
+	return func(bc *Blockchain) {
+		bc.pruneConfig = config
+	}
 }
 
 // NewBlockchain 创建一个新的区块链
-func NewBlockchain() *Blockchain {
+func NewBlockchain(options ...BlockchainOption) *Blockchain {
 	bc := &Blockchain{
-		logger:       *log.New(os.Stdout, "Blockchain", log.LstdFlags),
-		mu:           sync.RWMutex{},
-		blocks:       make([]*Block, 0),
-		headers:      make([]*BlockHeader, 0),
-		blockStore:   make(map[types.Hash]*Block),
-		txStore:      make(map[types.Hash]*Transaction),
-		accountState: NewAccountState(),
-		stateLock:    sync.RWMutex{},
-		validator:    nil,
+		logger:           *log.New(os.Stdout, "Blockchain", log.LstdFlags),
+		mu:               sync.RWMutex{},
+		blocks:           make([]*Block, 0),
+		headers:          make([]*BlockHeader, 0),
+		diffs:            make([]*StateDiff, 0),
+		blockStore:       make(map[types.Hash]*Block),
+		txStore:          make(map[types.Hash]*Transaction),
+		accountState:     NewAccountState(),
+		stateLock:        sync.RWMutex{},
+		validator:        nil,
+		snapshotInterval: 1000,
+		snapshotRetain:   2,
+		snapshots:        make([]*StateSnapshot, 0),
+		chainID:          DefaultChainID,
+	}
+	for _, option := range options {
+		option(bc)
 	}
 	v := &BlockValidator{bc: bc}
 	bc.validator = v
@@ -56,28 +106,37 @@ func (bc *Blockchain) AddBlock(block *Block) error {
 		return errors.New("区块验证失败")
 	}
 
-	bc.addBlock(block)
-	return nil
+	return bc.addBlock(block, true)
 }
 
 // AddBlock 向区块链中添加一个新区块
 // 用于直接添加区块 在同步别的节点的block时，无需再验证每个区块
 func (bc *Blockchain) AddBlockWithoutValidation(block *Block) {
-	bc.addBlock(block)
+	bc.addBlock(block, false)
 }
 
 // GetBlock 根据高度获取区块
 func (bc *Blockchain) GetBlock(height uint32) (*Block, error) {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
 	if height >= uint32(len(bc.blocks)) || height < 1 {
 		bc.logger.Printf("区块高度 %d 超出范围", height)
 		return nil, ErrBlockNotFound
 	}
+	if height < bc.lowest {
+		return nil, ErrBlockPruned
+	}
 	block := bc.blocks[height]
+	if block == nil {
+		return nil, ErrBlockNotFound
+	}
 	return block, nil
 }
 
 // GetBlock 根据高度获取区块
 func (bc *Blockchain) GetBlockByHash(hash types.Hash) *Block {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
 	return bc.blockStore[hash]
 }
 
@@ -89,44 +148,115 @@ func (bc *Blockchain) GetLatestBlock() *Block {
 }
 
 func (bc *Blockchain) Height() uint32 {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	return bc.height()
+}
+
+// height 调用时需要持有bc.mu
+func (bc *Blockchain) height() uint32 {
 	// 区块高度为区块数量减1  因为初始创世区块的高度是0 每个区块链必然有一个创世区块
 	return uint32(len(bc.blocks) - 1)
 }
 
 // addBlock 将区块添加到区块链中
-func (bc *Blockchain) addBlock(block *Block) {
-	// 先执行这个区块的所有交易
+// checkRoot为true时 区块头承诺了状态根就必须与执行结果一致 否则撤销执行并拒绝区块
+func (bc *Blockchain) addBlock(block *Block, checkRoot bool) error {
+	// 先执行这个区块的所有交易 同时记录状态差异
 	bc.stateLock.Lock()
+	diff := newStateDiff(bc.accountState, block)
 	for i, tx := range block.Transactions {
-		if err := bc.ExecuteTransaction(tx); err != nil {
+		if err := bc.executeTransactionAt(tx, block.Height()); err != nil {
 			// 将这个交易删除 是通过与最后的Tx进行交换，然后删除最后的Tx
 			block.Transactions[i] = block.Transactions[len(block.Transactions)-1]
 			block.Transactions = block.Transactions[:len(block.Transactions)-1]
 			continue
 		}
 	}
-	bc.stateLock.Unlock()
-
+	diff.finish(bc.accountState)
+	if checkRoot && !block.Header.StateRoot.IsZero() && bc.accountState.StateRoot() != block.Header.StateRoot {
+		for _, change := range diff.Changes {
+			bc.accountState.restoreAccount(change.Address, change.Prev)
+		}
+		bc.stateLock.Unlock()
+		return ErrStateRoot
+	}
 
+	// 状态的改动和状态差异在同一个临界区内生效 StateAt不会看到状态已经改动但差异还没有记录的中间状态
 	bc.mu.Lock()
 	// 将区块添加到存储中
 	bc.blocks = append(bc.blocks, block)
 	bc.headers = append(bc.headers, block.Header)
-	bc.blockStore[block.Header.DataHash] = block
+	bc.diffs = append(bc.diffs, diff)
+	bc.blockStore[block.Hash()] = block
 
 	// 将交易也加到区块链中
 	for _, tx := range block.Transactions {
 		// todo 要执行区块中每个交易
 		bc.txStore[tx.CalHash()] = tx
 	}
+	bc.prune()
 	bc.mu.Unlock()
+	bc.stateLock.Unlock()
 
 	bc.logger.Println(
 		"msg", "new block",
-		"hash", block.GetDataHash(),
+		"hash", block.Hash(),
 		"height", block.Height(),
 		"transactions", len(block.Transactions),
 	)
+
+	if bc.snapshotInterval > 0 && block.Height() > 0 && block.Height()%bc.snapshotInterval == 0 {
+		bc.TakeSnapshot()
+	}
+	return nil
+}
+
+// GetHeader 根据高度获取区块头 区块被裁剪后区块头仍然保留
+// 从快照恢复的节点保留了快照之前的区块头 但没有对应的区块
+func (bc *Blockchain) GetHeader(height uint32) (*BlockHeader, error) {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	return bc.getHeader(height)
+}
+
+func (bc *Blockchain) getHeader(height uint32) (*BlockHeader, error) {
+	if height >= uint32(len(bc.headers)) {
+		return nil, ErrBlockNotFound
+	}
+	header := bc.headers[height]
+	if header == nil {
+		return nil, ErrBlockPruned
+	}
+	return header, nil
+}
+
+// GetHeaders 获取[from, to]范围内的区块头
+func (bc *Blockchain) GetHeaders(from uint32, to uint32) ([]*BlockHeader, error) {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+
+	if from > to {
+		return nil, ErrBlockNotFound
+	}
+	headers := make([]*BlockHeader, 0, to-from+1)
+	for h := from; h <= to; h++ {
+		header, err := bc.getHeader(h)
+		if err != nil {
+			return nil, err
+		}
+		headers = append(headers, header)
+	}
+	return headers, nil
+}
+
+// HasTransaction 检查交易是否已经被打包进链上的区块
+// 被裁剪的区块中的交易不再保留索引
+func (bc *Blockchain) HasTransaction(hash types.Hash) bool {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	_, ok := bc.txStore[hash]
+	return ok
 }
 
 // HasBlock 检查区块链中是否存在指定哈希的区块
@@ -143,56 +273,72 @@ func (bc *Blockchain) getRangeBlocks(from uint32, to uint32) []*Block {
 	return bc.blocks[utils.HeightToIndex(from): utils.HeightToIndex(to) + 1]
 }
 
-func (bc *Blockchain) GetRangeBlocks(from uint32, to uint32) []*Block {
+// GetRangeBlocks 获取[from, to]范围内的区块 范围内有区块被裁剪时返回ErrBlockPruned
+func (bc *Blockchain) GetRangeBlocks(from uint32, to uint32) ([]*Block, error) {
 	bc.mu.RLock()
 	defer bc.mu.RUnlock()
 
-	if !bc.checkGetBlockRange(from, to) {
-		return nil
+	if err := bc.checkGetBlockRange(from, to); err != nil {
+		return nil, err
 	}
 
-	return bc.getRangeBlocks(from, to)
+	return bc.getRangeBlocks(from, to), nil
 }
 
 
 
-func (bc *Blockchain) checkGetBlockRange(from uint32, to uint32) bool {
+func (bc *Blockchain) checkGetBlockRange(from uint32, to uint32) error {
 	if from > to {
 		bc.logger.Printf("获取区块消息的from参数错误: %v > %v", from, to)
-		return false
+		return ErrBlockNotFound
+	}
+	if from <= 0 || from > bc.height() {
+		bc.logger.Printf("获取区块消息的from参数错误: %v > %v", from, bc.height())
+		return ErrBlockNotFound
+	}
+	if to > bc.height() {
+		bc.logger.Printf("获取区块消息的to参数错误: %v > %v", to, bc.height())
+		return ErrBlockNotFound
 	}
-	if from <= 0 || from > bc.Height() {
-		bc.logger.Printf("获取区块消息的from参数错误: %v > %v", from, bc.Height())
-		return false
+	if from < bc.lowest {
+		bc.logger.Printf("区块 %v 已被裁剪, 当前最低区块高度 %v", from, bc.lowest)
+		return ErrBlockPruned
 	}
-	if to > bc.Height() {
-		bc.logger.Printf("获取区块消息的to参数错误: %v > %v", to, bc.Height())
-		return false
+	return nil
+}
+
+// executeTransactionAt 在指定高度的区块中执行交易 过期的交易不会被执行
+func (bc *Blockchain) executeTransactionAt(tx *Transaction, height uint32) error {
+	if tx.ExpiredAt(height) {
+		bc.logger.Printf("交易已过期: 最晚高度 %d, 区块高度 %d", tx.ValidUntilHeight, height)
+		return ErrTxExpired
 	}
-	return true
+	return bc.ExecuteTransaction(tx)
 }
 
 // ExecuteTransaction 执行交易并更新账户状态
 func (bc *Blockchain) ExecuteTransaction(tx *Transaction) error {
-	// 验证交易
-	if !tx.Verify() {
-		return errors.New("交易验证失败")
-	}
-	err := bc.accountState.Transfer(tx.From.Address(), tx.To.Address(), tx.Value)
+	err := applyTransaction(bc.accountState, bc.chainID, tx)
 	if err != nil {
 		bc.logger.Printf("交易执行失败: %v", err)
 		return err
 	}
 
-	// 记录交易
-	bc.txStore[tx.CalHash()] = tx
-
 	bc.logger.Printf("交易执行成功: 从 %s 转账 %d 到 %s", tx.From, tx.Value, tx.To)
 	return nil
 }
 
-
-
+// applyTransaction 验证交易并在给定的账户状态上执行
+// 出块时也用它在沙盒状态上模拟执行交易
+func applyTransaction(state *AccountState, chainID uint32, tx *Transaction) error {
+	if !tx.Verify() {
+		return ErrTxVerifyFailed
+	}
+	if tx.ChainID != chainID {
+		return ErrInvalidChainID
+	}
+	return state.TransferWithNonce(tx.From.Address(), tx.To.Address(), tx.Value, tx.Fee, tx.Nonce)
+}
 
 func (bc *Blockchain) GetAccountState() *AccountState {
 	return bc.accountState
@@ -201,16 +347,137 @@ func (bc *Blockchain) GetAccountState() *AccountState {
 
 // 
 func (bc *Blockchain) RemoveBlocks(toHeight uint32) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
 	bc.blocks = bc.blocks[:toHeight]
+	bc.headers = bc.headers[:toHeight]
+	bc.diffs = bc.diffs[:toHeight]
 }
 
 
 func (bc *Blockchain) DeleteTxs(txs []*Transaction) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
 	for _, tx := range txs {
 		delete(bc.txStore, tx.CalHash())
 	}
 }
 
 func (bc *Blockchain) DeleteBlockStore(hash types.Hash) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
 	delete(bc.blockStore, hash)
 }
+
+
+// TakeSnapshot 在当前最新区块上生成状态快照 只保留最近的snapshotRetain个快照
+func (bc *Blockchain) TakeSnapshot() *StateSnapshot {
+	// 读取状态时不能有新的区块加入 否则快照的状态与区块对不上
+	bc.stateLock.RLock()
+	accounts := bc.accountState.Accounts()
+	latest := bc.GetLatestBlock()
+	bc.stateLock.RUnlock()
+	snap := &StateSnapshot{
+		Height:    latest.Height(),
+		BlockHash: latest.Hash(),
+		StateRoot: CalculateStateRoot(accounts),
+		Accounts:  accounts,
+	}
+
+	bc.mu.Lock()
+	bc.snapshots = append(bc.snapshots, snap)
+	if bc.snapshotRetain > 0 && len(bc.snapshots) > bc.snapshotRetain {
+		bc.snapshots = bc.snapshots[len(bc.snapshots)-bc.snapshotRetain:]
+	}
+	bc.mu.Unlock()
+
+	bc.logger.Printf("生成状态快照: 高度 %d, 状态根 %x, 账户数 %d", snap.Height, snap.StateRoot, len(accounts))
+	return snap
+}
+
+// GetLatestSnapshot 获取最新的状态快照
+func (bc *Blockchain) GetLatestSnapshot() (*StateSnapshot, error) {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	if len(bc.snapshots) == 0 {
+		return nil, ErrSnapshotNotFound
+	}
+	return bc.snapshots[len(bc.snapshots)-1], nil
+}
+
+// GetSnapshot 根据高度获取状态快照
+func (bc *Blockchain) GetSnapshot(height uint32) (*StateSnapshot, error) {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	for _, snap := range bc.snapshots {
+		if snap.Height == height {
+			return snap, nil
+		}
+	}
+	return nil, ErrSnapshotNotFound
+}
+
+// ApplySnapshot 使用快照重置区块链 anchor为快照高度对应的区块
+// headers为从高度1到快照高度的区块头 必须从本地的创世区块开始首尾相连 最后一个区块头就是anchor的区块头
+// 快照的状态根必须与anchor在区块头中承诺的状态根一致 快照之前的区块不再保存 之后只需要同步快照之后的区块
+func (bc *Blockchain) ApplySnapshot(snap *StateSnapshot, headers []*BlockHeader, anchor *Block) error {
+	if err := snap.Verify(); err != nil {
+		return err
+	}
+	genesis, err := bc.GetHeader(0)
+	if err != nil {
+		return err
+	}
+	if snap.Height == 0 || uint32(len(headers)) != snap.Height {
+		return ErrInvalidHeaderChain
+	}
+	if err := VerifyHeaderChain(genesis, headers); err != nil {
+		return err
+	}
+	tip := headers[len(headers)-1]
+	if anchor == nil || anchor.Header == nil || *anchor.Header != *tip || tip.Hash() != snap.BlockHash || !anchor.verifyDataHash() {
+		return ErrSnapshotAnchorInvalid
+	}
+	if tip.StateRoot != snap.StateRoot {
+		return ErrSnapshotRootMismatch
+	}
+
+	bc.stateLock.Lock()
+	bc.accountState = NewAccountStateFromAccounts(snap.Accounts)
+	bc.mu.Lock()
+	bc.blocks = make([]*Block, snap.Height+1)
+	bc.headers = append([]*BlockHeader{genesis}, headers...)
+	bc.diffs = make([]*StateDiff, snap.Height+1)
+	bc.blocks[snap.Height] = anchor
+	bc.blockStore = map[types.Hash]*Block{anchor.Hash(): anchor}
+	bc.txStore = make(map[types.Hash]*Transaction)
+	for _, tx := range anchor.Transactions {
+		bc.txStore[tx.CalHash()] = tx
+	}
+	bc.lowest = snap.Height
+	bc.stateLowest = snap.Height
+	bc.snapshots = []*StateSnapshot{snap}
+	bc.mu.Unlock()
+	bc.stateLock.Unlock()
+
+	bc.logger.Printf("已从快照恢复: 高度 %d, 状态根 %x", snap.Height, snap.StateRoot)
+	return nil
+}
+
+// LowestHeight 返回本地保存了完整区块的最低高度
+func (bc *Blockchain) LowestHeight() uint32 {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	return bc.lowest
+}
+
+// ServableRange 返回本节点可以提供给其他节点的区块范围
+func (bc *Blockchain) ServableRange() (from uint32, to uint32) {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	from = bc.lowest
+	if from < 1 {
+		from = 1
+	}
+	return from, uint32(len(bc.blocks) - 1)
+}
@@ -1,8 +1,23 @@
 package core
 
 import (
-	"encoding/gob"
-	"io"
+	"bytes"
+	"go-chain/cryptoo"
+	"go-chain/types"
+	"go-chain/utils"
+	"math/big"
+)
+
+// 二进制编码中各个变长字段的长度上限 解码时超过上限直接返回错误
+const (
+	// 公钥的最大字节数 压缩格式为33字节
+	MaxPublicKeySize = 65
+	// 签名中R和S的最大字节数
+	MaxSignatureScalarSize = 32
+	// 交易数据的最大字节数
+	MaxTxDataSize = 1 << 16
+	// 区块中交易数量的上限
+	MaxBlockTransactions = 1 << 16
 )
 
 type Encoder[T any] interface {
@@ -13,61 +28,112 @@ type Decoder[T any] interface {
 	Decode(T) error
 }
 
-type GobTxEncoder struct {
-	w io.Writer
+// writeTransactionBody 写入交易中参与计算哈希的字段
+func writeTransactionBody(w *utils.BinaryWriter, tx *Transaction) {
+	w.WriteUint32(tx.ChainID)
+	w.WriteBytes(tx.From)
+	w.WriteBytes(tx.To)
+	w.WriteBytes(tx.Data)
+	w.WriteUint64(tx.Value)
+	w.WriteUint64(tx.Fee)
+	w.WriteInt64(tx.Nonce)
+	w.WriteUint32(tx.ValidUntilHeight)
 }
 
-type GobTxDecoder struct {
-	r io.Reader
-}
-
-func NewGobTxEncoder(w io.Writer) *GobTxEncoder {
-	return &GobTxEncoder{
-		w: w,
+// WriteTransaction 写入完整的交易 包括哈希和签名
+func WriteTransaction(w *utils.BinaryWriter, tx *Transaction) {
+	writeTransactionBody(w, tx)
+	w.WriteFixed(tx.Hash[:])
+	w.WriteBool(tx.Signature != nil)
+	if tx.Signature != nil {
+		w.WriteBytes(scalarBytes(tx.Signature.R))
+		w.WriteBytes(scalarBytes(tx.Signature.S))
 	}
 }
 
-func (e *GobTxEncoder) Encode(tx *Transaction) error {
-	return gob.NewEncoder(e.w).Encode(tx)
+// ReadTransaction 按WriteTransaction的格式读取交易
+func ReadTransaction(r *utils.BinaryReader, tx *Transaction) {
+	tx.ChainID = r.ReadUint32()
+	tx.From = r.ReadBytes(MaxPublicKeySize)
+	tx.To = r.ReadBytes(MaxPublicKeySize)
+	tx.Data = r.ReadBytes(MaxTxDataSize)
+	tx.Value = r.ReadUint64()
+	tx.Fee = r.ReadUint64()
+	tx.Nonce = r.ReadInt64()
+	tx.ValidUntilHeight = r.ReadUint32()
+	r.ReadFixed(tx.Hash[:])
+	tx.Signature = nil
+	if r.ReadBool() {
+		tx.Signature = &cryptoo.Signature{
+			R: new(big.Int).SetBytes(r.ReadUnsigned(MaxSignatureScalarSize)),
+			S: new(big.Int).SetBytes(r.ReadUnsigned(MaxSignatureScalarSize)),
+		}
+	}
 }
 
-func NewGobTxDecoder(r io.Reader) *GobTxDecoder {
-	return &GobTxDecoder{
-		r: r,
+func scalarBytes(v *big.Int) []byte {
+	if v == nil {
+		return nil
 	}
+	return v.Bytes()
 }
 
-func (d *GobTxDecoder) Decode(tx *Transaction) error {
-	return gob.NewDecoder(d.r).Decode(tx)
+func WriteBlockHeader(w *utils.BinaryWriter, h *BlockHeader) {
+	w.WriteUint32(h.Version)
+	w.WriteFixed(h.PrevBlockHash[:])
+	w.WriteFixed(h.DataHash[:])
+	w.WriteUint32(h.Height)
+	w.WriteInt64(h.Timestamp)
+	w.WriteUint32(h.Nonce)
+	w.WriteFixed(h.StateRoot[:])
 }
 
-type GobBlockEncoder struct {
-	w io.Writer
+func ReadBlockHeader(r *utils.BinaryReader, h *BlockHeader) {
+	h.Version = r.ReadUint32()
+	r.ReadFixed(h.PrevBlockHash[:])
+	r.ReadFixed(h.DataHash[:])
+	h.Height = r.ReadUint32()
+	h.Timestamp = r.ReadInt64()
+	h.Nonce = r.ReadUint32()
+	r.ReadFixed(h.StateRoot[:])
 }
 
-func NewGobBlockEncoder(w io.Writer) *GobBlockEncoder {
-	return &GobBlockEncoder{
-		w: w,
+// WriteBlock 写入区块头 交易数量和所有交易
+func WriteBlock(w *utils.BinaryWriter, b *Block) {
+	WriteBlockHeader(w, b.Header)
+	w.WriteUint32(uint32(len(b.Transactions)))
+	for _, tx := range b.Transactions {
+		WriteTransaction(w, tx)
 	}
 }
 
-func (e *GobBlockEncoder) Encode(block *Block) error {
-	return gob.NewEncoder(e.w).Encode(block)
+func ReadBlock(r *utils.BinaryReader, b *Block) {
+	b.Header = new(BlockHeader)
+	ReadBlockHeader(r, b.Header)
+	n := r.ReadLength(MaxBlockTransactions)
+	b.Transactions = make([]*Transaction, 0, n)
+	for i := uint32(0); i < n && r.Err() == nil; i++ {
+		tx := new(Transaction)
+		ReadTransaction(r, tx)
+		b.Transactions = append(b.Transactions, tx)
+	}
 }
 
-type GobBlockDecoder struct {
-	r io.Reader
+func WriteAccount(w *utils.BinaryWriter, a *Account) {
+	w.WriteFixed(a.Address[:])
+	w.WriteUint64(a.Balance)
+	w.WriteInt64(a.Nonce)
 }
 
-func NewGobBlockDecoder(r io.Reader) *GobBlockDecoder {
-	return &GobBlockDecoder{
-		r: r,
-	}
+func ReadAccount(r *utils.BinaryReader, a *Account) {
+	r.ReadFixed(a.Address[:])
+	a.Balance = r.ReadUint64()
+	a.Nonce = r.ReadInt64()
 }
 
-func (d *GobBlockDecoder) Decoder(block *Block) error {
-	return gob.NewDecoder(d.r).Decode(block)
+// hashTransactionBody 计算交易哈希 只包含交易本身的字段 不包含哈希和签名
+func hashTransactionBody(tx *Transaction) types.Hash {
+	buf := &bytes.Buffer{}
+	writeTransactionBody(utils.NewBinaryWriter(buf), tx)
+	return types.HashFromBytes(utils.SHA256(buf.Bytes()))
 }
-
-// 新的
-
@@ -0,0 +1,118 @@
+package core
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+var ErrJournalClosed = errors.New("交易日志未打开")
+
+// TxJournal 把本地提交的交易追加写入日志文件 节点重启后可以重新加载
+type TxJournal struct {
+	mu     sync.Mutex
+	path   string
+	writer *os.File
+}
+
+// NewTxJournal 创建交易日志 在Load之后调用Rotate才会打开文件用于写入
+func NewTxJournal(path string) *TxJournal {
+	return &TxJournal{
+		path: path,
+	}
+}
+
+// Load 读取日志文件中的所有交易 文件不存在时返回空列表
+// 文件末尾不完整的交易会被忽略
+func (j *TxJournal) Load() ([]*Transaction, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	f, err := os.Open(j.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	txs := make([]*Transaction, 0)
+	r := bufio.NewReader(f)
+	for {
+		tx := new(Transaction)
+		if err := tx.Decode(r); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return txs, err
+		}
+		txs = append(txs, tx)
+	}
+	return txs, nil
+}
+
+// Insert 追加一笔交易到日志文件
+func (j *TxJournal) Insert(tx *Transaction) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.writer == nil {
+		return ErrJournalClosed
+	}
+	return tx.Encode(j.writer)
+}
+
+// Rotate 用当前仍然有效的本地交易重写日志文件 并重新打开文件用于追加
+func (j *TxJournal) Rotate(txs []*Transaction) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.writer != nil {
+		if err := j.writer.Close(); err != nil {
+			return err
+		}
+		j.writer = nil
+	}
+
+	// 先写到临时文件 再替换原文件 避免写到一半时丢失日志
+	tmp := j.path + ".new"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	for _, tx := range txs {
+		if err := tx.Encode(f); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, j.path); err != nil {
+		return err
+	}
+
+	writer, err := os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	j.writer = writer
+	return nil
+}
+
+// Close 关闭日志文件
+func (j *TxJournal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.writer == nil {
+		return nil
+	}
+	err := j.writer.Close()
+	j.writer = nil
+	return err
+}
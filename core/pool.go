@@ -1,30 +1,138 @@
 package core
 
 import (
+	"bytes"
 	"container/heap"
 	"errors"
 	"go-chain/types"
+	"math"
+	"math/bits"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/samber/lo"
 )
 
+// defaultSortFunc 按手续费排序 手续费相同时按value排序
 var defaultSortFunc = func(a, b *Transaction) bool {
+	if a.Fee != b.Fee {
+		return a.Fee < b.Fee
+	}
 	return a.Value < b.Value
 }
 
+// 替换交易时 新交易的手续费至少要比原交易高出的百分比
+const defaultPriceBump = 10
+
+// 每个发送者在交易池中默认最多可以占用的交易数量
+const defaultAccountSlots = 64
+
+// 交易在交易池中默认的最长存活时间
+const defaultTxLifetime = 3 * time.Hour
+
 var (
-	ErrTxAlreadyInPool = errors.New("交易已存在于交易池中")
-	ErrPoolIsFull      = errors.New("交易池已满")
+	ErrTxAlreadyInPool    = errors.New("交易已存在于交易池中")
+	ErrPoolIsFull         = errors.New("交易池已满")
+	ErrNonceTooLow        = errors.New("交易nonce过低")
+	ErrReplaceUnderpriced = errors.New("替换交易的手续费不足")
+	ErrAccountSlotsFull   = errors.New("发送者在交易池中的交易数量已达上限")
+	ErrTxAlreadyKnown     = errors.New("交易已经被打包上链")
 )
 
 // TxPool 表示交易池
+// all保存池子里的所有交易 并按照value淘汰交易
+// 每个发送者的交易按nonce分为两类: pending中是nonce连续 可以直接执行的交易
+// queue中是nonce不连续 需要等待前面的交易到达后才能执行的交易
 type TxPool struct {
-	mu       sync.RWMutex
-	all      *TxSortedStore
-	pending  *TxSortedStore
-	allSize  int
-	pendingSize int
+	mu      sync.RWMutex
+	all     *TxSortedStore
+	pending map[types.Address]*txList
+	queue   map[types.Address]*txList
+	// 每个发送者下一个可以进入pending的nonce
+	nonces       map[types.Address]int64
+	pendingCount int
+	allSize      int
+	pendingSize  int
+	// 用于获取账户当前的状态 为nil时所有账户的nonce都从0开始
+	state func() StateReader
+	// 替换相同nonce的交易时 手续费需要提高的百分比
+	priceBump uint64
+	chainID   uint32
+	// 用于获取当前链的高度 为nil时不检查交易的ValidUntilHeight
+	height func() uint32
+	// 每个交易进入交易池的时间
+	arrivals map[types.Hash]time.Time
+	// 获取当前时间 记录交易进入交易池的时间
+	now func() time.Time
+	// 交易在交易池中的最长存活时间
+	lifetime time.Duration
+	// 本地提交的交易 节点重启时需要从日志中恢复
+	locals map[types.Hash]struct{}
+	// 因为账户状态暂时无法进入交易池的本地交易 每次Reset之后重试
+	parked map[types.Hash]*Transaction
+	// 每个发送者在pending和queue中最多可以占用的交易数量
+	accountSlots int
+	// 用于判断交易是否已经上链 为nil时不检查
+	txIndex func(types.Hash) bool
+}
+
+type TxPoolOption func(*TxPool)
+
+// WithPriceBump 设置替换交易时手续费需要提高的百分比
+func WithPriceBump(percent uint64) TxPoolOption {
+	return func(pool *TxPool) {
+		pool.priceBump = percent
+	}
+}
+
+// WithPoolChainID 设置交易池接受的交易链ID
+func WithPoolChainID(chainID uint32) TxPoolOption {
+	return func(pool *TxPool) {
+		pool.chainID = chainID
+	}
+}
+
+// WithHeightProvider 设置交易池获取当前链高度的方式
+func WithHeightProvider(provider func() uint32) TxPoolOption {
+	return func(pool *TxPool) {
+		pool.height = provider
+	}
+}
+
+// WithPoolClock 设置交易池获取当前时间的方式 与淘汰过期交易时传入的时间使用同一个时钟
+func WithPoolClock(now func() time.Time) TxPoolOption {
+	return func(pool *TxPool) {
+		pool.now = now
+	}
+}
+
+// WithTxLifetime 设置交易在交易池中的最长存活时间
+func WithTxLifetime(lifetime time.Duration) TxPoolOption {
+	return func(pool *TxPool) {
+		pool.lifetime = lifetime
+	}
+}
+
+// WithAccountSlots 设置每个发送者在交易池中最多可以占用的交易数量
+func WithAccountSlots(slots int) TxPoolOption {
+	return func(pool *TxPool) {
+		pool.accountSlots = slots
+	}
+}
+
+// WithTxIndex 设置链上交易索引 已经上链的交易不会再进入交易池
+func WithTxIndex(index func(types.Hash) bool) TxPoolOption {
+	return func(pool *TxPool) {
+		pool.txIndex = index
+	}
+}
+
+// WithStateProvider 设置交易池获取账户状态的方式
+func WithStateProvider(provider func() StateReader) TxPoolOption {
+	return func(pool *TxPool) {
+		pool.state = provider
+	}
 }
 
 func (pool *TxPool) GetAllSize() int {
@@ -35,46 +143,422 @@ func (pool *TxPool) GetMaxAllSize() int {
 	return pool.all.GetMaxSize()
 }
 
-
 func (pool *TxPool) GetPendingSize() int {
-	return pool.pending.Len()
+	pool.mu.RLock()
+	defer pool.mu.RUnlock()
+	return pool.pendingCount
 }
 
 func (pool *TxPool) GetMaxPendingSize() int {
-	return pool.pending.GetMaxSize()
+	return pool.pendingSize
 }
 
 // NewTxPool 创建一个新的交易池
-
-// NewTxPool 创建一个新的交易池
-func NewTxPool(allSize, pendingSize int) *TxPool {
-	return &TxPool{
-		mu:       sync.RWMutex{},
-		all:      NewTxSortedStore(allSize),
-		pending:  NewTxSortedStore(pendingSize),
-		allSize:  allSize,
-		pendingSize: pendingSize,
+func NewTxPool(allSize, pendingSize int, options ...TxPoolOption) *TxPool {
+	pool := &TxPool{
+		mu:           sync.RWMutex{},
+		all:          NewTxSortedStore(allSize),
+		pending:      make(map[types.Address]*txList),
+		queue:        make(map[types.Address]*txList),
+		nonces:       make(map[types.Address]int64),
+		allSize:      allSize,
+		pendingSize:  pendingSize,
+		priceBump:    defaultPriceBump,
+		chainID:      DefaultChainID,
+		arrivals:     make(map[types.Hash]time.Time),
+		now:          time.Now,
+		lifetime:     defaultTxLifetime,
+		locals:       make(map[types.Hash]struct{}),
+		parked:       make(map[types.Hash]*Transaction),
+		accountSlots: defaultAccountSlots,
 	}
+	for _, option := range options {
+		option(pool)
+	}
+	return pool
 }
 
 // Add 向交易池中添加交易
+// 交易先放入发送者的queue 再把nonce连续的交易提升到pending
 func (pool *TxPool) Add(txs []*Transaction) error {
 	pool.mu.Lock()
 	defer pool.mu.Unlock()
 
+	var errs []error
 	lo.ForEach(txs, func(tx *Transaction, _ int) {
-		pool.all.Add(tx)
-		pool.pending.Add(tx)
+		if err := pool.add(tx); err != nil {
+			errs = append(errs, err)
+		}
+	})
+
+	return errors.Join(errs...)
+}
+
+// AddLocals 添加本地提交的交易 成功加入的交易会被标记为本地交易
+func (pool *TxPool) AddLocals(txs []*Transaction) error {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	var errs []error
+	lo.ForEach(txs, func(tx *Transaction, _ int) {
+		if err := pool.add(tx); err != nil {
+			errs = append(errs, err)
+			return
+		}
+		pool.locals[tx.CalHash()] = struct{}{}
+	})
+
+	return errors.Join(errs...)
+}
+
+// RestoreLocals 恢复节点重启前提交的本地交易
+// 本地的账户状态还没有同步到最新时 交易可能暂时余额不足 这类交易会保留下来 每次Reset之后重试
+// 只有交易本身无效或者nonce已经被使用的交易才会被丢弃 返回丢弃的原因
+func (pool *TxPool) RestoreLocals(txs []*Transaction) error {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	var errs []error
+	for _, tx := range txs {
+		if err := pool.addLocal(tx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// addLocal 添加本地交易 因为账户状态暂时无法加入的交易放入parked等待重试
+func (pool *TxPool) addLocal(tx *Transaction) error {
+	hash := tx.CalHash()
+	err := pool.add(tx)
+	// 已经从其他节点收到了同一笔交易 仍然算作本地交易
+	if err == nil || errors.Is(err, ErrTxAlreadyInPool) {
+		delete(pool.parked, hash)
+		pool.locals[hash] = struct{}{}
+		return nil
+	}
+	if isStateTxErr(err) {
+		pool.park(tx)
+		return nil
+	}
+	delete(pool.parked, hash)
+	return err
+}
+
+// park 保留暂时无法进入交易池的本地交易 到达时间不变 仍然按最长存活时间淘汰
+func (pool *TxPool) park(tx *Transaction) {
+	hash := tx.CalHash()
+	pool.parked[hash] = tx
+	if _, ok := pool.arrivals[hash]; !ok {
+		pool.arrivals[hash] = pool.now()
+	}
+}
+
+// isStateTxErr 判断交易是否只是因为当前的账户状态或者交易池的容量暂时无法加入
+func isStateTxErr(err error) bool {
+	return errors.Is(err, ErrInsufficientFunds) ||
+		errors.Is(err, ErrPoolIsFull) ||
+		errors.Is(err, ErrAccountSlotsFull)
+}
+
+// Locals 获取仍在交易池中的本地交易 以及等待重试的本地交易 按发送者和nonce排序
+// 已经离开交易池的交易会同时从本地交易中删除
+func (pool *TxPool) Locals() []*Transaction {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	locals := make([]*Transaction, 0, len(pool.locals)+len(pool.parked))
+	for hash := range pool.locals {
+		tx := pool.all.Get(hash)
+		if tx == nil {
+			delete(pool.locals, hash)
+			continue
+		}
+		locals = append(locals, tx)
+	}
+	for _, tx := range pool.parked {
+		locals = append(locals, tx)
+	}
+	sortBySender(locals)
+	return locals
+}
+
+// sortBySender 按发送者和nonce排序 同一个发送者的交易按nonce从小到大排列
+func sortBySender(txs []*Transaction) {
+	sort.Slice(txs, func(i, j int) bool {
+		a, b := txs[i].From.Address(), txs[j].From.Address()
+		if a != b {
+			return bytes.Compare(a[:], b[:]) < 0
+		}
+		return txs[i].Nonce < txs[j].Nonce
 	})
+}
 
+func (pool *TxPool) add(tx *Transaction) error {
+	hash := tx.CalHash()
+	if pool.all.Get(hash) != nil {
+		return ErrTxAlreadyInPool
+	}
+	if pool.txIndex != nil && pool.txIndex(hash) {
+		return ErrTxAlreadyKnown
+	}
+	if err := pool.validateTx(tx); err != nil {
+		return err
+	}
+	from := tx.From.Address()
+	if existing := pool.findByNonce(from, tx.Nonce); existing != nil {
+		return pool.replace(existing, tx)
+	}
+	// 替换交易不占用新的位置 只限制新增的交易
+	if pool.accountSlots > 0 && pool.senderTxCount(from) >= pool.accountSlots {
+		return ErrAccountSlotsFull
+	}
+
+	added, evicted := pool.all.Add(tx)
+	if !added {
+		return ErrPoolIsFull
+	}
+	if evicted != nil {
+		pool.removeFromLists(evicted)
+	}
+
+	// 等待重试的本地交易保留最初的到达时间
+	if _, ok := pool.arrivals[hash]; !ok {
+		pool.arrivals[hash] = pool.now()
+	}
+	pool.listOf(pool.queue, from).Put(tx)
+	pool.promote(from)
 	return nil
 }
 
+// senderTxCount 发送者在pending和queue中的交易数量
+func (pool *TxPool) senderTxCount(addr types.Address) int {
+	count := 0
+	if list, ok := pool.pending[addr]; ok {
+		count += list.Len()
+	}
+	if list, ok := pool.queue[addr]; ok {
+		count += list.Len()
+	}
+	return count
+}
 
-// GetPendingTxs 获取待处理的交易
+// replace 用手续费更高的交易替换发送者相同nonce的交易 同时更新all和pending/queue
+func (pool *TxPool) replace(old *Transaction, tx *Transaction) error {
+	if pool.underpriced(old, tx) {
+		return ErrReplaceUnderpriced
+	}
+	from := tx.From.Address()
+	pending := pool.pending[from]
+	inPending := pending != nil && pending.Get(tx.Nonce) == old
+	// 替换pending中的交易后 pending中所有交易的花费仍然不能超过账户余额
+	if inPending && pool.state != nil {
+		spent := uint64(0)
+		for _, pendingTx := range pending.txs {
+			if pendingTx == old {
+				pendingTx = tx
+			}
+			spent = addCost(spent, pendingTx.Cost())
+		}
+		if spent > pool.stateBalance(from) {
+			return ErrInsufficientFunds
+		}
+	}
+	pool.all.Remove(old)
+	if added, evicted := pool.all.Add(tx); !added {
+		pool.all.Add(old)
+		return ErrPoolIsFull
+	} else if evicted != nil {
+		pool.removeFromLists(evicted)
+	}
+	delete(pool.arrivals, old.CalHash())
+	pool.arrivals[tx.CalHash()] = pool.now()
+
+	if inPending {
+		pending.Put(tx)
+		return nil
+	}
+	pool.listOf(pool.queue, from).Put(tx)
+	return nil
+}
+
+// underpriced 新交易的手续费是否没有比原交易高出priceBump百分比
+// 手续费可以接近uint64的上限 乘法使用128位结果比较 避免溢出后绕回很小的值
+func (pool *TxPool) underpriced(old *Transaction, tx *Transaction) bool {
+	if tx.Fee <= old.Fee {
+		return true
+	}
+	newHi, newLo := bits.Mul64(tx.Fee, 100)
+	oldHi, oldLo := bits.Mul64(old.Fee, 100+pool.priceBump)
+	return newHi < oldHi || (newHi == oldHi && newLo < oldLo)
+}
+
+// stateNonce 获取账户在链上状态中的nonce
+func (pool *TxPool) stateNonce(addr types.Address) int64 {
+	if pool.state == nil {
+		return 0
+	}
+	return pool.state().GetNonce(addr)
+}
+
+// stateBalance 获取账户在链上状态中的余额
+func (pool *TxPool) stateBalance(addr types.Address) uint64 {
+	if pool.state == nil {
+		return 0
+	}
+	return pool.state().GetBalance(addr)
+}
+
+// pendingCost 计算发送者pending中所有交易的花费
+func (pool *TxPool) pendingCost(addr types.Address) uint64 {
+	list := pool.pending[addr]
+	if list == nil {
+		return 0
+	}
+	cost := uint64(0)
+	for _, tx := range list.txs {
+		cost = addCost(cost, tx.Cost())
+	}
+	return cost
+}
+
+// addCost 累加花费 溢出时返回math.MaxUint64
+func addCost(a uint64, b uint64) uint64 {
+	if a > math.MaxUint64-b {
+		return math.MaxUint64
+	}
+	return a + b
+}
+
+// nextNonce 获取发送者下一个可以进入pending的nonce
+func (pool *TxPool) nextNonce(addr types.Address) int64 {
+	if nonce, ok := pool.nonces[addr]; ok {
+		return nonce
+	}
+	nonce := pool.stateNonce(addr)
+	pool.nonces[addr] = nonce
+	return nonce
+}
+
+func (pool *TxPool) listOf(lists map[types.Address]*txList, addr types.Address) *txList {
+	list := lists[addr]
+	if list == nil {
+		list = newTxList()
+		lists[addr] = list
+	}
+	return list
+}
+
+func (pool *TxPool) findByNonce(addr types.Address, nonce int64) *Transaction {
+	if list := pool.pending[addr]; list != nil {
+		if tx := list.Get(nonce); tx != nil {
+			return tx
+		}
+	}
+	if list := pool.queue[addr]; list != nil {
+		return list.Get(nonce)
+	}
+	return nil
+}
+
+// promote 把发送者queue中nonce连续的交易提升到pending
+func (pool *TxPool) promote(addr types.Address) {
+	queue := pool.queue[addr]
+	if queue == nil {
+		return
+	}
+	next := pool.nextNonce(addr)
+	// pending中所有交易的花费不能超过账户余额
+	spent, balance := pool.pendingCost(addr), pool.stateBalance(addr)
+	for pool.pendingCount < pool.pendingSize {
+		tx := queue.Get(next)
+		if tx == nil || (pool.state != nil && addCost(spent, tx.Cost()) > balance) {
+			break
+		}
+		queue.Remove(next)
+		spent = addCost(spent, tx.Cost())
+		pool.listOf(pool.pending, addr).Put(tx)
+		pool.pendingCount++
+		next++
+	}
+	pool.nonces[addr] = next
+	pool.cleanup(addr)
+}
+
+// demote 发送者pending中nonce为nonce的交易被移除后 之后的交易不再连续 退回到queue
+func (pool *TxPool) demote(addr types.Address, nonce int64) {
+	pending := pool.pending[addr]
+	if pending == nil {
+		return
+	}
+	moved := pending.Filter(func(tx *Transaction) bool {
+		return tx.Nonce > nonce
+	})
+	for _, tx := range moved {
+		pool.listOf(pool.queue, addr).Put(tx)
+	}
+	pool.pendingCount -= len(moved)
+	if next, ok := pool.nonces[addr]; ok && nonce < next {
+		pool.nonces[addr] = nonce
+	}
+	pool.cleanup(addr)
+}
+
+// removeFromLists 从pending或queue中移除交易 不会修改all
+func (pool *TxPool) removeFromLists(tx *Transaction) {
+	from := tx.From.Address()
+	if list := pool.pending[from]; list != nil && list.Get(tx.Nonce) == tx {
+		list.Remove(tx.Nonce)
+		pool.pendingCount--
+		pool.demote(from, tx.Nonce)
+	}
+	if list := pool.queue[from]; list != nil && list.Get(tx.Nonce) == tx {
+		list.Remove(tx.Nonce)
+	}
+	pool.cleanup(from)
+}
+
+func (pool *TxPool) cleanup(addr types.Address) {
+	if list := pool.pending[addr]; list != nil && list.Len() == 0 {
+		delete(pool.pending, addr)
+	}
+	if list := pool.queue[addr]; list != nil && list.Len() == 0 {
+		delete(pool.queue, addr)
+	}
+}
+
+// GetPendingTxs 获取待处理的交易 按打包顺序排列
 func (pool *TxPool) GetPendingTxs() (pendings []*Transaction) {
-	pendings = append(pendings, pool.pending.GetAll()...)
-	return pendings
+	pool.mu.RLock()
+	defer pool.mu.RUnlock()
+	return pool.orderedPending()
+}
+
+// orderedPending 每次从所有发送者pending的第一笔交易中选出手续费最高的 手续费相同时选value更高的
+// 保证同一个发送者的交易按nonce顺序排列
+func (pool *TxPool) orderedPending() []*Transaction {
+	ordered := make([]*Transaction, 0, pool.pendingCount)
+	lists := make(map[types.Address][]*Transaction, len(pool.pending))
+	heads := make([]*Transaction, 0, len(pool.pending))
+	for addr, list := range pool.pending {
+		sorted := list.Sorted()
+		lists[addr] = sorted[1:]
+		heads = append(heads, sorted[0])
+	}
+
+	h := types.NewMinHeap(heads, func(a, b *Transaction) bool {
+		return defaultSortFunc(b, a)
+	})
+	for h.Len() > 0 {
+		best := heap.Pop(h).(*Transaction)
+		ordered = append(ordered, best)
+		from := best.From.Address()
+		if rest := lists[from]; len(rest) > 0 {
+			heap.Push(h, rest[0])
+			lists[from] = rest[1:]
+		}
+	}
+	return ordered
 }
 
 // GetPendingTxs 获取待处理的交易
@@ -84,40 +568,163 @@ func (pool *TxPool) GetAllTxs() (all []*Transaction) {
 }
 
 // 从pending里打包交易 并清空pending
+// 打包的交易仍然保留在all中 直到区块上链后通过RemovePendingTxs或Reset移除
+// 清空pending后发送者的nonce仍然停留在打包的交易之后 之后加入的交易直接接在打包的交易后面
+// 区块没有上链时需要调用Reset 按链上的状态重新计算nonce 打包的交易重新回到pending
 func (pool *TxPool) GetPendingTxsForPacking() (packedTxs []*Transaction, err error) {
 	pool.mu.Lock()
 	defer pool.mu.Unlock()
 
-	if pool.pending.Len() == 0 {
+	if pool.pendingCount == 0 {
 		return nil, nil
 	}
-	packedTxs = pool.GetPendingTxs()
-	pool.ClearPending()
+	packedTxs = pool.orderedPending()
+	pool.clearPending()
 
 	return packedTxs, nil
 }
 
+// RemovePendingTxs 移除已经上链的交易 发送者之后的交易可以继续进入pending
 func (pool *TxPool) RemovePendingTxs(txs []*Transaction) {
 	pool.mu.Lock()
 	defer pool.mu.Unlock()
-	// 从pending里删除交易
+
+	senders := make(map[types.Address]bool)
 	for _, tx := range txs {
-		pool.pending.Remove(tx)
+		from := tx.From.Address()
+		senders[from] = true
+		if stored := pool.all.Get(tx.CalHash()); stored != nil {
+			pool.all.Remove(stored)
+			pool.removeFromLists(stored)
+		}
+		if tx.Nonce+1 > pool.nextNonce(from) {
+			pool.nonces[from] = tx.Nonce + 1
+		}
+	}
+	for from := range senders {
+		pool.dropStale(from, pool.nonces[from])
+		pool.promote(from)
+	}
+}
+
+// dropStale 删除发送者queue中nonce小于nonce的交易
+func (pool *TxPool) dropStale(addr types.Address, nonce int64) {
+	queue := pool.queue[addr]
+	if queue == nil {
+		return
+	}
+	for _, tx := range queue.Filter(func(tx *Transaction) bool {
+		return tx.Nonce < nonce
+	}) {
+		pool.all.Remove(tx)
+	}
+	pool.cleanup(addr)
+}
+
+// Reset 在新区块上链后根据最新的账户状态重新整理交易池
+// 删除nonce已经被使用或者余额已经不足以支付的交易 其余的交易重新按nonce分到pending和queue
+// 余额不足的本地交易不删除 和之前暂时无法加入的本地交易一起重试 返回重试后加入交易池的本地交易
+func (pool *TxPool) Reset(state StateReader) []*Transaction {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	pool.pending = make(map[types.Address]*txList)
+	pool.queue = make(map[types.Address]*txList)
+	pool.nonces = make(map[types.Address]int64)
+	pool.pendingCount = 0
+
+	all := append([]*Transaction{}, pool.all.GetAll()...)
+	for _, tx := range all {
+		from := tx.From.Address()
+		if _, ok := pool.nonces[from]; !ok {
+			pool.nonces[from] = state.GetNonce(from)
+		}
+		if tx.Nonce < pool.nonces[from] || state.GetBalance(from) < tx.Cost() {
+			pool.all.Remove(tx)
+			if _, local := pool.locals[tx.CalHash()]; local && tx.Nonce >= pool.nonces[from] {
+				delete(pool.locals, tx.CalHash())
+				pool.park(tx)
+			}
+			continue
+		}
+		pool.listOf(pool.queue, from).Put(tx)
+	}
+	for from := range pool.queue {
+		pool.promote(from)
+	}
+
+	parked := make([]*Transaction, 0, len(pool.parked))
+	for _, tx := range pool.parked {
+		parked = append(parked, tx)
 	}
-	newTxs := make([]*Transaction, 0, len(pool.pending.lookup))
-	for _, tx := range pool.pending.lookup {
-		newTxs = append(newTxs, tx)
+	sortBySender(parked)
+	restored := make([]*Transaction, 0)
+	for _, tx := range parked {
+		if pool.addLocal(tx) == nil && pool.parked[tx.CalHash()] == nil {
+			restored = append(restored, tx)
+		}
 	}
-	pool.pending.ResetTree(newTxs)
+	return restored
 }
 
+// EvictExpired 删除在交易池中存活超过最长时间 或者已经无法进入下一个区块的交易
+// 返回被删除的交易
+func (pool *TxPool) EvictExpired(now time.Time) []*Transaction {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	var nextHeight uint32
+	if pool.height != nil {
+		nextHeight = pool.height() + 1
+	}
+
+	evicted := make([]*Transaction, 0)
+	all := append([]*Transaction{}, pool.all.GetAll()...)
+	for _, tx := range all {
+		hash := tx.CalHash()
+		arrival, ok := pool.arrivals[hash]
+		expired := ok && pool.lifetime > 0 && now.Sub(arrival) > pool.lifetime
+		if !expired && (nextHeight == 0 || !tx.ExpiredAt(nextHeight)) {
+			continue
+		}
+		pool.all.Remove(tx)
+		pool.removeFromLists(tx)
+		delete(pool.arrivals, hash)
+		evicted = append(evicted, tx)
+	}
+	for hash, tx := range pool.parked {
+		arrival, ok := pool.arrivals[hash]
+		expired := ok && pool.lifetime > 0 && now.Sub(arrival) > pool.lifetime
+		if !expired && (nextHeight == 0 || !tx.ExpiredAt(nextHeight)) {
+			continue
+		}
+		delete(pool.parked, hash)
+		delete(pool.arrivals, hash)
+		evicted = append(evicted, tx)
+	}
+
+	// 清理已经不在交易池中的交易的到达时间
+	for hash := range pool.arrivals {
+		if pool.all.Get(hash) == nil && pool.parked[hash] == nil {
+			delete(pool.arrivals, hash)
+		}
+	}
+	return evicted
+}
 
 func (pool *TxPool) Get(hash types.Hash) *Transaction {
 	return pool.all.Get(hash)
 }
 
 func (pool *TxPool) ClearPending() {
-	pool.pending.Clear()
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	pool.clearPending()
+}
+
+func (pool *TxPool) clearPending() {
+	pool.pending = make(map[types.Address]*txList)
+	pool.pendingCount = 0
 }
 
 func (pool *TxPool) ClearAll() {
@@ -125,49 +732,72 @@ func (pool *TxPool) ClearAll() {
 	defer pool.mu.Unlock()
 
 	pool.all.Clear()
+	pool.arrivals = make(map[types.Hash]time.Time)
+	pool.locals = make(map[types.Hash]struct{})
+	pool.parked = make(map[types.Hash]*Transaction)
+	pool.pending = make(map[types.Address]*txList)
+	pool.queue = make(map[types.Address]*txList)
+	pool.nonces = make(map[types.Address]int64)
+	pool.pendingCount = 0
 }
 
-
 type TxSortedStore struct {
-	mu sync.RWMutex
+	mu     sync.RWMutex
 	lookup map[types.Hash]*Transaction
-	txx *types.MinHeap[*Transaction]
+	txx    *types.MinHeap[*Transaction]
+	// 每个交易在堆中的位置 删除交易时不需要重建整个堆
+	index   map[*Transaction]int
 	maxSize int
 }
 
 // NewTxSortedStore 创建一个新的TxSortedStore
 func NewTxSortedStore(maxSize int) *TxSortedStore {
-	return &TxSortedStore{
-		mu: sync.RWMutex{},
-		lookup: make(map[types.Hash]*Transaction),
-		txx: types.NewMinHeap[*Transaction](make([]*Transaction, 0), defaultSortFunc),
+	s := &TxSortedStore{
+		mu:      sync.RWMutex{},
+		lookup:  make(map[types.Hash]*Transaction),
 		maxSize: maxSize,
 	}
+	s.resetHeap(make([]*Transaction, 0))
+	return s
+}
+
+// resetHeap 用txs重建堆和位置索引 调用时需要持有s.mu
+func (s *TxSortedStore) resetHeap(txs []*Transaction) {
+	s.index = make(map[*Transaction]int, len(txs))
+	s.txx = types.NewIndexedMinHeap(txs, defaultSortFunc, func(tx *Transaction, i int) {
+		if i < 0 {
+			delete(s.index, tx)
+			return
+		}
+		s.index[tx] = i
+	})
 }
 
 // Add 添加一个交易到存储中 维持前maxsize个value的交易
-func (s *TxSortedStore) Add(tx *Transaction) {
+// 返回交易是否被加入 以及因此被淘汰的交易
+func (s *TxSortedStore) Add(tx *Transaction) (added bool, evicted *Transaction) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	hash := tx.CalHash()
 	// 每次检查长度 pop时 保持loopup和tree里面的交易是一致的
 	if _, exists := s.lookup[hash]; exists {
-		return 
+		return false, nil
 	}
 	// 长度大于的时候  顶掉
 	if s.txx.Len() >= s.maxSize {
 		// 如果比堆顶还小 那就不插入了
 		
 		peeked := s.txx.Peek().(*Transaction)
-		if tx.Value <= peeked.Value {
-			return 
+		if !defaultSortFunc(peeked, tx) {
+			return false, nil
 		}
-		poped := heap.Pop(s.txx).(*Transaction)
-		delete(s.lookup, poped.CalHash())
+		evicted = heap.Pop(s.txx).(*Transaction)
+		delete(s.lookup, evicted.CalHash())
 	}
 	s.lookup[hash] = tx
 	heap.Push(s.txx, tx)
+	return true, evicted
 }
 
 func (s *TxSortedStore) Get(hash types.Hash) *Transaction {
@@ -194,7 +824,14 @@ func (s *TxSortedStore) GetAll() []*Transaction {
 func (s *TxSortedStore) Remove(tx *Transaction) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	delete(s.lookup, tx.CalHash())
+	hash := tx.CalHash()
+	stored, exists := s.lookup[hash]
+	if !exists {
+		return
+	}
+	delete(s.lookup, hash)
+	// 同时按位置从堆中删除 保持lookup和堆一致
+	s.txx.Remove(s.index[stored])
 }
 
 func (s *TxSortedStore) Clear() {
@@ -202,13 +839,13 @@ func (s *TxSortedStore) Clear() {
 	defer s.mu.Unlock()
 	// 清空lookup和tree
 	s.lookup = make(map[types.Hash]*Transaction)
-	s.txx = types.NewMinHeap(make([]*Transaction, 0), defaultSortFunc)
+	s.resetHeap(make([]*Transaction, 0))
 }
 
 func (s *TxSortedStore) ResetTree(txs []*Transaction) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.txx = types.NewMinHeap(txs, defaultSortFunc)
+	s.resetHeap(txs)
 }
 
 func (s *TxSortedStore) GetMaxSize() int {
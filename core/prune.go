@@ -0,0 +1,69 @@
+package core
+
+// PruneMode 表示区块链存储的裁剪模式
+type PruneMode byte
+
+const (
+	// PruneModeArchive 归档模式 保留所有区块和状态差异
+	PruneModeArchive PruneMode = iota
+	// PruneModeBlocks 只保留最近KeepBlocks个区块的区块体 状态差异全部保留
+	PruneModeBlocks
+	// PruneModeState 除了裁剪区块体外 只保留最近KeepDiffs个区块的状态差异
+	PruneModeState
+)
+
+// PruneConfig 区块链存储的裁剪配置
+type PruneConfig struct {
+	Mode PruneMode
+	// KeepBlocks 保留的最近区块体数量
+	KeepBlocks uint32
+	// KeepDiffs 保留的最近状态差异数量
+	KeepDiffs uint32
+}
+
+func (c PruneConfig) pruneBlocks() bool {
+	return c.Mode != PruneModeArchive && c.KeepBlocks > 0
+}
+
+func (c PruneConfig) pruneState() bool {
+	return c.Mode == PruneModeState && c.KeepDiffs > 0
+}
+
+// prune 按照裁剪配置删除旧的区块体和状态差异 调用方需持有bc.mu
+func (bc *Blockchain) prune() {
+	tip := uint32(len(bc.blocks) - 1)
+
+	if bc.pruneConfig.pruneBlocks() && tip+1 > bc.pruneConfig.KeepBlocks {
+		newLowest := tip + 1 - bc.pruneConfig.KeepBlocks
+		// 最新快照的锚定区块需要保留 用于给快速同步的节点提供
+		if len(bc.snapshots) > 0 {
+			if anchor := bc.snapshots[len(bc.snapshots)-1].Height; anchor < newLowest {
+				newLowest = anchor
+			}
+		}
+		for h := bc.lowest; h < newLowest; h++ {
+			block := bc.blocks[h]
+			if block == nil {
+				continue
+			}
+			delete(bc.blockStore, block.Hash())
+			for _, tx := range block.Transactions {
+				delete(bc.txStore, tx.CalHash())
+			}
+			bc.blocks[h] = nil
+		}
+		if newLowest > bc.lowest {
+			bc.lowest = newLowest
+		}
+	}
+
+	if bc.pruneConfig.pruneState() && tip > bc.pruneConfig.KeepDiffs {
+		newStateLowest := tip - bc.pruneConfig.KeepDiffs
+		for h := bc.stateLowest + 1; h <= newStateLowest; h++ {
+			bc.diffs[h] = nil
+		}
+		if newStateLowest > bc.stateLowest {
+			bc.stateLowest = newStateLowest
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"go-chain/types"
+	"go-chain/utils"
+	"sort"
+)
+
+var (
+	ErrSnapshotNotFound      = errors.New("快照未找到")
+	ErrSnapshotRootMismatch  = errors.New("快照状态根不匹配")
+	ErrSnapshotAnchorInvalid = errors.New("快照锚定区块无效")
+)
+
+// StateSnapshot 表示某个区块高度上的账户状态快照
+// 新节点可以直接下载快照 然后只同步快照之后的区块
+type StateSnapshot struct {
+	Height    uint32
+	BlockHash types.Hash
+	StateRoot types.Hash
+	// 按地址排序的账户
+	Accounts []*Account
+}
+
+// ChunkCount 按照每块size个账户计算快照的分块数量 至少为1
+func (snap *StateSnapshot) ChunkCount(size int) uint32 {
+	if size <= 0 || len(snap.Accounts) == 0 {
+		return 1
+	}
+	return uint32((len(snap.Accounts) + size - 1) / size)
+}
+
+// Chunk 获取第index个分块中的账户
+func (snap *StateSnapshot) Chunk(index uint32, size int) []*Account {
+	if size <= 0 {
+		return snap.Accounts
+	}
+	start := int(index) * size
+	if start >= len(snap.Accounts) {
+		return []*Account{}
+	}
+	end := start + size
+	if end > len(snap.Accounts) {
+		end = len(snap.Accounts)
+	}
+	return snap.Accounts[start:end]
+}
+
+// Verify 校验快照中的账户与状态根是否一致
+func (snap *StateSnapshot) Verify() error {
+	if CalculateStateRoot(snap.Accounts) != snap.StateRoot {
+		return ErrSnapshotRootMismatch
+	}
+	return nil
+}
+
+// CalculateStateRoot 计算账户列表的状态根 账户会先按地址排序
+func CalculateStateRoot(accounts []*Account) types.Hash {
+	sorted := make([]*Account, len(accounts))
+	copy(sorted, accounts)
+	sortAccounts(sorted)
+
+	buf := &bytes.Buffer{}
+	for _, account := range sorted {
+		buf.Write(account.Address[:])
+		binary.Write(buf, binary.LittleEndian, account.Balance)
+		binary.Write(buf, binary.LittleEndian, account.Nonce)
+	}
+	return types.HashFromBytes(utils.SHA256(buf.Bytes()))
+}
+
+func sortAccounts(accounts []*Account) {
+	sort.Slice(accounts, func(i, j int) bool {
+		return bytes.Compare(accounts[i].Address[:], accounts[j].Address[:]) < 0
+	})
+}
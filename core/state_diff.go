@@ -0,0 +1,89 @@
+package core
+
+import "go-chain/types"
+
+// AccountChange 记录一个账户在某个区块执行前后的状态
+type AccountChange struct {
+	Address types.Address
+	// Prev 为nil表示该账户在区块执行前不存在
+	Prev *Account
+	Post *Account
+}
+
+// StateDiff 表示执行某个区块对账户状态造成的改动
+type StateDiff struct {
+	Height  uint32
+	Changes []*AccountChange
+}
+
+// newStateDiff 在区块执行前记录区块涉及账户的原始状态
+func newStateDiff(state *AccountState, block *Block) *StateDiff {
+	diff := &StateDiff{
+		Height:  block.Height(),
+		Changes: make([]*AccountChange, 0),
+	}
+	seen := make(map[types.Address]bool)
+	track := func(addr types.Address) {
+		if seen[addr] {
+			return
+		}
+		seen[addr] = true
+		diff.Changes = append(diff.Changes, &AccountChange{
+			Address: addr,
+			Prev:    state.copyAccount(addr),
+		})
+	}
+	for _, tx := range block.Transactions {
+		track(tx.From.Address())
+		track(tx.To.Address())
+	}
+	return diff
+}
+
+// finish 在区块执行后记录账户的最新状态 并去掉没有变化的账户
+func (d *StateDiff) finish(state *AccountState) {
+	changes := make([]*AccountChange, 0, len(d.Changes))
+	for _, change := range d.Changes {
+		change.Post = state.copyAccount(change.Address)
+		if accountEqual(change.Prev, change.Post) {
+			continue
+		}
+		changes = append(changes, change)
+	}
+	d.Changes = changes
+}
+
+func accountEqual(a, b *Account) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// RevertState 撤销从fromHeight开始的所有区块对账户状态的改动
+// 需要对应高度的状态差异都还保留着 撤销后这些差异同时被删除 与当前的状态保持一致
+func (bc *Blockchain) RevertState(fromHeight uint32) error {
+	bc.stateLock.Lock()
+	defer bc.stateLock.Unlock()
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	if fromHeight == 0 || fromHeight > uint32(len(bc.diffs)) {
+		return ErrBlockNotFound
+	}
+	if fromHeight <= bc.stateLowest {
+		return ErrStatePruned
+	}
+	for h := uint32(len(bc.diffs) - 1); h >= fromHeight; h-- {
+		if bc.diffs[h] == nil {
+			return ErrStatePruned
+		}
+	}
+	for h := uint32(len(bc.diffs) - 1); h >= fromHeight; h-- {
+		for _, change := range bc.diffs[h].Changes {
+			bc.accountState.restoreAccount(change.Address, change.Prev)
+		}
+	}
+	bc.diffs = bc.diffs[:fromHeight]
+	return nil
+}
@@ -0,0 +1,62 @@
+package core
+
+import (
+	"errors"
+	"go-chain/types"
+)
+
+var ErrStatePruned = errors.New("该高度的账户状态已被裁剪")
+
+// StateReader 账户状态的只读接口
+// 最新状态和历史状态都可以通过它读取
+type StateReader interface {
+	GetAccount(address types.Address) *Account
+	GetBalance(address types.Address) uint64
+	GetNonce(address types.Address) int64
+	Accounts() []*Account
+	StateRoot() types.Hash
+}
+
+var _ StateReader = new(AccountState)
+
+// StateAt 返回指定高度的区块执行完之后的账户状态
+// 从最新状态开始 按高度从高到低撤销每个区块的状态差异
+func (bc *Blockchain) StateAt(height uint32) (StateReader, error) {
+	bc.stateLock.RLock()
+	defer bc.stateLock.RUnlock()
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+
+	tip := uint32(len(bc.diffs) - 1)
+	if len(bc.diffs) == 0 || height > tip {
+		return nil, ErrBlockNotFound
+	}
+	if height < bc.stateLowest {
+		return nil, ErrStatePruned
+	}
+
+	accounts := make(map[types.Address]*Account)
+	for _, account := range bc.accountState.Accounts() {
+		accounts[account.Address] = account
+	}
+	for h := tip; h > height; h-- {
+		diff := bc.diffs[h]
+		if diff == nil {
+			return nil, ErrStatePruned
+		}
+		for _, change := range diff.Changes {
+			if change.Prev == nil {
+				delete(accounts, change.Address)
+				continue
+			}
+			prev := *change.Prev
+			accounts[change.Address] = &prev
+		}
+	}
+
+	list := make([]*Account, 0, len(accounts))
+	for _, account := range accounts {
+		list = append(list, account)
+	}
+	return NewAccountStateFromAccounts(list), nil
+}
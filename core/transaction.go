@@ -1,21 +1,28 @@
 package core
 
 import (
-	"bytes"
-	"encoding/binary"
 	"go-chain/cryptoo"
 	"go-chain/types"
 	"go-chain/utils"
 	"io"
+	"math"
 )
 
+// DefaultChainID 默认的链ID 交易中的链ID与节点不一致时会被拒绝 防止交易在其他链上重放
+const DefaultChainID uint32 = 1
+
 type Transaction struct {
 	// 交易本身数据
-	From cryptoo.PublicKey
-	To   cryptoo.PublicKey
-	Data []byte
-	Value uint64
+	ChainID uint32
+	From    cryptoo.PublicKey
+	To      cryptoo.PublicKey
+	Data    []byte
+	Value   uint64
+	// 交易手续费 执行时从发送方扣除 交易池按手续费排序
+	Fee   uint64
 	Nonce int64
+	// 交易最晚可以被打包的区块高度 为0时不会过期
+	ValidUntilHeight uint32
 
 	// tx data hash
 	Hash types.Hash
@@ -27,13 +34,7 @@ func (t *Transaction) setDigest() {
 	t.Hash = t.CalHash()
 }
 func (t *Transaction) CalHash() types.Hash {
-	b := &bytes.Buffer{}
-	binary.Write(b, binary.LittleEndian, t.From)
-	binary.Write(b, binary.LittleEndian, t.To)
-	binary.Write(b, binary.LittleEndian, t.Data)
-	binary.Write(b, binary.LittleEndian, t.Value)
-	binary.Write(b, binary.LittleEndian, t.Nonce)
-	return types.Hash(utils.SHA256(b.Bytes()))
+	return hashTransactionBody(t)
 }
 
 func (t *Transaction) GetHash() types.Hash {
@@ -55,36 +56,75 @@ func (t *Transaction) sign(priv *cryptoo.PrivateKey) {
 	t.Signature = signature
 }
 
+// Sign 使用私钥重新对交易签名 修改交易字段后需要重新签名
+func (t *Transaction) Sign(priv *cryptoo.PrivateKey) {
+	t.sign(priv)
+}
+
+// ExpiredAt 判断交易在指定高度的区块中是否已经过期
+func (t *Transaction) ExpiredAt(height uint32) bool {
+	return t.ValidUntilHeight != 0 && height > t.ValidUntilHeight
+}
+
 func (t *Transaction) Encode(w io.Writer) error {
-	return utils.EncodeMessage(t, w)
+	bw := utils.NewBinaryWriter(w)
+	WriteTransaction(bw, t)
+	return bw.Err()
 }
 
 func (t *Transaction) Decode(r io.Reader) error {
-	return utils.DecodeMessage(t, r)
+	br := utils.NewBinaryReader(r)
+	ReadTransaction(br, t)
+	return br.Err()
 }
 
 func NewTransaction(signerPriv *cryptoo.PrivateKey, to cryptoo.PublicKey, data []byte, value uint64, nonce int64) *Transaction {
+	return NewTransactionWithFee(signerPriv, to, data, value, 0, nonce)
+}
+
+// NewTransactionWithFee 创建一笔带手续费的交易
+func NewTransactionWithFee(signerPriv *cryptoo.PrivateKey, to cryptoo.PublicKey, data []byte, value uint64, fee uint64, nonce int64) *Transaction {
 	tx := &Transaction{
-		From: signerPriv.GetPublicKey(),
-		To:   to,
-		Data: data,
-		Value: value,
-		Nonce: nonce,
+		ChainID: DefaultChainID,
+		From:    signerPriv.GetPublicKey(),
+		To:      to,
+		Data:    data,
+		Value:   value,
+		Fee:     fee,
+		Nonce:   nonce,
 	}
 	// 生成Hash
 	tx.sign(signerPriv)
 	return tx
 }
 
+// Cost 返回执行这笔交易需要的总金额 金额和手续费之和溢出时返回math.MaxUint64 任何账户都无法支付
+func (t *Transaction) Cost() uint64 {
+	if t.CostOverflows() {
+		return math.MaxUint64
+	}
+	return t.Value + t.Fee
+}
+
+// CostOverflows 判断金额和手续费之和是否超出uint64的范围
+func (t *Transaction) CostOverflows() bool {
+	return t.Value > math.MaxUint64-t.Fee
+}
+
+// Gas 返回执行这笔交易消耗的执行额度 由固定开销和数据长度决定
+func (t *Transaction) Gas() uint64 {
+	return TxBaseGas + uint64(len(t.Data))*TxDataGas
+}
+
 func (t *Transaction) Verify() bool {
 	// 验证交易签名
 	if t.Signature == nil {
 		return false
 	}
 
-	// 重新计算交易的摘要
-	t.setDigest()
+	// 重新计算交易的摘要 不修改交易本身 同一笔交易可能同时在多个协程中被验证和编码
+	hash := t.CalHash()
 
 	// 使用公钥验证签名
-	return t.Signature.Verify(t.From, t.Hash[:])
+	return t.Signature.Verify(t.From, hash[:])
 }
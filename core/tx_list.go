@@ -0,0 +1,56 @@
+package core
+
+import "sort"
+
+// txList 同一个发送者的交易 按nonce索引
+type txList struct {
+	txs map[int64]*Transaction
+}
+
+func newTxList() *txList {
+	return &txList{
+		txs: make(map[int64]*Transaction),
+	}
+}
+
+func (l *txList) Get(nonce int64) *Transaction {
+	return l.txs[nonce]
+}
+
+func (l *txList) Put(tx *Transaction) {
+	l.txs[tx.Nonce] = tx
+}
+
+func (l *txList) Remove(nonce int64) *Transaction {
+	tx := l.txs[nonce]
+	delete(l.txs, nonce)
+	return tx
+}
+
+func (l *txList) Len() int {
+	return len(l.txs)
+}
+
+// Sorted 返回按nonce从小到大排序的交易
+func (l *txList) Sorted() []*Transaction {
+	txs := make([]*Transaction, 0, len(l.txs))
+	for _, tx := range l.txs {
+		txs = append(txs, tx)
+	}
+	sort.Slice(txs, func(i, j int) bool {
+		return txs[i].Nonce < txs[j].Nonce
+	})
+	return txs
+}
+
+// Filter 删除并返回满足条件的交易
+func (l *txList) Filter(remove func(tx *Transaction) bool) []*Transaction {
+	removed := make([]*Transaction, 0)
+	for nonce, tx := range l.txs {
+		if remove(tx) {
+			removed = append(removed, tx)
+			delete(l.txs, nonce)
+		}
+	}
+	return removed
+}
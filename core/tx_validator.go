@@ -0,0 +1,54 @@
+package core
+
+import "errors"
+
+// 交易本身无效的错误 发送这类交易的节点可以被认为是在作恶
+var (
+	ErrInvalidSignature  = errors.New("交易签名无效")
+	ErrInvalidChainID    = errors.New("交易链ID不匹配")
+	ErrInsufficientFunds = errors.New("账户余额不足以支付交易金额和手续费")
+	ErrTxExpired         = errors.New("交易已过期")
+	ErrCostOverflow      = errors.New("交易金额和手续费之和溢出")
+)
+
+// IsInvalidTxErr 判断错误是否表示交易本身无效
+// 交易池已满 交易已存在等由于本地交易池状态导致的错误不算
+func IsInvalidTxErr(err error) bool {
+	return errors.Is(err, ErrInvalidSignature) ||
+		errors.Is(err, ErrInvalidChainID) ||
+		errors.Is(err, ErrInsufficientFunds) ||
+		errors.Is(err, ErrNonceTooLow) ||
+		errors.Is(err, ErrTxExpired) ||
+		errors.Is(err, ErrCostOverflow)
+}
+
+// validateTx 校验交易能否进入交易池
+// 签名和链ID总是校验 设置了账户状态时还会校验nonce和余额
+func (pool *TxPool) validateTx(tx *Transaction) error {
+	if tx.ChainID != pool.chainID {
+		return ErrInvalidChainID
+	}
+	if !tx.Verify() {
+		return ErrInvalidSignature
+	}
+	// 溢出后的总金额会绕回很小的值 必须在比较余额之前拒绝
+	if tx.CostOverflows() {
+		return ErrCostOverflow
+	}
+	// 无法进入下一个区块的交易已经过期
+	if pool.height != nil && tx.ExpiredAt(pool.height()+1) {
+		return ErrTxExpired
+	}
+	if pool.state == nil {
+		return nil
+	}
+	state := pool.state()
+	from := tx.From.Address()
+	if tx.Nonce < state.GetNonce(from) {
+		return ErrNonceTooLow
+	}
+	if state.GetBalance(from) < tx.Cost() {
+		return ErrInsufficientFunds
+	}
+	return nil
+}
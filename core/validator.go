@@ -10,8 +10,8 @@ func  (v *BlockValidator) Validate(o any) bool {
 		v.bc.logger.Printf("Invalid block data: %v", o)
 		return false
 	}
-	if v.bc.HasBlock(b.GetDataHash()) {
-		v.bc.logger.Printf("Block %s already exists", b.GetDataHash())
+	if v.bc.HasBlock(b.Hash()) {
+		v.bc.logger.Printf("Block %s already exists", b.Hash())
 		return false
 	}
 	if b.Height() != v.bc.Height()+1 {
@@ -19,8 +19,8 @@ func  (v *BlockValidator) Validate(o any) bool {
 		return false
 	}
 	currLb := v.bc.GetLatestBlock()
-	if currLb.GetDataHash() != b.GetPrevBlockHash() {
-		v.bc.logger.Printf("Invalid block prev hash: %s, current hash: %s", b.GetPrevBlockHash(), currLb.GetDataHash())
+	if currLb.Hash() != b.GetPrevBlockHash() {
+		v.bc.logger.Printf("Invalid block prev hash: %s, current hash: %s", b.GetPrevBlockHash(), currLb.Hash())
 		return false
 	}
 	if !b.Verify() {
@@ -2,6 +2,7 @@ package main
 
 import (
 	// 导入必要的包
+	"context"
 	"fmt"
 	"go-chain/network"
 	"log"
@@ -53,6 +54,15 @@ func main() {
 	fmt.Println("服务器正在运行...")
 	time.Sleep(30 * time.Second)
 
+	// 停止所有服务器 最多等待10秒
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for i, server := range servers {
+		if err := server.Stop(ctx); err != nil {
+			fmt.Printf("停止服务器%d失败: %v\n", i+1, err)
+		}
+	}
+
 	fmt.Println("程序结束")
 }
 
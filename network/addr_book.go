@@ -0,0 +1,292 @@
+package network
+
+import (
+	"bufio"
+	"errors"
+	"go-chain/utils"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// 地址簿中最多保存的地址数量
+	maxAddrBookSize = 2048
+	// 连续连接失败这么多次的地址从地址簿中删除
+	maxAddrAttempts = 10
+	// 地址簿文件的格式版本
+	addrBookVersion = 1
+)
+
+var ErrAddrBookVersion = errors.New("不支持的地址簿版本")
+
+// KnownAddress 地址簿中的一个节点地址 地址是节点对外宣布的监听地址 而不是连接的临时端口
+type KnownAddress struct {
+	Addr string
+	// 从哪个节点得知的这个地址 种子节点和本地连接时为空
+	Source string
+	// 最近一次成功连接或者确认节点在线的时间
+	LastSeen time.Time
+	// 最近一次尝试连接的时间
+	LastAttempt time.Time
+	// 连续连接失败的次数 连接成功后清零
+	Attempts int
+}
+
+// AddrBook 记录已知的节点地址 用于交换连接信息和在重启后重新连接
+type AddrBook struct {
+	mu    sync.Mutex
+	path  string
+	addrs map[string]*KnownAddress
+}
+
+// NewAddrBook 创建地址簿 path为空时只保存在内存中
+func NewAddrBook(path string) *AddrBook {
+	return &AddrBook{
+		path:  path,
+		addrs: make(map[string]*KnownAddress),
+	}
+}
+
+// Add 添加一个地址 已经存在的地址不会被覆盖 返回是否是新地址
+func (b *AddrBook) Add(addr string, source string) bool {
+	if addr == "" || len(addr) > maxStringLength {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.addrs[addr]; ok {
+		return false
+	}
+	if len(b.addrs) >= maxAddrBookSize {
+		b.evictLocked()
+	}
+	b.addrs[addr] = &KnownAddress{Addr: addr, Source: source}
+	return true
+}
+
+// evictLocked 地址簿满时删除失败次数最多 最久没有见到的地址 调用时需要持有b.mu
+func (b *AddrBook) evictLocked() {
+	var worst *KnownAddress
+	for _, ka := range b.addrs {
+		if worst == nil || worse(ka, worst) {
+			worst = ka
+		}
+	}
+	if worst != nil {
+		delete(b.addrs, worst.Addr)
+	}
+}
+
+// worse a是否比b更不值得保留
+func worse(a *KnownAddress, b *KnownAddress) bool {
+	if a.Attempts != b.Attempts {
+		return a.Attempts > b.Attempts
+	}
+	return a.LastSeen.Before(b.LastSeen)
+}
+
+// Good 记录成功连接了这个地址 不存在的地址会被添加
+func (b *AddrBook) Good(addr string, now time.Time) {
+	if addr == "" || len(addr) > maxStringLength {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ka, ok := b.addrs[addr]
+	if !ok {
+		if len(b.addrs) >= maxAddrBookSize {
+			b.evictLocked()
+		}
+		ka = &KnownAddress{Addr: addr}
+		b.addrs[addr] = ka
+	}
+	ka.LastSeen = now
+	ka.LastAttempt = now
+	ka.Attempts = 0
+}
+
+// Attempt 记录连接这个地址失败 连续失败次数过多的地址被删除
+func (b *AddrBook) Attempt(addr string, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ka, ok := b.addrs[addr]
+	if !ok {
+		return
+	}
+	ka.LastAttempt = now
+	ka.Attempts++
+	if ka.Attempts >= maxAddrAttempts {
+		delete(b.addrs, addr)
+	}
+}
+
+func (b *AddrBook) Remove(addr string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.addrs, addr)
+}
+
+func (b *AddrBook) Get(addr string) (KnownAddress, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ka, ok := b.addrs[addr]
+	if !ok {
+		return KnownAddress{}, false
+	}
+	return *ka, true
+}
+
+func (b *AddrBook) Size() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.addrs)
+}
+
+// Addresses 返回最多n个地址 连接失败次数少 最近见过的地址排在前面
+func (b *AddrBook) Addresses(n int) []string {
+	b.mu.Lock()
+	known := make([]*KnownAddress, 0, len(b.addrs))
+	for _, ka := range b.addrs {
+		known = append(known, ka)
+	}
+	sort.Slice(known, func(i, j int) bool {
+		if known[i].Attempts != known[j].Attempts {
+			return known[i].Attempts < known[j].Attempts
+		}
+		if !known[i].LastSeen.Equal(known[j].LastSeen) {
+			return known[i].LastSeen.After(known[j].LastSeen)
+		}
+		return known[i].Addr < known[j].Addr
+	})
+	b.mu.Unlock()
+
+	if len(known) > n {
+		known = known[:n]
+	}
+	addrs := make([]string, len(known))
+	for i, ka := range known {
+		addrs[i] = ka.Addr
+	}
+	return addrs
+}
+
+// Load 从文件中读取地址簿 文件不存在时地址簿为空
+func (b *AddrBook) Load() error {
+	if b.path == "" {
+		return nil
+	}
+	f, err := os.Open(b.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	br := utils.NewBinaryReader(bufio.NewReader(f))
+	version := br.ReadUint8()
+	if br.Err() == nil && version != addrBookVersion {
+		return ErrAddrBookVersion
+	}
+	n := br.ReadLength(maxAddrBookSize)
+	addrs := make(map[string]*KnownAddress, n)
+	for i := uint32(0); i < n && br.Err() == nil; i++ {
+		ka := &KnownAddress{
+			Addr:        br.ReadString(maxStringLength),
+			Source:      br.ReadString(maxStringLength),
+			LastSeen:    readTime(br),
+			LastAttempt: readTime(br),
+			Attempts:    int(br.ReadUint32()),
+		}
+		addrs[ka.Addr] = ka
+	}
+	if err := br.Err(); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.addrs = addrs
+	return nil
+}
+
+// Save 把地址簿写入文件 先写到临时文件再替换 避免写到一半时丢失地址簿
+func (b *AddrBook) Save() error {
+	if b.path == "" {
+		return nil
+	}
+	tmp := b.path + ".new"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	bw := utils.NewBinaryWriter(w)
+	b.mu.Lock()
+	bw.WriteUint8(addrBookVersion)
+	bw.WriteUint32(uint32(len(b.addrs)))
+	for _, ka := range b.addrs {
+		bw.WriteString(ka.Addr)
+		bw.WriteString(ka.Source)
+		writeTime(bw, ka.LastSeen)
+		writeTime(bw, ka.LastAttempt)
+		bw.WriteUint32(uint32(ka.Attempts))
+	}
+	b.mu.Unlock()
+
+	if err := bw.Err(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, b.path)
+}
+
+// 时间按Unix秒保存 零值保存为0
+func writeTime(bw *utils.BinaryWriter, t time.Time) {
+	if t.IsZero() {
+		bw.WriteInt64(0)
+		return
+	}
+	bw.WriteInt64(t.Unix())
+}
+
+func readTime(br *utils.BinaryReader) time.Time {
+	sec := br.ReadInt64()
+	if sec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0)
+}
+
+// resolveListenAddr 把节点宣布的监听地址补全为可以连接的地址
+// 只有端口或者监听在全部网卡上的地址使用连接的来源IP
+func resolveListenAddr(advertised string, remote net.Addr) string {
+	host, port, err := net.SplitHostPort(advertised)
+	if err != nil {
+		// 没有端口的地址(例如本地传输层的地址)直接使用
+		return advertised
+	}
+	if ip := net.ParseIP(host); host != "" && (ip == nil || !ip.IsUnspecified()) {
+		return advertised
+	}
+	remoteHost, _, err := net.SplitHostPort(remote.String())
+	if err != nil {
+		return advertised
+	}
+	return net.JoinHostPort(remoteHost, port)
+}
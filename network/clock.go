@@ -0,0 +1,171 @@
+package network
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock 提供当前时间和定时器 Server中的定时任务都通过它计时
+// 默认使用真实时间 模拟网络中使用SimClock 由测试控制时间的流逝
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+	After(d time.Duration) <-chan time.Time
+}
+
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+type realClock struct{}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
+
+// simTimer 虚拟时钟上的一个定时任务
+type simTimer struct {
+	when time.Time
+	// 相同时间的任务按添加的顺序执行
+	seq    uint64
+	period time.Duration
+	ch     chan time.Time
+	fn     func()
+}
+
+// SimClock 虚拟时钟 只有调用Advance时时间才会前进 到期的定时任务按时间顺序执行
+type SimClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	seq    uint64
+	timers map[uint64]*simTimer
+}
+
+var _ Clock = new(SimClock)
+
+func NewSimClock(start time.Time) *SimClock {
+	return &SimClock{
+		now:    start,
+		timers: make(map[uint64]*simTimer),
+	}
+}
+
+func (c *SimClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// add 添加一个在d之后到期的定时任务
+func (c *SimClock) add(d time.Duration, t *simTimer) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seq++
+	t.seq = c.seq
+	t.when = c.now.Add(d)
+	c.timers[t.seq] = t
+	return t.seq
+}
+
+func (c *SimClock) remove(seq uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.timers, seq)
+}
+
+func (c *SimClock) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	c.add(d, &simTimer{ch: ch})
+	return ch
+}
+
+// AfterFunc 在虚拟时间经过d之后执行f f在调用Advance的协程中执行
+func (c *SimClock) AfterFunc(d time.Duration, f func()) {
+	c.add(d, &simTimer{fn: f})
+}
+
+func (c *SimClock) NewTicker(d time.Duration) Ticker {
+	t := &simTicker{clock: c, ch: make(chan time.Time, 1)}
+	t.seq = c.add(d, &simTimer{period: d, ch: t.ch})
+	return t
+}
+
+// Advance 让时间前进d 期间到期的定时任务按时间顺序依次执行
+func (c *SimClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	target := c.now.Add(d)
+	for {
+		next := c.nextLocked(target)
+		if next == nil {
+			break
+		}
+		c.now = next.when
+		if next.period > 0 {
+			next.when = next.when.Add(next.period)
+		} else {
+			delete(c.timers, next.seq)
+		}
+		c.mu.Unlock()
+		c.fire(next)
+		c.mu.Lock()
+	}
+	c.now = target
+	c.mu.Unlock()
+}
+
+// nextLocked 找出不晚于target的最早的定时任务
+func (c *SimClock) nextLocked(target time.Time) *simTimer {
+	var next *simTimer
+	for _, t := range c.timers {
+		if t.when.After(target) {
+			continue
+		}
+		if next == nil || t.when.Before(next.when) || (t.when.Equal(next.when) && t.seq < next.seq) {
+			next = t
+		}
+	}
+	return next
+}
+
+func (c *SimClock) fire(t *simTimer) {
+	if t.fn != nil {
+		t.fn()
+		return
+	}
+	// 与time.Ticker一样 接收方来不及处理时丢弃这次触发
+	select {
+	case t.ch <- c.Now():
+	default:
+	}
+}
+
+type simTicker struct {
+	clock *SimClock
+	seq   uint64
+	ch    chan time.Time
+}
+
+func (t *simTicker) C() <-chan time.Time {
+	return t.ch
+}
+
+func (t *simTicker) Stop() {
+	t.clock.remove(t.seq)
+}
@@ -0,0 +1,295 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"go-chain/core"
+	"go-chain/types"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// 同时等待补齐交易的紧凑区块数量上限 超出时丢弃最早的
+	// 丢弃的区块由定期的状态查询重新同步
+	maxPendingCompactBlocks = 16
+	// 每个节点同时等待补齐交易的紧凑区块数量上限 避免一个节点挤掉其他节点的区块
+	maxPendingCompactBlocksPerPeer = 4
+	// 等待补齐交易的最长时间 与普通请求的超时时间相同 超时的区块被丢弃
+	compactBlockTimeout = defaultRequestTimeout
+)
+
+// ShortTxID 紧凑区块中交易的短ID 取SHA256(区块哈希 + 交易哈希)的前8字节
+// 短ID和区块相关 构造出的冲突交易只能影响一个区块
+func ShortTxID(blockHash types.Hash, txHash types.Hash) uint64 {
+	h := sha256.New()
+	h.Write(blockHash[:])
+	h.Write(txHash[:])
+	return binary.LittleEndian.Uint64(h.Sum(nil)[:8])
+}
+
+// partialBlock 收到紧凑区块后交易池中缺少部分交易 等待对方发送BlockTxn补齐
+type partialBlock struct {
+	from   string
+	header *core.BlockHeader
+	txs    []*core.Transaction
+	// 缺少的交易在区块中的位置 从小到大排列
+	missing []uint32
+	// 收到紧凑区块的时间
+	added time.Time
+}
+
+type compactBlocks struct {
+	mu      sync.Mutex
+	pending map[types.Hash]*partialBlock
+	// 按加入的顺序记录区块哈希 用于淘汰最早的区块
+	order []types.Hash
+}
+
+func newCompactBlocks() *compactBlocks {
+	return &compactBlocks{
+		pending: make(map[types.Hash]*partialBlock),
+	}
+}
+
+// add 记录等待补齐的区块 同一个区块只保留最近一次收到的紧凑区块
+// 先丢弃超时的区块 同一个节点等待中的区块过多时丢弃这个节点最早的区块
+func (cb *compactBlocks) add(hash types.Hash, block *partialBlock) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.expire(block.added)
+	if _, ok := cb.pending[hash]; ok {
+		cb.remove(hash)
+	}
+	count := 0
+	for i := len(cb.order) - 1; i >= 0; i-- {
+		h := cb.order[i]
+		if cb.pending[h].from != block.from {
+			continue
+		}
+		if count++; count >= maxPendingCompactBlocksPerPeer {
+			cb.remove(h)
+		}
+	}
+	cb.order = append(cb.order, hash)
+	cb.pending[hash] = block
+	for len(cb.order) > maxPendingCompactBlocks {
+		delete(cb.pending, cb.order[0])
+		cb.order = cb.order[1:]
+	}
+}
+
+// take 取出from发送的等待补齐的区块 没有或者已经超时时返回nil
+func (cb *compactBlocks) take(hash types.Hash, from net.Addr, now time.Time) *partialBlock {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.expire(now)
+	block, ok := cb.pending[hash]
+	if !ok || block.from != from.String() {
+		return nil
+	}
+	cb.remove(hash)
+	return block
+}
+
+// expire 丢弃超时的区块 调用时需要持有cb.mu
+func (cb *compactBlocks) expire(now time.Time) {
+	for len(cb.order) > 0 && now.Sub(cb.pending[cb.order[0]].added) > compactBlockTimeout {
+		delete(cb.pending, cb.order[0])
+		cb.order = cb.order[1:]
+	}
+}
+
+// remove 删除等待补齐的区块 调用时需要持有cb.mu
+func (cb *compactBlocks) remove(hash types.Hash) {
+	delete(cb.pending, hash)
+	for i, h := range cb.order {
+		if h == hash {
+			cb.order = append(cb.order[:i], cb.order[i+1:]...)
+			break
+		}
+	}
+}
+
+func (cb *compactBlocks) len() int {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return len(cb.pending)
+}
+
+// PendingCompactBlocks 返回等待补齐交易的紧凑区块数量
+func (s *Server) PendingCompactBlocks() int {
+	return s.compactBlocks.len()
+}
+
+// compactBlock 为节点to构造紧凑区块 对方还不知道的交易直接携带 避免再请求一次
+func (s *Server) compactBlock(block *core.Block, to net.Addr) *CompactBlockMessage {
+	hash := block.Hash()
+	msg := &CompactBlockMessage{Header: block.Header}
+	for i, tx := range block.Transactions {
+		txHash := tx.CalHash()
+		if s.inventory.knows(to, txHash) {
+			msg.ShortIDs = append(msg.ShortIDs, ShortTxID(hash, txHash))
+		} else {
+			msg.Prefilled = append(msg.Prefilled, PrefilledTx{Index: uint32(i), Tx: tx})
+		}
+	}
+	return msg
+}
+
+func (s *Server) handleCompactBlockMessage(from net.Addr, body []byte) {
+	msg := new(CompactBlockMessage)
+	if err := DecodeExact(bytes.NewBuffer(body), msg); err != nil {
+		s.logf("解析紧凑区块消息失败: %v", err)
+		s.misbehave(from, misbehaviorBadMessage)
+		return
+	}
+	hash := msg.Header.Hash()
+	s.inventory.markKnown(from, hash)
+	if s.chain.HasBlock(hash) {
+		return
+	}
+	if !msg.Header.Verify() {
+		s.logf("来自 %s 的紧凑区块无效", from)
+		s.misbehave(from, misbehaviorInvalidBlock)
+		return
+	}
+
+	// 先放入直接携带的交易 位置必须递增且不超过交易总数
+	total := len(msg.ShortIDs) + len(msg.Prefilled)
+	if total > core.MaxBlockTransactions {
+		s.misbehave(from, misbehaviorProtocol)
+		return
+	}
+	txs := make([]*core.Transaction, total)
+	next := 0
+	for _, p := range msg.Prefilled {
+		if int(p.Index) < next || int(p.Index) >= total {
+			s.logf("来自 %s 的紧凑区块中交易位置错误", from)
+			s.misbehave(from, misbehaviorProtocol)
+			return
+		}
+		txs[p.Index] = p.Tx
+		next = int(p.Index) + 1
+	}
+
+	// 其余位置用交易池中短ID相同的交易填充 池中有两笔交易短ID冲突时当作缺少
+	byShortID := make(map[uint64]*core.Transaction)
+	for _, tx := range s.pool.GetAllTxs() {
+		id := ShortTxID(hash, tx.CalHash())
+		if _, ok := byShortID[id]; ok {
+			byShortID[id] = nil
+			continue
+		}
+		byShortID[id] = tx
+	}
+	var missing []uint32
+	ids := msg.ShortIDs
+	for i := range txs {
+		if txs[i] != nil {
+			continue
+		}
+		if tx := byShortID[ids[0]]; tx != nil {
+			txs[i] = tx
+		} else {
+			missing = append(missing, uint32(i))
+		}
+		ids = ids[1:]
+	}
+
+	if len(missing) == 0 {
+		s.completeCompactBlock(from, msg.Header, txs)
+		return
+	}
+	s.compactBlocks.add(hash, &partialBlock{
+		from:    from.String(),
+		header:  msg.Header,
+		txs:     txs,
+		missing: missing,
+		added:   s.opts.clock.Now(),
+	})
+	data, err := EncodeMessage(MessageTypeGetBlockTxn, &GetBlockTxnMessage{BlockHash: hash, Indexes: missing})
+	if err != nil {
+		s.logf("编码获取区块交易消息失败: %v", err)
+		return
+	}
+	s.send(from, data)
+}
+
+func (s *Server) handleGetBlockTxnMessage(from net.Addr, body []byte) {
+	msg := new(GetBlockTxnMessage)
+	if err := DecodeExact(bytes.NewBuffer(body), msg); err != nil {
+		s.logf("解析获取区块交易消息失败: %v", err)
+		s.misbehave(from, misbehaviorBadMessage)
+		return
+	}
+	block := s.chain.GetBlockByHash(msg.BlockHash)
+	if block == nil {
+		return
+	}
+	txs := make([]*core.Transaction, 0, len(msg.Indexes))
+	for _, index := range msg.Indexes {
+		if int(index) >= len(block.Transactions) {
+			s.misbehave(from, misbehaviorProtocol)
+			return
+		}
+		txs = append(txs, block.Transactions[index])
+	}
+	data, err := EncodeMessage(MessageTypeBlockTxn, &BlockTxnMessage{BlockHash: msg.BlockHash, Transactions: txs})
+	if err != nil {
+		s.logf("编码区块交易消息失败: %v", err)
+		return
+	}
+	s.send(from, data)
+}
+
+func (s *Server) handleBlockTxnMessage(from net.Addr, body []byte) {
+	msg := new(BlockTxnMessage)
+	if err := DecodeExact(bytes.NewBuffer(body), msg); err != nil {
+		s.logf("解析区块交易消息失败: %v", err)
+		s.misbehave(from, misbehaviorBadMessage)
+		return
+	}
+	// 没有请求过的区块可能已经被淘汰 直接忽略
+	block := s.compactBlocks.take(msg.BlockHash, from, s.opts.clock.Now())
+	if block == nil {
+		return
+	}
+	if len(msg.Transactions) != len(block.missing) {
+		s.logf("%s 返回的区块交易数量与请求不一致", from)
+		s.misbehave(from, misbehaviorProtocol)
+		return
+	}
+	for i, index := range block.missing {
+		block.txs[index] = msg.Transactions[i]
+	}
+	s.completeCompactBlock(from, block.header, block.txs)
+}
+
+// completeCompactBlock 验证还原出的区块 并按普通区块处理
+// 验证失败可能只是短ID冲突选错了交易 不扣分 改为向对方请求完整的区块
+// 对方发送的紧凑区块一定来自它自己的区块 返回的完整区块与区块头不一致说明对方在作恶
+func (s *Server) completeCompactBlock(from net.Addr, header *core.BlockHeader, txs []*core.Transaction) {
+	block := &core.Block{Header: header, Transactions: txs}
+	if !block.Verify() {
+		s.logf("还原来自 %s 的紧凑区块失败, 请求完整区块", from)
+		hash := header.Hash()
+		block = new(core.Block)
+		err := s.Request(context.Background(), from, MessageTypeGetData, &GetDataMessage{
+			Items: []InvVector{{Type: InvTypeBlock, Hash: hash}},
+		}, MessageTypeBlock, block)
+		if err != nil {
+			s.logf("从 %s 获取完整区块失败: %v", from, err)
+			return
+		}
+		if block.Header == nil || block.Hash() != hash || !block.Verify() {
+			s.logf("%s 返回的完整区块与紧凑区块的区块头不一致", from)
+			s.misbehave(from, misbehaviorInvalidBlock)
+			return
+		}
+	}
+	s.processBlock(from, block)
+}
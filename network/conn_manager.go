@@ -0,0 +1,289 @@
+package network
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// 默认至少保持的主动连接数量 不足时从地址簿中选择节点连接
+	defaultMinOutbound = 4
+	// 默认最多的主动连接数量
+	defaultMaxOutbound = 8
+	// 默认最多接受的被动连接数量
+	defaultMaxInbound = 32
+	// 检查连接数量的间隔
+	connManagerInterval = 5 * time.Second
+	// 连接失败后第一次重试的等待时间 之后每次失败翻倍
+	minReconnectBackoff = 5 * time.Second
+	// 重试等待时间的上限
+	maxReconnectBackoff = 10 * time.Minute
+	// 连接保持这么久之后断开才清零失败次数 连接后马上被断开的节点按失败处理
+	stableConnectionTime = time.Minute
+)
+
+var (
+	ErrTooManyPeers  = errors.New("连接数量已达上限")
+	ErrDuplicatePeer = errors.New("已经与这个节点建立了连接")
+)
+
+// peerInfo 一个连接的附加信息 由Server.mu保护
+type peerInfo struct {
+	peer     Peer
+	outbound bool
+	// 节点的监听地址 主动连接时为连接的地址 被动连接时由对方在Hello中宣布
+	listenAddr string
+	// 节点ID 收到Hello之前为空
+	id string
+	// 建立连接的时间
+	connected time.Time
+	ping      pingState
+	// 与同一个节点重复的连接 已经被关闭
+	duplicate bool
+}
+
+// dialState 一个地址连续连接失败的次数和下次可以重试的时间
+type dialState struct {
+	failures int
+	next     time.Time
+}
+
+// connManager 维持主动连接的数量 断开或者连接失败的节点按指数退避重连
+type connManager struct {
+	mu          sync.Mutex
+	minOutbound int
+	maxOutbound int
+	maxInbound  int
+	// 需要保持连接的地址 包括种子节点和断开的主动连接
+	persistent map[string]bool
+	seeds      map[string]bool
+	backoff    map[string]*dialState
+	// 正在连接的地址 避免同时重复连接
+	dialing map[string]bool
+	// 主动连接后从Hello中得知的地址对应的节点ID 同一个节点的其他地址已经连接时不再连接
+	ids map[string]string
+}
+
+func newConnManager(opts ServerOpts) *connManager {
+	cm := &connManager{
+		minOutbound: defaultMinOutbound,
+		maxOutbound: defaultMaxOutbound,
+		maxInbound:  defaultMaxInbound,
+		persistent:  make(map[string]bool),
+		seeds:       make(map[string]bool),
+		backoff:     make(map[string]*dialState),
+		dialing:     make(map[string]bool),
+		ids:         make(map[string]string),
+	}
+	if opts.minOutbound > 0 {
+		cm.minOutbound = opts.minOutbound
+	}
+	if opts.maxOutbound > 0 {
+		cm.maxOutbound = opts.maxOutbound
+	}
+	if cm.maxOutbound < cm.minOutbound {
+		cm.maxOutbound = cm.minOutbound
+	}
+	if opts.maxInbound > 0 {
+		cm.maxInbound = opts.maxInbound
+	}
+	for _, addr := range opts.seedNodes {
+		cm.seeds[addr] = true
+		cm.persistent[addr] = true
+	}
+	return cm
+}
+
+// reconnectBackoff 连续失败n次之后需要等待的时间
+func reconnectBackoff(failures int) time.Duration {
+	d := minReconnectBackoff
+	for i := 1; i < failures && d < maxReconnectBackoff; i++ {
+		d *= 2
+	}
+	if d > maxReconnectBackoff {
+		d = maxReconnectBackoff
+	}
+	return d
+}
+
+// persistentAddrs 返回需要保持连接的地址 种子节点排在前面
+func (cm *connManager) persistentAddrs() []string {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	addrs := make([]string, 0, len(cm.persistent))
+	for addr := range cm.seeds {
+		addrs = append(addrs, addr)
+	}
+	for addr := range cm.persistent {
+		if !cm.seeds[addr] {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// startDial 标记开始连接addr 正在连接或者还在退避时间内的地址返回false
+func (cm *connManager) startDial(addr string, now time.Time) bool {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.dialing[addr] {
+		return false
+	}
+	if state, ok := cm.backoff[addr]; ok && now.Before(state.next) {
+		return false
+	}
+	cm.dialing[addr] = true
+	return true
+}
+
+// finishDial 记录连接的结果 失败时推迟下次重试的时间
+// 已经与这个节点建立了连接不算失败
+func (cm *connManager) finishDial(addr string, err error, now time.Time) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	delete(cm.dialing, addr)
+	if err != nil && !errors.Is(err, ErrDuplicatePeer) {
+		cm.failLocked(addr, now)
+	}
+}
+
+// dropped 记录一个主动连接断开了 之后按退避时间重连
+// 连接保持了足够长的时间时从最短的等待时间开始 否则按又一次失败计算
+func (cm *connManager) dropped(addr string, uptime time.Duration, now time.Time) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.persistent[addr] = true
+	if state, ok := cm.backoff[addr]; ok && uptime >= stableConnectionTime {
+		state.failures = 0
+	}
+	cm.failLocked(addr, now)
+}
+
+// failLocked 增加失败次数并推迟下次重试的时间 多次失败的地址不再重连 种子节点一直重试
+// 调用时需要持有cm.mu
+func (cm *connManager) failLocked(addr string, now time.Time) {
+	state, ok := cm.backoff[addr]
+	if !ok {
+		state = new(dialState)
+		cm.backoff[addr] = state
+	}
+	state.failures++
+	state.next = now.Add(reconnectBackoff(state.failures))
+	if state.failures >= maxAddrAttempts && !cm.seeds[addr] {
+		delete(cm.persistent, addr)
+		delete(cm.backoff, addr)
+	}
+}
+
+// setID 记录地址对应的节点ID
+func (cm *connManager) setID(addr string, id string) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.ids[addr] = id
+}
+
+// idOf 返回地址对应的节点ID 还没有连接过的地址返回空
+func (cm *connManager) idOf(addr string) string {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	return cm.ids[addr]
+}
+
+// connectLoop 定期检查连接数量 重连断开的节点
+func (s *Server) connectLoop() {
+	ticker := s.opts.clock.NewTicker(connManagerInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C():
+			s.maintainPeers()
+		case <-s.quitCh:
+			return
+		}
+	}
+}
+
+// maintainPeers 先重连需要保持的连接 主动连接仍然不足minOutbound时
+// 先从路由表的不同K桶中选择节点 再从地址簿中选择
+func (s *Server) maintainPeers() {
+	outbound, _ := s.PeerCounts()
+	cm := s.connMgr
+	for _, addr := range cm.persistentAddrs() {
+		if outbound >= cm.maxOutbound {
+			return
+		}
+		if s.tryDial(addr) {
+			outbound++
+		}
+	}
+	for _, node := range s.dht.Diverse(nodeKeyBits) {
+		if outbound >= cm.minOutbound {
+			return
+		}
+		if s.tryDial(node.Addr) {
+			outbound++
+		}
+	}
+	for _, addr := range s.addrBook.Addresses(maxAddrBookSize) {
+		if outbound >= cm.minOutbound {
+			return
+		}
+		if s.tryDial(addr) {
+			outbound++
+		}
+	}
+}
+
+// tryDial 在新的协程中连接addr 指向本节点 已经连接 被禁止或者还不能重试的地址返回false
+func (s *Server) tryDial(addr string) bool {
+	if s.isSelfAddr(addr) || s.isConnectedTo(addr) || s.IsBanned(addr) {
+		return false
+	}
+	if id := s.connMgr.idOf(addr); id != "" && (id == s.opts.id || s.isConnectedToID(id)) {
+		return false
+	}
+	if !s.connMgr.startDial(addr, s.opts.clock.Now()) {
+		return false
+	}
+	s.spawn(func() {
+		err := s.connectToNode(addr)
+		s.connMgr.finishDial(addr, err, s.opts.clock.Now())
+		if err != nil {
+			s.logf("连接节点 %s 失败: %v", addr, err)
+		}
+	})
+	return true
+}
+
+// isConnectedToID 是否已经与这个节点建立了连接
+func (s *Server) isConnectedToID(id string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, info := range s.peerInfo {
+		if info.id == id && !info.duplicate {
+			return true
+		}
+	}
+	return false
+}
+
+// peerCountsLocked 调用时需要持有s.mu
+func (s *Server) peerCountsLocked() (outbound int, inbound int) {
+	for _, info := range s.peerInfo {
+		if info.outbound {
+			outbound++
+		} else {
+			inbound++
+		}
+	}
+	return outbound, inbound
+}
+
+// PeerCounts 返回主动连接和被动连接的数量
+func (s *Server) PeerCounts() (outbound int, inbound int) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.peerCountsLocked()
+}
@@ -0,0 +1,53 @@
+package network
+
+import (
+	"go-chain/types"
+	"sync"
+)
+
+// 最近见过的交易哈希默认保留的数量
+const defaultSeenTxsCapacity = 32768
+
+// hashCache 保存最近见过的哈希 超过容量后淘汰最早加入的哈希
+type hashCache struct {
+	mu       sync.Mutex
+	capacity int
+	set      map[types.Hash]struct{}
+	// 环形队列 记录哈希加入的顺序
+	order []types.Hash
+	next  int
+}
+
+func newHashCache(capacity int) *hashCache {
+	return &hashCache{
+		capacity: capacity,
+		set:      make(map[types.Hash]struct{}, capacity),
+		order:    make([]types.Hash, 0, capacity),
+	}
+}
+
+// Add 加入一个哈希 返回false表示这个哈希已经存在
+func (c *hashCache) Add(hash types.Hash) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.set[hash]; ok {
+		return false
+	}
+	if len(c.order) < c.capacity {
+		c.order = append(c.order, hash)
+	} else {
+		delete(c.set, c.order[c.next])
+		c.order[c.next] = hash
+		c.next = (c.next + 1) % c.capacity
+	}
+	c.set[hash] = struct{}{}
+	return true
+}
+
+func (c *hashCache) Contains(hash types.Hash) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.set[hash]
+	return ok
+}
@@ -0,0 +1,462 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"go-chain/core"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// 每个区块头消息最多包含的区块头数量
+	maxHeadersPerMessage = 2000
+	// 请求区块头时从本地高度往前多请求的数量 用于发现分叉
+	headerLookback = 16
+	// 每次向一个节点请求的区块数量
+	bodyBatchSize = 16
+	// 同时在下载的区块批次数量上限
+	maxBatchesInFlight = 8
+	// 同一个节点同时下载的区块批次数量上限
+	maxBatchesPerPeer = 2
+	// 区块批次下载失败后的最大重试次数 超过后放弃本次同步
+	maxBodyRetries = 3
+)
+
+var ErrRollbackFailed = errors.New("无法回滚到共同祖先")
+
+// headerCandidate 表示某个节点提供的一条区块头链
+type headerCandidate struct {
+	peer net.Addr
+	// 与本地链的共同祖先高度
+	forkHeight uint32
+	// 从forkHeight+1开始的区块头
+	headers []*core.BlockHeader
+}
+
+func (c *headerCandidate) tip() uint32 {
+	return c.forkHeight + uint32(len(c.headers))
+}
+
+// header 获取指定高度的区块头 不在范围内时返回nil
+func (c *headerCandidate) header(height uint32) *core.BlockHeader {
+	if height <= c.forkHeight || height > c.tip() {
+		return nil
+	}
+	return c.headers[height-c.forkHeight-1]
+}
+
+// bodyBatch 表示一批按高度连续的区块
+type bodyBatch struct {
+	from uint32
+	to   uint32
+	// 正在下载这批区块的节点 为nil表示等待分配
+	peer    net.Addr
+	retries int
+	// 下载失败过的节点 重新分配时尽量避开
+	failed map[string]bool
+	blocks []*core.Block
+}
+
+func (b *bodyBatch) inFlight() bool {
+	return b.peer != nil && b.blocks == nil
+}
+
+// headerSync 记录先同步区块头再下载区块的过程
+// 先从各个节点获取区块头链 选出最长的一条 再把区块分批从拥有这条链的多个节点并行下载
+// 下载完成的批次按高度顺序添加到链上
+type headerSync struct {
+	mu         sync.Mutex
+	candidates map[string]*headerCandidate
+	// 正在下载区块的区块头链 为nil表示没有在同步
+	best    *headerCandidate
+	batches []*bodyBatch
+}
+
+func newHeaderSync() *headerSync {
+	return &headerSync{
+		candidates: make(map[string]*headerCandidate),
+	}
+}
+
+func (hs *headerSync) reset() {
+	hs.best = nil
+	hs.batches = nil
+	hs.candidates = make(map[string]*headerCandidate)
+}
+
+// requestHeaders 向节点请求本地高度之后的区块头 为了发现分叉会多请求本地最近的一些区块头
+func (s *Server) requestHeaders(to net.Addr, target uint32) {
+	height := s.chain.Height()
+	from := uint32(1)
+	if height+1 > headerLookback {
+		from = height + 1 - headerLookback
+	}
+	if lowest := s.chain.LowestHeight(); from <= lowest {
+		from = lowest + 1
+	}
+	if target < from {
+		return
+	}
+	if target-from+1 > maxHeadersPerMessage {
+		target = from + maxHeadersPerMessage - 1
+	}
+
+	data, err := EncodeMessage(MessageTypeGetHeaders, &GetHeadersMessage{
+		From: from,
+		To:   target,
+	})
+	if err != nil {
+		s.logf("编码获取区块头消息失败: %v", err)
+		return
+	}
+	s.send(to, data)
+}
+
+func (s *Server) handleGetHeadersMessage(from net.Addr, id uint64, body []byte) {
+	s.logf("处理来自 %s 的获取区块头消息", from)
+	getHeaders := new(GetHeadersMessage)
+	if err := DecodeExact(bytes.NewBuffer(body), getHeaders); err != nil {
+		s.logf("解析获取区块头消息失败: %v", err)
+		s.misbehave(from, misbehaviorBadMessage)
+		return
+	}
+
+	to := getHeaders.To
+	if to > s.chain.Height() {
+		to = s.chain.Height()
+	}
+	if getHeaders.From <= to && to-getHeaders.From+1 > maxHeadersPerMessage {
+		to = getHeaders.From + maxHeadersPerMessage - 1
+	}
+	hm := &HeadersMessage{Headers: []*core.BlockHeader{}}
+	if getHeaders.From <= to {
+		headers, err := s.chain.GetHeaders(getHeaders.From, to)
+		if err != nil {
+			s.logf("获取区块头 [%d, %d] 失败: %v", getHeaders.From, to, err)
+		} else {
+			hm.Headers = headers
+		}
+	}
+
+	data, err := EncodeMessageWithID(MessageTypeHeaders, id, hm)
+	if err != nil {
+		s.logf("编码区块头消息失败: %v", err)
+		return
+	}
+	s.send(from, data)
+}
+
+func (s *Server) handleHeadersMessage(from net.Addr, body []byte) {
+	s.logf("处理来自 %s 的区块头消息", from)
+	hm := new(HeadersMessage)
+	if err := DecodeExact(bytes.NewBuffer(body), hm); err != nil {
+		s.logf("解析区块头消息失败: %v", err)
+		s.misbehave(from, misbehaviorBadMessage)
+		return
+	}
+	if len(hm.Headers) == 0 {
+		return
+	}
+	if err := core.VerifyHeaderChain(nil, hm.Headers); err != nil {
+		s.logf("来自 %s 的区块头无效: %v", from, err)
+		s.misbehave(from, misbehaviorProtocol)
+		return
+	}
+
+	// 跳过与本地链相同的区块头 找到分叉的位置
+	i := 0
+	for ; i < len(hm.Headers); i++ {
+		local, err := s.chain.GetHeader(hm.Headers[i].Height)
+		if err != nil || local.Hash() != hm.Headers[i].Hash() {
+			break
+		}
+	}
+	if i == len(hm.Headers) {
+		return
+	}
+	first := hm.Headers[i]
+	parent, err := s.chain.GetHeader(first.Height - 1)
+	if err != nil || parent.Hash() != first.PrevBlockHash {
+		s.logf("来自 %s 的区块头与本地链没有共同祖先, 高度 %d", from, first.Height)
+		return
+	}
+
+	candidate := &headerCandidate{
+		peer:       from,
+		forkHeight: parent.Height,
+		headers:    hm.Headers[i:],
+	}
+	if candidate.tip() <= s.chain.Height() {
+		return
+	}
+
+	hs := s.headerSync
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	hs.candidates[from.String()] = candidate
+	if hs.best == nil {
+		s.startBodySync()
+	}
+}
+
+// startBodySync 选出最长的区块头链并开始下载区块 调用时需要持有hs.mu
+func (s *Server) startBodySync() {
+	hs := s.headerSync
+	var best *headerCandidate
+	for _, candidate := range hs.candidates {
+		if candidate.tip() <= s.chain.Height() {
+			continue
+		}
+		if best == nil || candidate.tip() > best.tip() {
+			best = candidate
+		}
+	}
+	if best == nil {
+		return
+	}
+
+	hs.best = best
+	hs.batches = nil
+	for h := best.forkHeight + 1; h <= best.tip(); h += bodyBatchSize {
+		to := h + bodyBatchSize - 1
+		if to > best.tip() {
+			to = best.tip()
+		}
+		hs.batches = append(hs.batches, &bodyBatch{
+			from:   h,
+			to:     to,
+			failed: make(map[string]bool),
+		})
+	}
+	s.logf("开始从高度 %d 同步到 %d, 共 %d 批区块", best.forkHeight+1, best.tip(), len(hs.batches))
+	s.scheduleBatches()
+}
+
+// scheduleBatches 把等待中的区块批次分配给拥有对应区块头的节点 调用时需要持有hs.mu
+func (s *Server) scheduleBatches() {
+	hs := s.headerSync
+	if hs.best == nil {
+		return
+	}
+	inFlight := 0
+	perPeer := make(map[string]int)
+	for _, batch := range hs.batches {
+		if batch.inFlight() {
+			inFlight++
+			perPeer[batch.peer.String()]++
+		}
+	}
+
+	for _, batch := range hs.batches {
+		if inFlight >= maxBatchesInFlight {
+			return
+		}
+		if batch.peer != nil {
+			continue
+		}
+		peer := s.pickBatchPeer(batch, perPeer)
+		if peer == nil {
+			continue
+		}
+		batch.peer = peer
+		perPeer[peer.String()]++
+		inFlight++
+		best := hs.best
+		s.spawn(func() { s.fetchBatch(best, batch, peer) })
+	}
+	// 没有节点能够提供剩下的区块
+	if inFlight == 0 {
+		s.logf("没有节点可以提供剩余的区块, 放弃本次同步")
+		hs.reset()
+	}
+}
+
+// pickBatchPeer 在区块头链与最长链一致的节点中选择负载最低的节点 负载相同时选择RTT最小的节点
+// 优先选择没有下载失败过这批区块的节点
+func (s *Server) pickBatchPeer(batch *bodyBatch, perPeer map[string]int) net.Addr {
+	hs := s.headerSync
+	want := hs.best.header(batch.to)
+	var (
+		picked       net.Addr
+		pickedLoad   int
+		pickedFailed bool
+		pickedRTT    time.Duration
+	)
+	for key, candidate := range hs.candidates {
+		header := candidate.header(batch.to)
+		if header == nil || header.Hash() != want.Hash() {
+			continue
+		}
+		load := perPeer[key]
+		if load >= maxBatchesPerPeer {
+			continue
+		}
+		failed := batch.failed[key]
+		rtt := s.peerLatency(key)
+		if picked == nil || (pickedFailed && !failed) ||
+			(pickedFailed == failed && (load < pickedLoad || (load == pickedLoad && rtt < pickedRTT))) {
+			picked, pickedLoad, pickedFailed, pickedRTT = candidate.peer, load, failed, rtt
+		}
+	}
+	return picked
+}
+
+// isSyncing 是否正在按区块头同步区块 同步过程中忽略其他区块列表消息 避免与同步的区块冲突
+func (s *Server) isSyncing() bool {
+	hs := s.headerSync
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	return hs.best != nil
+}
+
+// fetchBatch 向节点请求一批区块 超时或者区块与区块头不一致时换一个节点重试
+func (s *Server) fetchBatch(best *headerCandidate, batch *bodyBatch, peer net.Addr) {
+	bm := new(BlocksMessage)
+	err := s.Request(context.Background(), peer, MessageTypeGetBlocks, &GetBlocksMessage{
+		From: batch.from,
+		To:   batch.to,
+	}, MessageTypeBlocks, bm)
+
+	hs := s.headerSync
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+
+	// 同步已经结束或者这批区块已经分配给了其他节点
+	if hs.best != best || batch.peer == nil || batch.peer.String() != peer.String() {
+		return
+	}
+	if err != nil {
+		s.logf("从 %s 下载区块 [%d, %d] 失败: %v", peer, batch.from, batch.to, err)
+		s.retryBatch(batch)
+		s.scheduleBatches()
+		return
+	}
+	if !s.checkBatch(batch, bm.Blocks) {
+		s.logf("来自 %s 的区块 [%d, %d] 与区块头不一致", peer, batch.from, batch.to)
+		s.misbehave(peer, misbehaviorInvalidBlock)
+		delete(hs.candidates, peer.String())
+		s.retryBatch(batch)
+		s.scheduleBatches()
+		return
+	}
+	batch.blocks = bm.Blocks
+	s.applyBatches()
+}
+
+// checkBatch 检查区块是否与最长链的区块头一致
+func (s *Server) checkBatch(batch *bodyBatch, blocks []*core.Block) bool {
+	if uint32(len(blocks)) != batch.to-batch.from+1 {
+		return false
+	}
+	for i, block := range blocks {
+		header := s.headerSync.best.header(batch.from + uint32(i))
+		if block == nil || block.Header == nil || header == nil {
+			return false
+		}
+		if block.Hash() != header.Hash() {
+			return false
+		}
+		if !block.Verify() {
+			return false
+		}
+	}
+	return true
+}
+
+// retryBatch 把下载失败的批次重新放回等待队列 调用时需要持有hs.mu
+func (s *Server) retryBatch(batch *bodyBatch) {
+	batch.failed[batch.peer.String()] = true
+	batch.peer = nil
+	batch.retries++
+	if batch.retries > maxBodyRetries {
+		s.logf("区块 [%d, %d] 多次下载失败, 放弃本次同步", batch.from, batch.to)
+		s.headerSync.reset()
+	}
+}
+
+// applyBatches 按高度顺序把已经下载完成的批次添加到链上 调用时需要持有hs.mu
+// 最长链与本地链分叉时 等替换的区块全部下载完成后再一起切换 下载失败时不会丢掉本地的区块
+func (s *Server) applyBatches() {
+	hs := s.headerSync
+	if hs.best == nil {
+		return
+	}
+	if hs.best.forkHeight < s.chain.Height() {
+		var blocks []*core.Block
+		for _, batch := range hs.batches {
+			if batch.blocks == nil {
+				s.scheduleBatches()
+				return
+			}
+			blocks = append(blocks, batch.blocks...)
+		}
+		hs.batches = nil
+		if err := s.reorganize(hs.best.forkHeight, blocks); err != nil {
+			s.logf("切换到来自 %s 的链失败: %v, 放弃本次同步", hs.best.peer, err)
+			hs.reset()
+			return
+		}
+	}
+	for len(hs.batches) > 0 && hs.batches[0].blocks != nil {
+		batch := hs.batches[0]
+		s.mu.Lock()
+		for _, block := range batch.blocks {
+			if err := s.chain.AddBlock(block); err != nil {
+				s.mu.Unlock()
+				s.logf("添加同步的区块 %d 失败: %v, 放弃本次同步", block.Height(), err)
+				hs.reset()
+				s.resetPool()
+				return
+			}
+		}
+		s.mu.Unlock()
+		hs.batches = hs.batches[1:]
+	}
+	s.resetPool()
+
+	if len(hs.batches) > 0 {
+		s.scheduleBatches()
+		return
+	}
+
+	// 同步完成 继续向这个节点请求之后的区块头
+	peer := hs.best.peer
+	s.logf("区块同步完成, 当前高度 %d", s.chain.Height())
+	hs.reset()
+	height := s.chain.Height() + maxHeadersPerMessage
+	s.spawn(func() { s.requestHeaders(peer, height) })
+}
+
+// reorganize 回滚共同祖先之后的本地区块 换成新的区块
+// 新的区块添加失败时撤销已经添加的部分 重新添加原来的区块
+func (s *Server) reorganize(forkHeight uint32, blocks []*core.Block) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, err := s.chain.GetRangeBlocks(forkHeight+1, s.chain.Height())
+	if err != nil {
+		return err
+	}
+	s.RollBlockRange(forkHeight + 1)
+	if s.chain.Height() != forkHeight {
+		return ErrRollbackFailed
+	}
+	for _, block := range blocks {
+		if err := s.chain.AddBlock(block); err != nil {
+			if s.chain.Height() > forkHeight {
+				s.RollBlockRange(forkHeight + 1)
+			}
+			for _, block := range old {
+				if err := s.chain.AddBlock(block); err != nil {
+					s.logf("恢复原来的区块 %d 失败: %v", block.Height(), err)
+					break
+				}
+			}
+			s.resetPool()
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package network
+
+import (
+	"bytes"
+	"go-chain/core"
+	"go-chain/types"
+	"net"
+	"sync"
+)
+
+// 每个节点默认记录的已知哈希数量
+const defaultKnownPerPeer = 4096
+
+// peerInventory 记录每个节点已经拥有的交易和区块
+// 节点发送过或者我们通告过的哈希不会再发给这个节点 保证每个数据在每条连接上最多传输一次
+type peerInventory struct {
+	mu    sync.Mutex
+	peers map[string]*hashCache
+}
+
+func newPeerInventory() *peerInventory {
+	return &peerInventory{
+		peers: make(map[string]*hashCache),
+	}
+}
+
+// markKnown 记录节点已经拥有这个哈希 返回false表示之前已经记录过
+func (pi *peerInventory) markKnown(addr net.Addr, hash types.Hash) bool {
+	pi.mu.Lock()
+	known, ok := pi.peers[addr.String()]
+	if !ok {
+		known = newHashCache(defaultKnownPerPeer)
+		pi.peers[addr.String()] = known
+	}
+	pi.mu.Unlock()
+	return known.Add(hash)
+}
+
+// knows 返回节点是否已经拥有这个哈希 不修改记录
+func (pi *peerInventory) knows(addr net.Addr, hash types.Hash) bool {
+	pi.mu.Lock()
+	known, ok := pi.peers[addr.String()]
+	pi.mu.Unlock()
+	return ok && known.Contains(hash)
+}
+
+// remove 删除已断开节点的记录
+func (pi *peerInventory) remove(addr net.Addr) {
+	pi.mu.Lock()
+	defer pi.mu.Unlock()
+	delete(pi.peers, addr.String())
+}
+
+// announce 向还不知道这个数据的节点发送通告 exclude为数据的来源节点
+func (s *Server) announce(invType InvType, hash types.Hash, exclude net.Addr) {
+	data, err := EncodeMessage(MessageTypeInv, &InvMessage{
+		Items: []InvVector{{Type: invType, Hash: hash}},
+	})
+	if err != nil {
+		s.logf("编码通告消息失败: %v", err)
+		return
+	}
+
+	// 发送可能阻塞 先复制连接列表再发送 不在持有锁时发送
+	s.mu.RLock()
+	peers := make([]Peer, 0, len(s.peerMap))
+	for _, peer := range s.peerMap {
+		peers = append(peers, peer)
+	}
+	s.mu.RUnlock()
+
+	for _, peer := range peers {
+		addr := peer.RemoteAddr()
+		if exclude != nil && addr.String() == exclude.String() {
+			continue
+		}
+		if !s.inventory.markKnown(addr, hash) {
+			continue
+		}
+		if err := peer.Send(data); err != nil {
+			s.logf("向 %s 发送通告失败: %v", addr, err)
+		}
+	}
+}
+
+func (s *Server) handleInvMessage(from net.Addr, body []byte) {
+	inv := new(InvMessage)
+	if err := DecodeExact(bytes.NewBuffer(body), inv); err != nil {
+		s.logf("解析通告消息失败: %v", err)
+		s.misbehave(from, misbehaviorBadMessage)
+		return
+	}
+
+	// 只请求本地还没有的数据
+	wanted := make([]InvVector, 0, len(inv.Items))
+	for _, item := range inv.Items {
+		s.inventory.markKnown(from, item.Hash)
+		switch item.Type {
+		case InvTypeTx:
+			if s.seenTxs.Contains(item.Hash) || s.pool.Get(item.Hash) != nil || s.chain.HasTransaction(item.Hash) {
+				continue
+			}
+		case InvTypeBlock:
+			if s.chain.HasBlock(item.Hash) {
+				continue
+			}
+			// 区块以紧凑区块的形式请求 对方只发送区块头和交易短ID
+			item.Type = InvTypeCompactBlock
+		default:
+			continue
+		}
+		wanted = append(wanted, item)
+	}
+	if len(wanted) == 0 {
+		return
+	}
+
+	data, err := EncodeMessage(MessageTypeGetData, &GetDataMessage{Items: wanted})
+	if err != nil {
+		s.logf("编码获取数据消息失败: %v", err)
+		return
+	}
+	s.send(from, data)
+}
+
+// handleGetDataMessage 发送请求的数据 请求带有编号时响应使用相同的编号
+func (s *Server) handleGetDataMessage(from net.Addr, id uint64, body []byte) {
+	getData := new(GetDataMessage)
+	if err := DecodeExact(bytes.NewBuffer(body), getData); err != nil {
+		s.logf("解析获取数据消息失败: %v", err)
+		s.misbehave(from, misbehaviorBadMessage)
+		return
+	}
+
+	for _, item := range getData.Items {
+		var (
+			data []byte
+			err  error
+		)
+		switch item.Type {
+		case InvTypeTx:
+			tx := s.pool.Get(item.Hash)
+			if tx == nil {
+				continue
+			}
+			data, err = EncodeMessageWithID(MessageTypeTx, id, tx)
+		case InvTypeBlock:
+			block := s.chain.GetBlockByHash(item.Hash)
+			if block == nil {
+				continue
+			}
+			data, err = EncodeMessageWithID(MessageTypeBlock, id, block)
+		case InvTypeCompactBlock:
+			block := s.chain.GetBlockByHash(item.Hash)
+			if block == nil {
+				continue
+			}
+			data, err = EncodeMessageWithID(MessageTypeCompactBlock, id, s.compactBlock(block, from))
+		default:
+			continue
+		}
+		if err != nil {
+			s.logf("编码数据失败: %v", err)
+			continue
+		}
+		s.inventory.markKnown(from, item.Hash)
+		s.send(from, data)
+	}
+}
+
+func (s *Server) broadcastTx(tx *core.Transaction, from net.Addr) {
+	s.announce(InvTypeTx, tx.CalHash(), from)
+}
+
+func (s *Server) broadcastBlock(block *core.Block, from net.Addr) {
+	s.announce(InvTypeBlock, block.Hash(), from)
+}
@@ -0,0 +1,368 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"go-chain/types"
+	"go-chain/utils"
+	"math/bits"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// 每个K桶最多保存的节点数量 也是一次FIND_NODE最多返回的节点数量
+	kBucketSize = 16
+	// 每次查询同时询问的节点数量
+	kademliaAlpha = 3
+	// 节点位置的位数 也是K桶的数量
+	nodeKeyBits = 256
+	// 随机查询一个位置的间隔 用于发现新的节点
+	dhtRefreshInterval = time.Minute
+)
+
+// NodeKey 节点在DHT中的位置 为节点ID的哈希 两个节点之间的距离为位置的异或
+func NodeKey(id string) types.Hash {
+	return types.HashFromBytes(utils.SHA256([]byte(id)))
+}
+
+// LogDistance 返回a和b异或之后最高的非零位是第几位 相同时为0 值越小距离越近
+func LogDistance(a types.Hash, b types.Hash) int {
+	for i := range a {
+		if x := a[i] ^ b[i]; x != 0 {
+			return (len(a)-i)*8 - bits.LeadingZeros8(x)
+		}
+	}
+	return 0
+}
+
+// closer a是否比b离target更近
+func closer(target types.Hash, a types.Hash, b types.Hash) bool {
+	for i := range target {
+		da, db := a[i]^target[i], b[i]^target[i]
+		if da != db {
+			return da < db
+		}
+	}
+	return false
+}
+
+type dhtNode struct {
+	NodeRecord
+	key types.Hash
+	// 最近一次确认节点在线的时间 从其他节点得知还没有连接过的节点为零值
+	lastSeen time.Time
+}
+
+// RoutingTable Kademlia路由表 第i个K桶保存与本节点的距离为LogDistance i+1的节点
+// 离本节点越远的K桶覆盖的ID空间越大 从不同的K桶中选择节点可以连接到网络中不同的部分
+type RoutingTable struct {
+	mu      sync.Mutex
+	self    types.Hash
+	buckets [nodeKeyBits][]*dhtNode
+}
+
+func NewRoutingTable(selfID string) *RoutingTable {
+	return &RoutingTable{self: NodeKey(selfID)}
+}
+
+// Add 添加或者更新一个节点 seen为确认节点在线的时间 从其他节点得知的节点为零值
+// K桶已满时优先替换还没有确认过的节点 否则保留旧的节点 在线时间长的节点更可能继续在线
+// 返回是否是新节点
+func (rt *RoutingTable) Add(id string, addr string, seen time.Time) bool {
+	if id == "" || addr == "" || len(id) > maxStringLength || len(addr) > maxStringLength {
+		return false
+	}
+	key := NodeKey(id)
+	d := LogDistance(rt.self, key)
+	if d == 0 {
+		return false
+	}
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	bucket := rt.buckets[d-1]
+	for i, n := range bucket {
+		if n.ID != id {
+			continue
+		}
+		if seen.IsZero() {
+			return false
+		}
+		// 确认在线的节点移到K桶的末尾
+		n.Addr = addr
+		n.lastSeen = seen
+		rt.buckets[d-1] = append(append(bucket[:i:i], bucket[i+1:]...), n)
+		return false
+	}
+
+	node := &dhtNode{NodeRecord: NodeRecord{ID: id, Addr: addr}, key: key, lastSeen: seen}
+	if len(bucket) < kBucketSize {
+		rt.buckets[d-1] = append(bucket, node)
+		return true
+	}
+	if seen.IsZero() {
+		return false
+	}
+	for i, n := range bucket {
+		if n.lastSeen.IsZero() {
+			rt.buckets[d-1] = append(append(bucket[:i:i], bucket[i+1:]...), node)
+			return true
+		}
+	}
+	return false
+}
+
+// RemoveAddr 删除监听在addr上的节点 连接失败的节点不再返回给其他节点
+func (rt *RoutingTable) RemoveAddr(addr string) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	for d, bucket := range rt.buckets {
+		for i, n := range bucket {
+			if n.Addr == addr {
+				rt.buckets[d] = append(bucket[:i:i], bucket[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+func (rt *RoutingTable) Size() int {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	n := 0
+	for _, bucket := range rt.buckets {
+		n += len(bucket)
+	}
+	return n
+}
+
+// Closest 返回路由表中离target最近的最多n个节点
+func (rt *RoutingTable) Closest(target types.Hash, n int) []NodeRecord {
+	// Add会修改已有节点的地址 在锁内复制节点
+	rt.mu.Lock()
+	nodes := make([]dhtNode, 0, kBucketSize)
+	for _, bucket := range rt.buckets {
+		for _, node := range bucket {
+			nodes = append(nodes, *node)
+		}
+	}
+	rt.mu.Unlock()
+
+	sort.Slice(nodes, func(i, j int) bool {
+		return closer(target, nodes[i].key, nodes[j].key)
+	})
+	if len(nodes) > n {
+		nodes = nodes[:n]
+	}
+	records := make([]NodeRecord, len(nodes))
+	for i, node := range nodes {
+		records[i] = node.NodeRecord
+	}
+	return records
+}
+
+// Diverse 返回最多n个来自不同K桶的节点 从最远的K桶开始每个K桶轮流取一个最近确认过的节点
+func (rt *RoutingTable) Diverse(n int) []NodeRecord {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	records := make([]NodeRecord, 0, n)
+	for round := 0; round < kBucketSize; round++ {
+		for d := nodeKeyBits - 1; d >= 0; d-- {
+			bucket := rt.buckets[d]
+			if round >= len(bucket) {
+				continue
+			}
+			if len(records) >= n {
+				return records
+			}
+			records = append(records, bucket[len(bucket)-1-round].NodeRecord)
+		}
+	}
+	return records
+}
+
+// FindNode 迭代查询离target最近的节点
+// 每一轮并行询问结果中还没有询问过的最近的kademliaAlpha个节点 把返回的节点合并到结果中
+// 一轮询问没有发现更近的节点时结束 返回离target最近的最多kBucketSize个节点
+func (s *Server) FindNode(target types.Hash) []NodeRecord {
+	result := s.dht.Closest(target, kBucketSize)
+	queried := map[string]bool{s.opts.id: true}
+	for {
+		batch := make([]NodeRecord, 0, kademliaAlpha)
+		for _, node := range result {
+			if len(batch) == kademliaAlpha {
+				break
+			}
+			if !queried[node.ID] {
+				queried[node.ID] = true
+				batch = append(batch, node)
+			}
+		}
+		if len(batch) == 0 {
+			return result
+		}
+
+		responses := make([][]NodeRecord, len(batch))
+		failed := make([]bool, len(batch))
+		var wg sync.WaitGroup
+		for i, node := range batch {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				nodes, err := s.queryNode(node, target)
+				if err != nil {
+					s.logf("向 %s 查询节点失败: %v", node.Addr, err)
+					failed[i] = true
+					return
+				}
+				responses[i] = nodes
+			}()
+		}
+		wg.Wait()
+
+		// 无法访问的节点不再留在结果中
+		best := NodeKey(result[0].ID)
+		known := make(map[string]bool, len(result))
+		merged := make([]NodeRecord, 0, len(result))
+		for _, node := range result {
+			known[node.ID] = true
+			if i := indexOfNode(batch, node.ID); i < 0 || !failed[i] {
+				merged = append(merged, node)
+			}
+		}
+		improved := false
+		for _, nodes := range responses {
+			for _, node := range nodes {
+				if known[node.ID] {
+					continue
+				}
+				known[node.ID] = true
+				merged = append(merged, node)
+				if closer(target, NodeKey(node.ID), best) {
+					improved = true
+				}
+			}
+		}
+		sort.Slice(merged, func(i, j int) bool {
+			return closer(target, NodeKey(merged[i].ID), NodeKey(merged[j].ID))
+		})
+		if len(merged) > kBucketSize {
+			merged = merged[:kBucketSize]
+		}
+		result = merged
+		if !improved {
+			return result
+		}
+	}
+}
+
+func indexOfNode(nodes []NodeRecord, id string) int {
+	for i, node := range nodes {
+		if node.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// queryNode 向一个节点发送FIND_NODE请求 已经连接的节点通过现有的连接请求
+// 还没有连接的节点临时建立一个连接 收到响应后关闭 不占用连接管理器的名额
+func (s *Server) queryNode(node NodeRecord, target types.Hash) ([]NodeRecord, error) {
+	if addr := s.connectedAddr(node); addr != nil {
+		return s.requestNodes(addr, target)
+	}
+	msg := new(NodesMessage)
+	if err := s.requestOnce(node.Addr, MessageTypeFindNode, &FindNodeMessage{Target: target}, MessageTypeNodes, msg); err != nil {
+		return nil, err
+	}
+	return s.addNodes(node.Addr, msg.Nodes), nil
+}
+
+// connectedAddr 返回与这个节点的连接的远端地址 没有连接时返回nil
+func (s *Server) connectedAddr(node NodeRecord) net.Addr {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for remote, info := range s.peerInfo {
+		if info.duplicate {
+			continue
+		}
+		if info.id == node.ID || remote == node.Addr || info.listenAddr == node.Addr {
+			return info.peer.RemoteAddr()
+		}
+	}
+	return nil
+}
+
+// requestNodes 通过已经建立的连接发送FIND_NODE请求 响应中的节点加入路由表和地址簿
+func (s *Server) requestNodes(to net.Addr, target types.Hash) ([]NodeRecord, error) {
+	msg := new(NodesMessage)
+	if err := s.Request(context.Background(), to, MessageTypeFindNode, &FindNodeMessage{Target: target}, MessageTypeNodes, msg); err != nil {
+		return nil, err
+	}
+	return s.addNodes(to.String(), msg.Nodes), nil
+}
+
+// addNodes 把FIND_NODE响应中的节点加入路由表和地址簿 主动连接不足时连接新的节点
+// 返回除本节点之外的节点
+func (s *Server) addNodes(source string, nodes []NodeRecord) []NodeRecord {
+	added := 0
+	records := make([]NodeRecord, 0, len(nodes))
+	for _, node := range nodes {
+		if node.ID == s.opts.id || s.isSelfAddr(node.Addr) {
+			continue
+		}
+		s.addrBook.Add(node.Addr, source)
+		if s.dht.Add(node.ID, node.Addr, time.Time{}) {
+			added++
+		}
+		records = append(records, node)
+	}
+	if added > 0 {
+		s.maintainPeers()
+	}
+	return records
+}
+
+// dhtLoop 定期查询随机的位置 发现网络中不同部分的节点
+func (s *Server) dhtLoop() {
+	ticker := s.opts.clock.NewTicker(dhtRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C():
+			s.FindNode(types.RandomHash())
+		case <-s.quitCh:
+			return
+		}
+	}
+}
+
+// handleFindNodeMessage 返回路由表中离目标最近的节点 响应带上请求的编号
+func (s *Server) handleFindNodeMessage(from net.Addr, id uint64, body []byte) {
+	msg := new(FindNodeMessage)
+	if err := DecodeExact(bytes.NewBuffer(body), msg); err != nil {
+		s.logf("解析FIND_NODE消息失败: %v", err)
+		s.misbehave(from, misbehaviorBadMessage)
+		return
+	}
+
+	data, err := EncodeMessageWithID(MessageTypeNodes, id, &NodesMessage{
+		Nodes: s.dht.Closest(msg.Target, kBucketSize),
+	})
+	if err != nil {
+		s.logf("编码节点消息失败: %v", err)
+		return
+	}
+	s.send(from, data)
+}
+
+// handleNodesMessage 处理没有对应请求的节点列表 FIND_NODE的响应都交给发起请求的查询
+// 没有请求过或者已经超时的节点列表直接丢弃 不加入路由表和地址簿
+func (s *Server) handleNodesMessage(from net.Addr) {
+	s.logf("丢弃来自 %s 的未请求的节点列表", from)
+}
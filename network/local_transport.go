@@ -0,0 +1,186 @@
+package network
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+const (
+	// 每条本地连接上最多缓存的消息数量 缓存满时发送方阻塞 与TCP的发送缓冲区类似
+	localInboxSize = 1024
+	// 等待Server接收的连接数量
+	localAcceptBacklog = 16
+)
+
+var (
+	ErrPeerClosed        = errors.New("连接已关闭")
+	ErrTransportNotFound = errors.New("未找到目标节点")
+)
+
+// LocalTransport 在同一个进程内连接多个Server 不使用网络端口
+// 节点之间需要先通过Connect互相登记 之后才能按地址Dial
+type LocalTransport struct {
+	addr     NetAddr
+	mu       sync.RWMutex
+	started  bool
+	peers    map[NetAddr]*LocalTransport
+	acceptCh chan Peer
+	// 关闭后不再接受新的连接
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+var _ Transport = new(LocalTransport)
+var _ Peer = new(LocalPeer)
+
+func NewLocalTransport(addr NetAddr) *LocalTransport {
+	return &LocalTransport{
+		addr:     addr,
+		peers:    make(map[NetAddr]*LocalTransport),
+		acceptCh: make(chan Peer, localAcceptBacklog),
+		closed:   make(chan struct{}),
+	}
+}
+
+// Connect 让两个本地传输层互相可见 相当于把它们放到同一个网络中
+func (t *LocalTransport) Connect(other *LocalTransport) {
+	t.mu.Lock()
+	t.peers[other.addr] = other
+	t.mu.Unlock()
+
+	other.mu.Lock()
+	other.peers[t.addr] = t
+	other.mu.Unlock()
+}
+
+func (t *LocalTransport) Start() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.started = true
+	return nil
+}
+
+// Dial 与目标节点建立一对相连的LocalPeer 目标节点还没有启动时与TCP一样连接失败
+func (t *LocalTransport) Dial(addr string) (Peer, error) {
+	t.mu.RLock()
+	remote, ok := t.peers[NetAddr(addr)]
+	t.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrTransportNotFound, addr)
+	}
+
+	remote.mu.RLock()
+	started := remote.started
+	remote.mu.RUnlock()
+	if !started {
+		return nil, fmt.Errorf("节点 %s 还没有启动", addr)
+	}
+
+	local, accepted := newLocalPeerPair(t.addr, remote.addr)
+	select {
+	case remote.acceptCh <- accepted:
+	case <-remote.closed:
+		return nil, fmt.Errorf("节点 %s 已经停止", addr)
+	}
+	return local, nil
+}
+
+func (t *LocalTransport) Accept() <-chan Peer {
+	return t.acceptCh
+}
+
+func (t *LocalTransport) Addr() NetAddr {
+	return t.addr
+}
+
+// Close 停止接受新的连接 之后连接这个节点会失败
+func (t *LocalTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.started = false
+	t.closeOnce.Do(func() {
+		close(t.closed)
+	})
+	return nil
+}
+
+// LocalPeer 本地连接的一端 发送的消息直接放入另一端的收件箱
+type LocalPeer struct {
+	remote NetAddr
+	inbox  chan []byte
+	other  *LocalPeer
+	// 两端共享 任意一端关闭后整条连接都不可用
+	closed    chan struct{}
+	closeOnce *sync.Once
+}
+
+func newLocalPeerPair(from NetAddr, to NetAddr) (*LocalPeer, *LocalPeer) {
+	closed := make(chan struct{})
+	closeOnce := new(sync.Once)
+	dialer := &LocalPeer{
+		remote:    to,
+		inbox:     make(chan []byte, localInboxSize),
+		closed:    closed,
+		closeOnce: closeOnce,
+	}
+	acceptor := &LocalPeer{
+		remote:    from,
+		inbox:     make(chan []byte, localInboxSize),
+		closed:    closed,
+		closeOnce: closeOnce,
+	}
+	dialer.other = acceptor
+	acceptor.other = dialer
+	return dialer, acceptor
+}
+
+func (p *LocalPeer) Send(payload []byte) error {
+	// 复制一份数据 避免调用方之后修改
+	data := append([]byte(nil), payload...)
+	select {
+	case <-p.closed:
+		return ErrPeerClosed
+	default:
+	}
+	select {
+	case p.other.inbox <- data:
+		return nil
+	case <-p.closed:
+		return ErrPeerClosed
+	}
+}
+
+func (p *LocalPeer) ReceiveLoop(rpcCh chan<- RPC) {
+	defer p.Close()
+
+	for {
+		select {
+		case data := <-p.inbox:
+			rpc := RPC{
+				From:    p.remote,
+				Payload: bytes.NewReader(data),
+			}
+			select {
+			case rpcCh <- rpc:
+			case <-p.closed:
+				return
+			}
+		case <-p.closed:
+			return
+		}
+	}
+}
+
+func (p *LocalPeer) RemoteAddr() net.Addr {
+	return p.remote
+}
+
+func (p *LocalPeer) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.closed)
+	})
+	return nil
+}
@@ -2,28 +2,71 @@ package network
 
 import (
 	"bytes"
-	"encoding/gob"
+	"errors"
 	"go-chain/core"
 	"go-chain/inter"
+	"go-chain/types"
 	"go-chain/utils"
 	"io"
 )
 
 type MessageType byte
 
+var ErrTrailingData = errors.New("消息末尾有多余的数据")
+
+// 解码消息时各个字段的长度上限 编码格式见项目根目录下的 编码格式.md
+const (
+	// 单条消息的最大字节数 同时也是传输层一帧的上限
+	MaxMessageSize = 32 << 20
+	// 一条区块消息中的最大区块数量
+	maxBlocksPerMessage = 16
+	// 一条通告或获取数据消息中的最大条目数量
+	maxInvItems = 4096
+	// 一条连接信息消息中的最大地址数量
+	maxPeersPerMessage = 1000
+	// 节点ID和地址字符串的最大长度
+	maxStringLength = 256
+)
+
+const (
+	MessageTypeTx           MessageType = 0x1
+	MessageTypeBlock        MessageType = 0x2
+	MessageTypeGetBlocks    MessageType = 0x3
+	MessageTypeBlocks       MessageType = 0x4
+	MessageTypeGetStatus    MessageType = 0x5
+	MessageTypeStatus       MessageType = 0x6
+	MessageTypeGetPeers     MessageType = 0x7
+	MessageTypePeers        MessageType = 0x8
+	MessageTypeGetSnapshot  MessageType = 0x9
+	MessageTypeSnapshot     MessageType = 0xa
+	MessageTypeInv          MessageType = 0xb
+	MessageTypeGetData      MessageType = 0xc
+	MessageTypeGetHeaders   MessageType = 0xd
+	MessageTypeHeaders      MessageType = 0xe
+	MessageTypeHello        MessageType = 0xf
+	MessageTypeFindNode     MessageType = 0x10
+	MessageTypeNodes        MessageType = 0x11
+	MessageTypePing         MessageType = 0x12
+	MessageTypePong         MessageType = 0x13
+	MessageTypeCompactBlock MessageType = 0x14
+	MessageTypeGetBlockTxn  MessageType = 0x15
+	MessageTypeBlockTxn     MessageType = 0x16
+)
+
+// InvType 表示通告的数据类型
+type InvType byte
+
 const (
-	MessageTypeTx        MessageType = 0x1
-	MessageTypeBlock     MessageType = 0x2
-	MessageTypeGetBlocks MessageType = 0x3
-	MessageTypeBlocks    MessageType = 0x4
-	MessageTypeGetStatus MessageType = 0x5
-	MessageTypeStatus    MessageType = 0x6
-	MessageTypeGetPeers  MessageType = 0x7
-	MessageTypePeers     MessageType = 0x8
+	InvTypeTx    InvType = 0x1
+	InvTypeBlock InvType = 0x2
+	// 只在GetData中使用 请求对方用紧凑区块的形式发送区块
+	InvTypeCompactBlock InvType = 0x3
 )
 
 type Message struct {
 	Type MessageType
+	// ID 请求的编号 响应消息会带上对应请求的编号 为0表示不需要匹配响应
+	ID   uint64
 	Body []byte
 }
 
@@ -35,6 +78,9 @@ type GetBlocksMessage struct {
 // BlocksMessage 表示区块消息
 type BlocksMessage struct {
 	Blocks []*core.Block
+	// 发送方能提供的区块范围
+	Lowest  uint32
+	Highest uint32
 }
 
 func (bm BlocksMessage) FirstBlock() *core.Block {
@@ -64,83 +110,581 @@ type StatusMessage struct {
 	ID            string
 	Version       uint32
 	CurrentHeight uint32
+	// 能提供完整区块的最低高度 更低的区块已被裁剪
+	LowestHeight uint32
 }
 
 type GetPeersMessage struct {
 }
 
+// PeersMessage 已知节点的监听地址
 type PeersMessage struct {
 	Peers []string
 }
 
+// HelloMessage 建立连接后双方首先发送的消息 宣布自己的节点ID和监听地址
+// 监听地址只有端口时 对方使用连接的来源IP补全
+type HelloMessage struct {
+	ID         string
+	ListenAddr string
+}
+
+// FindNodeMessage Kademlia的FIND_NODE请求 查询离Target最近的节点
+type FindNodeMessage struct {
+	Target types.Hash
+}
+
+// NodeRecord DHT中一个节点的ID和监听地址
+type NodeRecord struct {
+	ID   string
+	Addr string
+}
+
+// NodesMessage FIND_NODE的响应
+type NodesMessage struct {
+	Nodes []NodeRecord
+}
+
+// PingMessage 检查连接是否存活 对方用相同的Nonce回复Pong
+type PingMessage struct {
+	Nonce uint64
+}
+
+type PongMessage struct {
+	Nonce uint64
+}
+
+// PrefilledTx 紧凑区块中直接携带的交易 Index为交易在区块中的位置
+type PrefilledTx struct {
+	Index uint32
+	Tx    *core.Transaction
+}
+
+// CompactBlockMessage 只携带区块头和交易短ID的区块 接收方用交易池中的交易还原区块
+// 发送方认为对方还没有的交易直接放在Prefilled中 按Index从小到大排列
+// ShortIDs依次对应其余位置上的交易
+type CompactBlockMessage struct {
+	Header    *core.BlockHeader
+	ShortIDs  []uint64
+	Prefilled []PrefilledTx
+}
+
+// GetBlockTxnMessage 请求紧凑区块中本地缺少的交易 Indexes为交易在区块中的位置
+type GetBlockTxnMessage struct {
+	BlockHash types.Hash
+	Indexes   []uint32
+}
+
+// BlockTxnMessage GetBlockTxn的响应 交易按请求中Indexes的顺序排列
+type BlockTxnMessage struct {
+	BlockHash    types.Hash
+	Transactions []*core.Transaction
+}
+
+// GetSnapshotMessage 请求状态快照的某个分块
+type GetSnapshotMessage struct {
+	// Height 为0时表示请求对方最新的快照
+	Height uint32
+	Index  uint32
+}
+
+// SnapshotMessage 表示状态快照的一个分块
+type SnapshotMessage struct {
+	Height    uint32
+	BlockHash types.Hash
+	StateRoot types.Hash
+	Index     uint32
+	Total     uint32
+	Accounts  []*core.Account
+	// Anchor 快照高度对应的区块 只在第0个分块中携带
+	Anchor *core.Block
+}
+
+// InvVector 用哈希标识一笔交易或者一个区块
+type InvVector struct {
+	Type InvType
+	Hash types.Hash
+}
+
+// InvMessage 通告本节点拥有的交易或区块 只包含哈希
+type InvMessage struct {
+	Items []InvVector
+}
+
+// GetDataMessage 请求对方发送通告过的交易或区块
+type GetDataMessage struct {
+	Items []InvVector
+}
+
+// GetHeadersMessage 请求[From, To]范围内的区块头
+type GetHeadersMessage struct {
+	From uint32
+	To   uint32
+}
+
+// HeadersMessage 表示一组连续的区块头
+type HeadersMessage struct {
+	Headers []*core.BlockHeader
+}
 
+var _ inter.Codable = new(Message)
 var _ inter.Codable = new(GetBlocksMessage)
 var _ inter.Codable = new(BlocksMessage)
 var _ inter.Codable = new(GetStatusMessage)
 var _ inter.Codable = new(StatusMessage)
-var _ inter.Codable = new(GetBlocksMessage)
 var _ inter.Codable = new(GetPeersMessage)
 var _ inter.Codable = new(PeersMessage)
+var _ inter.Codable = new(GetSnapshotMessage)
+var _ inter.Codable = new(SnapshotMessage)
+var _ inter.Codable = new(InvMessage)
+var _ inter.Codable = new(GetDataMessage)
+var _ inter.Codable = new(GetHeadersMessage)
+var _ inter.Codable = new(HeadersMessage)
+var _ inter.Codable = new(HelloMessage)
+var _ inter.Codable = new(FindNodeMessage)
+var _ inter.Codable = new(NodesMessage)
+var _ inter.Codable = new(PingMessage)
+var _ inter.Codable = new(PongMessage)
+var _ inter.Codable = new(CompactBlockMessage)
+var _ inter.Codable = new(GetBlockTxnMessage)
+var _ inter.Codable = new(BlockTxnMessage)
 
 // 为每种消息类型实现 Encode 和 Decode 方法
+// 字段按照结构体中定义的顺序依次写入 具体格式见 编码格式.md
+
+func encodeWith(w io.Writer, write func(bw *utils.BinaryWriter)) error {
+	bw := utils.NewBinaryWriter(w)
+	write(bw)
+	return bw.Err()
+}
+
+func decodeWith(r io.Reader, read func(br *utils.BinaryReader)) error {
+	br := utils.NewBinaryReader(r)
+	read(br)
+	return br.Err()
+}
+
+// DecodeExact 从r中解码一条消息 r中必须恰好是一条完整的编码 后面还有数据时返回ErrTrailingData
+// 这样同一条消息只有一种编码 对方不能在消息后面附带额外的数据
+func DecodeExact(r io.Reader, c inter.Codable) error {
+	if err := c.Decode(r); err != nil {
+		return err
+	}
+	var extra [1]byte
+	if n, _ := io.ReadFull(r, extra[:]); n > 0 {
+		return ErrTrailingData
+	}
+	return nil
+}
+
+func (m *Message) Encode(w io.Writer) error {
+	return encodeWith(w, func(bw *utils.BinaryWriter) {
+		bw.WriteUint8(uint8(m.Type))
+		bw.WriteUint64(m.ID)
+		bw.WriteBytes(m.Body)
+	})
+}
+
+func (m *Message) Decode(r io.Reader) error {
+	return decodeWith(r, func(br *utils.BinaryReader) {
+		m.Type = MessageType(br.ReadUint8())
+		m.ID = br.ReadUint64()
+		m.Body = br.ReadBytes(MaxMessageSize)
+	})
+}
+
 func (m *GetBlocksMessage) Encode(w io.Writer) error {
-	return utils.EncodeMessage(m, w)
+	return encodeWith(w, func(bw *utils.BinaryWriter) {
+		bw.WriteUint32(m.From)
+		bw.WriteUint32(m.To)
+	})
 }
 
 func (m *GetBlocksMessage) Decode(r io.Reader) error {
-	return utils.DecodeMessage(m, r)
+	return decodeWith(r, func(br *utils.BinaryReader) {
+		m.From = br.ReadUint32()
+		m.To = br.ReadUint32()
+	})
 }
 
 func (m *BlocksMessage) Encode(w io.Writer) error {
-	return utils.EncodeMessage(m, w)
+	return encodeWith(w, func(bw *utils.BinaryWriter) {
+		bw.WriteUint32(uint32(len(m.Blocks)))
+		for _, block := range m.Blocks {
+			core.WriteBlock(bw, block)
+		}
+		bw.WriteUint32(m.Lowest)
+		bw.WriteUint32(m.Highest)
+	})
 }
 
 func (m *BlocksMessage) Decode(r io.Reader) error {
-	return utils.DecodeMessage(m, r)
+	return decodeWith(r, func(br *utils.BinaryReader) {
+		n := br.ReadLength(maxBlocksPerMessage)
+		m.Blocks = make([]*core.Block, 0, n)
+		for i := uint32(0); i < n && br.Err() == nil; i++ {
+			block := new(core.Block)
+			core.ReadBlock(br, block)
+			m.Blocks = append(m.Blocks, block)
+		}
+		m.Lowest = br.ReadUint32()
+		m.Highest = br.ReadUint32()
+	})
 }
 
 func (m *GetStatusMessage) Encode(w io.Writer) error {
-	return utils.EncodeMessage(m, w)
+	return nil
 }
 
 func (m *GetStatusMessage) Decode(r io.Reader) error {
-	return utils.DecodeMessage(m, r)
+	return nil
 }
 
 func (m *StatusMessage) Encode(w io.Writer) error {
-	return utils.EncodeMessage(m, w)
+	return encodeWith(w, func(bw *utils.BinaryWriter) {
+		bw.WriteString(m.ID)
+		bw.WriteUint32(m.Version)
+		bw.WriteUint32(m.CurrentHeight)
+		bw.WriteUint32(m.LowestHeight)
+	})
 }
 
 func (m *StatusMessage) Decode(r io.Reader) error {
-	return utils.DecodeMessage(m, r)
+	return decodeWith(r, func(br *utils.BinaryReader) {
+		m.ID = br.ReadString(maxStringLength)
+		m.Version = br.ReadUint32()
+		m.CurrentHeight = br.ReadUint32()
+		m.LowestHeight = br.ReadUint32()
+	})
 }
 
 func (m *GetPeersMessage) Encode(w io.Writer) error {
-	return utils.EncodeMessage(m, w)
+	return nil
 }
 
 func (m *GetPeersMessage) Decode(r io.Reader) error {
-	return utils.DecodeMessage(m, r)
+	return nil
 }
 
 func (m *PeersMessage) Encode(w io.Writer) error {
-	return utils.EncodeMessage(m, w)
+	return encodeWith(w, func(bw *utils.BinaryWriter) {
+		bw.WriteUint32(uint32(len(m.Peers)))
+		for _, peer := range m.Peers {
+			bw.WriteString(peer)
+		}
+	})
 }
 
 func (m *PeersMessage) Decode(r io.Reader) error {
-	return utils.DecodeMessage(m, r)
+	return decodeWith(r, func(br *utils.BinaryReader) {
+		n := br.ReadLength(maxPeersPerMessage)
+		m.Peers = make([]string, 0, n)
+		for i := uint32(0); i < n && br.Err() == nil; i++ {
+			m.Peers = append(m.Peers, br.ReadString(maxStringLength))
+		}
+	})
+}
+
+func (m *HelloMessage) Encode(w io.Writer) error {
+	return encodeWith(w, func(bw *utils.BinaryWriter) {
+		bw.WriteString(m.ID)
+		bw.WriteString(m.ListenAddr)
+	})
+}
+
+func (m *HelloMessage) Decode(r io.Reader) error {
+	return decodeWith(r, func(br *utils.BinaryReader) {
+		m.ID = br.ReadString(maxStringLength)
+		m.ListenAddr = br.ReadString(maxStringLength)
+	})
+}
+
+func (m *FindNodeMessage) Encode(w io.Writer) error {
+	return encodeWith(w, func(bw *utils.BinaryWriter) {
+		bw.WriteFixed(m.Target[:])
+	})
+}
+
+func (m *FindNodeMessage) Decode(r io.Reader) error {
+	return decodeWith(r, func(br *utils.BinaryReader) {
+		br.ReadFixed(m.Target[:])
+	})
+}
+
+func (m *NodesMessage) Encode(w io.Writer) error {
+	return encodeWith(w, func(bw *utils.BinaryWriter) {
+		bw.WriteUint32(uint32(len(m.Nodes)))
+		for _, node := range m.Nodes {
+			bw.WriteString(node.ID)
+			bw.WriteString(node.Addr)
+		}
+	})
+}
+
+func (m *NodesMessage) Decode(r io.Reader) error {
+	return decodeWith(r, func(br *utils.BinaryReader) {
+		n := br.ReadLength(kBucketSize)
+		m.Nodes = make([]NodeRecord, 0, n)
+		for i := uint32(0); i < n && br.Err() == nil; i++ {
+			m.Nodes = append(m.Nodes, NodeRecord{
+				ID:   br.ReadString(maxStringLength),
+				Addr: br.ReadString(maxStringLength),
+			})
+		}
+	})
+}
+
+func (m *PingMessage) Encode(w io.Writer) error {
+	return encodeWith(w, func(bw *utils.BinaryWriter) {
+		bw.WriteUint64(m.Nonce)
+	})
+}
+
+func (m *PingMessage) Decode(r io.Reader) error {
+	return decodeWith(r, func(br *utils.BinaryReader) {
+		m.Nonce = br.ReadUint64()
+	})
+}
+
+func (m *PongMessage) Encode(w io.Writer) error {
+	return encodeWith(w, func(bw *utils.BinaryWriter) {
+		bw.WriteUint64(m.Nonce)
+	})
+}
+
+func (m *PongMessage) Decode(r io.Reader) error {
+	return decodeWith(r, func(br *utils.BinaryReader) {
+		m.Nonce = br.ReadUint64()
+	})
+}
+
+func (m *CompactBlockMessage) Encode(w io.Writer) error {
+	return encodeWith(w, func(bw *utils.BinaryWriter) {
+		core.WriteBlockHeader(bw, m.Header)
+		bw.WriteUint32(uint32(len(m.ShortIDs)))
+		for _, id := range m.ShortIDs {
+			bw.WriteUint64(id)
+		}
+		bw.WriteUint32(uint32(len(m.Prefilled)))
+		for _, p := range m.Prefilled {
+			bw.WriteUint32(p.Index)
+			core.WriteTransaction(bw, p.Tx)
+		}
+	})
+}
+
+func (m *CompactBlockMessage) Decode(r io.Reader) error {
+	return decodeWith(r, func(br *utils.BinaryReader) {
+		m.Header = new(core.BlockHeader)
+		core.ReadBlockHeader(br, m.Header)
+		n := br.ReadLength(core.MaxBlockTransactions)
+		m.ShortIDs = make([]uint64, n)
+		for i := range m.ShortIDs {
+			m.ShortIDs[i] = br.ReadUint64()
+		}
+		n = br.ReadLength(core.MaxBlockTransactions)
+		m.Prefilled = make([]PrefilledTx, 0, n)
+		for i := uint32(0); i < n && br.Err() == nil; i++ {
+			p := PrefilledTx{Index: br.ReadUint32(), Tx: new(core.Transaction)}
+			core.ReadTransaction(br, p.Tx)
+			m.Prefilled = append(m.Prefilled, p)
+		}
+	})
+}
+
+func (m *GetBlockTxnMessage) Encode(w io.Writer) error {
+	return encodeWith(w, func(bw *utils.BinaryWriter) {
+		bw.WriteFixed(m.BlockHash[:])
+		bw.WriteUint32(uint32(len(m.Indexes)))
+		for _, index := range m.Indexes {
+			bw.WriteUint32(index)
+		}
+	})
+}
+
+func (m *GetBlockTxnMessage) Decode(r io.Reader) error {
+	return decodeWith(r, func(br *utils.BinaryReader) {
+		br.ReadFixed(m.BlockHash[:])
+		n := br.ReadLength(core.MaxBlockTransactions)
+		m.Indexes = make([]uint32, n)
+		for i := range m.Indexes {
+			m.Indexes[i] = br.ReadUint32()
+		}
+	})
+}
+
+func (m *BlockTxnMessage) Encode(w io.Writer) error {
+	return encodeWith(w, func(bw *utils.BinaryWriter) {
+		bw.WriteFixed(m.BlockHash[:])
+		bw.WriteUint32(uint32(len(m.Transactions)))
+		for _, tx := range m.Transactions {
+			core.WriteTransaction(bw, tx)
+		}
+	})
+}
+
+func (m *BlockTxnMessage) Decode(r io.Reader) error {
+	return decodeWith(r, func(br *utils.BinaryReader) {
+		br.ReadFixed(m.BlockHash[:])
+		n := br.ReadLength(core.MaxBlockTransactions)
+		m.Transactions = make([]*core.Transaction, 0, n)
+		for i := uint32(0); i < n && br.Err() == nil; i++ {
+			tx := new(core.Transaction)
+			core.ReadTransaction(br, tx)
+			m.Transactions = append(m.Transactions, tx)
+		}
+	})
+}
+
+func (m *GetSnapshotMessage) Encode(w io.Writer) error {
+	return encodeWith(w, func(bw *utils.BinaryWriter) {
+		bw.WriteUint32(m.Height)
+		bw.WriteUint32(m.Index)
+	})
+}
+
+func (m *GetSnapshotMessage) Decode(r io.Reader) error {
+	return decodeWith(r, func(br *utils.BinaryReader) {
+		m.Height = br.ReadUint32()
+		m.Index = br.ReadUint32()
+	})
+}
+
+func (m *SnapshotMessage) Encode(w io.Writer) error {
+	return encodeWith(w, func(bw *utils.BinaryWriter) {
+		bw.WriteUint32(m.Height)
+		bw.WriteFixed(m.BlockHash[:])
+		bw.WriteFixed(m.StateRoot[:])
+		bw.WriteUint32(m.Index)
+		bw.WriteUint32(m.Total)
+		bw.WriteUint32(uint32(len(m.Accounts)))
+		for _, account := range m.Accounts {
+			core.WriteAccount(bw, account)
+		}
+		bw.WriteBool(m.Anchor != nil)
+		if m.Anchor != nil {
+			core.WriteBlock(bw, m.Anchor)
+		}
+	})
+}
+
+func (m *SnapshotMessage) Decode(r io.Reader) error {
+	return decodeWith(r, func(br *utils.BinaryReader) {
+		m.Height = br.ReadUint32()
+		br.ReadFixed(m.BlockHash[:])
+		br.ReadFixed(m.StateRoot[:])
+		m.Index = br.ReadUint32()
+		m.Total = br.ReadUint32()
+		n := br.ReadLength(snapshotChunkSize)
+		m.Accounts = make([]*core.Account, 0, n)
+		for i := uint32(0); i < n && br.Err() == nil; i++ {
+			account := new(core.Account)
+			core.ReadAccount(br, account)
+			m.Accounts = append(m.Accounts, account)
+		}
+		m.Anchor = nil
+		if br.ReadBool() {
+			m.Anchor = new(core.Block)
+			core.ReadBlock(br, m.Anchor)
+		}
+	})
+}
+
+func writeInvItems(bw *utils.BinaryWriter, items []InvVector) {
+	bw.WriteUint32(uint32(len(items)))
+	for _, item := range items {
+		bw.WriteUint8(uint8(item.Type))
+		bw.WriteFixed(item.Hash[:])
+	}
+}
+
+func readInvItems(br *utils.BinaryReader) []InvVector {
+	n := br.ReadLength(maxInvItems)
+	items := make([]InvVector, n)
+	for i := range items {
+		items[i].Type = InvType(br.ReadUint8())
+		br.ReadFixed(items[i].Hash[:])
+	}
+	return items
+}
+
+func (m *InvMessage) Encode(w io.Writer) error {
+	return encodeWith(w, func(bw *utils.BinaryWriter) {
+		writeInvItems(bw, m.Items)
+	})
+}
+
+func (m *InvMessage) Decode(r io.Reader) error {
+	return decodeWith(r, func(br *utils.BinaryReader) {
+		m.Items = readInvItems(br)
+	})
+}
+
+func (m *GetDataMessage) Encode(w io.Writer) error {
+	return encodeWith(w, func(bw *utils.BinaryWriter) {
+		writeInvItems(bw, m.Items)
+	})
+}
+
+func (m *GetDataMessage) Decode(r io.Reader) error {
+	return decodeWith(r, func(br *utils.BinaryReader) {
+		m.Items = readInvItems(br)
+	})
+}
+
+func (m *GetHeadersMessage) Encode(w io.Writer) error {
+	return encodeWith(w, func(bw *utils.BinaryWriter) {
+		bw.WriteUint32(m.From)
+		bw.WriteUint32(m.To)
+	})
+}
+
+func (m *GetHeadersMessage) Decode(r io.Reader) error {
+	return decodeWith(r, func(br *utils.BinaryReader) {
+		m.From = br.ReadUint32()
+		m.To = br.ReadUint32()
+	})
+}
+
+func (m *HeadersMessage) Encode(w io.Writer) error {
+	return encodeWith(w, func(bw *utils.BinaryWriter) {
+		bw.WriteUint32(uint32(len(m.Headers)))
+		for _, header := range m.Headers {
+			core.WriteBlockHeader(bw, header)
+		}
+	})
+}
+
+func (m *HeadersMessage) Decode(r io.Reader) error {
+	return decodeWith(r, func(br *utils.BinaryReader) {
+		n := br.ReadLength(maxHeadersPerMessage)
+		m.Headers = make([]*core.BlockHeader, 0, n)
+		for i := uint32(0); i < n && br.Err() == nil; i++ {
+			header := new(core.BlockHeader)
+			core.ReadBlockHeader(br, header)
+			m.Headers = append(m.Headers, header)
+		}
+	})
 }
 
 func EncodeMessage(t MessageType, c inter.Codable) ([]byte, error) {
+	return EncodeMessageWithID(t, 0, c)
+}
+
+// EncodeMessageWithID 编码带有请求编号的消息 用于发送请求和回复请求
+func EncodeMessageWithID(t MessageType, id uint64, c inter.Codable) ([]byte, error) {
 	var b bytes.Buffer
-	c.Encode(&b)
+	if err := c.Encode(&b); err != nil {
+		return nil, err
+	}
 	msg := Message{
 		Type: t,
+		ID:   id,
 		Body: b.Bytes(),
 	}
 	var buf bytes.Buffer
-	if err := gob.NewEncoder(&buf).Encode(msg); err != nil {
+	if err := msg.Encode(&buf); err != nil {
 		return nil, err
 	}
 	return buf.Bytes(), nil
-}
\ No newline at end of file
+}
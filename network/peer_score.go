@@ -0,0 +1,206 @@
+package network
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// 新连接的节点的初始评分 也是评分恢复的上限
+	initialPeerScore = 100
+	// 评分降到这个值以下的节点被断开并禁止连接
+	banScoreThreshold = 0
+	// 每分钟恢复的评分 偶尔出错的节点不会被一直记着
+	scoreRecoveryPerMinute = 1
+	// 默认的禁止连接时长
+	defaultBanDuration = 24 * time.Hour
+)
+
+var ErrPeerBanned = errors.New("节点已被禁止连接")
+
+// misbehavior 节点的不当行为 不同的行为扣除不同的评分
+type misbehavior int
+
+const (
+	// 无法解码的消息
+	misbehaviorBadMessage misbehavior = iota
+	// 违反协议 例如未知的消息类型或者无效的区块头链
+	misbehaviorProtocol
+	// 超过限速的消息
+	misbehaviorSpam
+	// 余额不足 nonce过低等无效交易
+	misbehaviorInvalidTx
+	// 签名无效的交易
+	misbehaviorBadSignature
+	// 校验失败的区块
+	misbehaviorInvalidBlock
+)
+
+var misbehaviorPenalties = map[misbehavior]float64{
+	misbehaviorBadMessage:   20,
+	misbehaviorProtocol:     20,
+	misbehaviorSpam:         1,
+	misbehaviorInvalidTx:    10,
+	misbehaviorBadSignature: 20,
+	misbehaviorInvalidBlock: 50,
+}
+
+var misbehaviorNames = map[misbehavior]string{
+	misbehaviorBadMessage:   "无法解码的消息",
+	misbehaviorProtocol:     "违反协议",
+	misbehaviorSpam:         "超过限速",
+	misbehaviorInvalidTx:    "无效交易",
+	misbehaviorBadSignature: "签名无效",
+	misbehaviorInvalidBlock: "无效区块",
+}
+
+func (m misbehavior) String() string {
+	return misbehaviorNames[m]
+}
+
+type peerScore struct {
+	score float64
+	last  time.Time
+}
+
+// peerScores 记录每个连接的评分和被禁止连接的节点
+// 评分按连接记录 禁止连接按主机记录 节点换一个端口重新连接也会被拒绝
+type peerScores struct {
+	mu          sync.Mutex
+	banDuration time.Duration
+	scores      map[string]*peerScore
+	// 被禁止的主机和解除禁止的时间
+	banned map[string]time.Time
+}
+
+func newPeerScores(banDuration time.Duration) *peerScores {
+	if banDuration <= 0 {
+		banDuration = defaultBanDuration
+	}
+	return &peerScores{
+		banDuration: banDuration,
+		scores:      make(map[string]*peerScore),
+		banned:      make(map[string]time.Time),
+	}
+}
+
+// banKey 禁止连接使用的主机 没有端口的地址(例如本地传输层的地址)直接使用整个地址
+func banKey(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// score 返回节点当前的评分 没有记录的节点为初始评分
+func (ps *peerScores) score(addr net.Addr, now time.Time) float64 {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if _, ok := ps.scores[addr.String()]; !ok {
+		return initialPeerScore
+	}
+	return ps.peer(addr, now).score
+}
+
+// peer 返回节点的评分记录 并按经过的时间恢复评分 调用时需要持有ps.mu
+func (ps *peerScores) peer(addr net.Addr, now time.Time) *peerScore {
+	p, ok := ps.scores[addr.String()]
+	if !ok {
+		p = &peerScore{score: initialPeerScore, last: now}
+		ps.scores[addr.String()] = p
+		return p
+	}
+	if elapsed := now.Sub(p.last).Minutes(); elapsed > 0 {
+		p.score += elapsed * scoreRecoveryPerMinute
+		if p.score > initialPeerScore {
+			p.score = initialPeerScore
+		}
+		p.last = now
+	}
+	return p
+}
+
+// penalize 按不当行为扣除节点的评分 评分过低时禁止这个节点 返回true表示应该断开连接
+func (ps *peerScores) penalize(addr net.Addr, m misbehavior, now time.Time) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	p := ps.peer(addr, now)
+	p.score -= misbehaviorPenalties[m]
+	if p.score > banScoreThreshold {
+		return false
+	}
+	ps.banned[banKey(addr.String())] = now.Add(ps.banDuration)
+	return true
+}
+
+// ban 禁止节点连接一段时间
+func (ps *peerScores) ban(addr string, d time.Duration, now time.Time) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.banned[banKey(addr)] = now.Add(d)
+}
+
+// isBanned 节点是否被禁止连接 顺便清理已经到期的记录
+func (ps *peerScores) isBanned(addr string, now time.Time) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	key := banKey(addr)
+	until, ok := ps.banned[key]
+	if !ok {
+		return false
+	}
+	if !now.Before(until) {
+		delete(ps.banned, key)
+		return false
+	}
+	return true
+}
+
+// remove 删除已断开连接的评分记录
+func (ps *peerScores) remove(addr net.Addr) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	delete(ps.scores, addr.String())
+}
+
+// misbehave 记录节点的不当行为 评分过低的节点被断开并在一段时间内禁止连接
+func (s *Server) misbehave(from net.Addr, m misbehavior) {
+	s.logf("节点 %s 的不当行为: %s", from, m)
+	if !s.scores.penalize(from, m, s.opts.clock.Now()) {
+		return
+	}
+	s.logf("节点 %s 的评分过低, 断开连接并禁止连接 %v", from, s.scores.banDuration)
+	s.disconnect(from)
+}
+
+// BanPeer 断开与这个主机的所有连接 并在d时间内拒绝它的连接 d为0时使用默认时长
+func (s *Server) BanPeer(addr string, d time.Duration) {
+	if d <= 0 {
+		d = s.scores.banDuration
+	}
+	s.scores.ban(addr, d, s.opts.clock.Now())
+
+	key := banKey(addr)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for peerAddr, peer := range s.peerMap {
+		if banKey(peerAddr.String()) == key {
+			peer.Close()
+		}
+	}
+}
+
+// IsBanned 节点是否被禁止连接
+func (s *Server) IsBanned(addr string) bool {
+	return s.scores.isBanned(addr, s.opts.clock.Now())
+}
+
+// PeerScore 返回节点当前的评分
+func (s *Server) PeerScore(addr string) float64 {
+	return s.scores.score(NetAddr(addr), s.opts.clock.Now())
+}
@@ -0,0 +1,180 @@
+package network
+
+import (
+	"bytes"
+	"math/rand"
+	"net"
+	"sort"
+	"time"
+)
+
+const (
+	// 向每个节点发送Ping的间隔
+	pingInterval = 15 * time.Second
+	// 超过这个时间没有收到Pong的节点被断开
+	pingTimeout = 20 * time.Second
+)
+
+// PeerStats 一个连接的状态 RTT为往返时间的平滑值 还没有测量过时为0
+type PeerStats struct {
+	Addr     string
+	ID       string
+	Outbound bool
+	RTT      time.Duration
+	// 最近一次收到Pong的时间
+	LastPong time.Time
+}
+
+// pingState 每个连接的Ping状态 由Server.mu保护
+type pingState struct {
+	// 等待响应的Ping 为0表示没有
+	nonce uint64
+	sent  time.Time
+	rtt   time.Duration
+	last  time.Time
+}
+
+// pingLoop 定期向所有节点发送Ping 断开超时没有响应的节点
+func (s *Server) pingLoop() {
+	ticker := s.opts.clock.NewTicker(pingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C():
+			s.pingPeers()
+		case <-s.quitCh:
+			return
+		}
+	}
+}
+
+func (s *Server) pingPeers() {
+	now := s.opts.clock.Now()
+	var (
+		ping []net.Addr
+		dead []Peer
+	)
+	s.mu.RLock()
+	for _, info := range s.peerInfo {
+		if info.ping.nonce == 0 {
+			ping = append(ping, info.peer.RemoteAddr())
+		} else if now.Sub(info.ping.sent) >= pingTimeout {
+			dead = append(dead, info.peer)
+		}
+	}
+	s.mu.RUnlock()
+
+	for _, peer := range dead {
+		s.logf("节点 %s 超过 %v 没有响应Ping, 断开连接", peer.RemoteAddr(), pingTimeout)
+		peer.Close()
+	}
+	for _, addr := range ping {
+		s.sendPing(addr)
+	}
+}
+
+// sendPing 向节点发送Ping 已经有等待响应的Ping时不再发送
+func (s *Server) sendPing(to net.Addr) {
+	nonce := rand.Uint64() | 1
+	s.mu.Lock()
+	info, ok := s.peerInfo[to.String()]
+	if !ok || info.ping.nonce != 0 {
+		s.mu.Unlock()
+		return
+	}
+	info.ping.nonce = nonce
+	info.ping.sent = s.opts.clock.Now()
+	s.mu.Unlock()
+
+	data, err := EncodeMessage(MessageTypePing, &PingMessage{Nonce: nonce})
+	if err != nil {
+		s.logf("编码Ping消息失败: %v", err)
+		return
+	}
+	s.send(to, data)
+}
+
+func (s *Server) handlePingMessage(from net.Addr, body []byte) {
+	ping := new(PingMessage)
+	if err := DecodeExact(bytes.NewBuffer(body), ping); err != nil {
+		s.logf("解析Ping消息失败: %v", err)
+		s.misbehave(from, misbehaviorBadMessage)
+		return
+	}
+	data, err := EncodeMessage(MessageTypePong, &PongMessage{Nonce: ping.Nonce})
+	if err != nil {
+		s.logf("编码Pong消息失败: %v", err)
+		return
+	}
+	s.send(from, data)
+}
+
+// handlePongMessage 记录往返时间 RTT按1/8的权重平滑 与TCP估计RTT的方法相同
+func (s *Server) handlePongMessage(from net.Addr, body []byte) {
+	pong := new(PongMessage)
+	if err := DecodeExact(bytes.NewBuffer(body), pong); err != nil {
+		s.logf("解析Pong消息失败: %v", err)
+		s.misbehave(from, misbehaviorBadMessage)
+		return
+	}
+
+	now := s.opts.clock.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	info, ok := s.peerInfo[from.String()]
+	if !ok || info.ping.nonce == 0 || info.ping.nonce != pong.Nonce {
+		return
+	}
+	sample := now.Sub(info.ping.sent)
+	if info.ping.rtt == 0 {
+		info.ping.rtt = sample
+	} else {
+		info.ping.rtt = (7*info.ping.rtt + sample) / 8
+	}
+	info.ping.nonce = 0
+	info.ping.last = now
+}
+
+// PeerStats 返回所有连接的状态 按RTT从小到大排序 还没有测量过的连接排在最后
+func (s *Server) PeerStats() []PeerStats {
+	s.mu.RLock()
+	stats := make([]PeerStats, 0, len(s.peerInfo))
+	for key, info := range s.peerInfo {
+		stats = append(stats, PeerStats{
+			Addr:     key,
+			ID:       info.id,
+			Outbound: info.outbound,
+			RTT:      info.ping.rtt,
+			LastPong: info.ping.last,
+		})
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(stats, func(i, j int) bool {
+		ri, rj := latencyRank(stats[i].RTT), latencyRank(stats[j].RTT)
+		if ri != rj {
+			return ri < rj
+		}
+		return stats[i].Addr < stats[j].Addr
+	})
+	return stats
+}
+
+// peerLatency 返回节点的RTT 用于同步时选择节点 还没有测量过时按超时时间计算
+func (s *Server) peerLatency(addr string) time.Duration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	info, ok := s.peerInfo[addr]
+	if !ok {
+		return pingTimeout
+	}
+	return latencyRank(info.ping.rtt)
+}
+
+func latencyRank(rtt time.Duration) time.Duration {
+	if rtt == 0 {
+		return pingTimeout
+	}
+	return rtt
+}
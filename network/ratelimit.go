@@ -0,0 +1,134 @@
+package network
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// 每个节点每秒可以发送的交易消息数量和突发上限
+	defaultTxRate  = 100
+	defaultTxBurst = 200
+	// 每个节点每秒可以发送的区块消息数量和突发上限
+	defaultBlockRate  = 10
+	defaultBlockBurst = 20
+	// 每个节点每秒可以发送的通告和数据请求消息数量和突发上限
+	defaultInvRate  = 50
+	defaultInvBurst = 100
+)
+
+// tokenBucket 令牌桶 每秒补充rate个令牌 最多保存burst个令牌
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   now,
+	}
+}
+
+// allow 尝试取出一个令牌 令牌不足时返回false
+func (b *tokenBucket) allow(now time.Time) bool {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// peerLimiter 记录单个节点的消息限速
+type peerLimiter struct {
+	tx    *tokenBucket
+	block *tokenBucket
+	inv   *tokenBucket
+}
+
+// rateLimiter 按节点对交易 区块和通告消息限速
+type rateLimiter struct {
+	mu         sync.Mutex
+	txRate     float64
+	txBurst    int
+	blockRate  float64
+	blockBurst int
+	invRate    float64
+	invBurst   int
+	peers      map[net.Addr]*peerLimiter
+}
+
+func newRateLimiter(opts ServerOpts) *rateLimiter {
+	rl := &rateLimiter{
+		txRate:     defaultTxRate,
+		txBurst:    defaultTxBurst,
+		blockRate:  defaultBlockRate,
+		blockBurst: defaultBlockBurst,
+		invRate:    defaultInvRate,
+		invBurst:   defaultInvBurst,
+		peers:      make(map[net.Addr]*peerLimiter),
+	}
+	if opts.txRate > 0 {
+		rl.txRate = opts.txRate
+		rl.txBurst = opts.txBurst
+	}
+	if opts.blockRate > 0 {
+		rl.blockRate = opts.blockRate
+		rl.blockBurst = opts.blockBurst
+	}
+	if opts.invRate > 0 {
+		rl.invRate = opts.invRate
+		rl.invBurst = opts.invBurst
+	}
+	return rl
+}
+
+func (rl *rateLimiter) peer(addr net.Addr, now time.Time) *peerLimiter {
+	pl, ok := rl.peers[addr]
+	if !ok {
+		pl = &peerLimiter{
+			tx:    newTokenBucket(rl.txRate, rl.txBurst, now),
+			block: newTokenBucket(rl.blockRate, rl.blockBurst, now),
+			inv:   newTokenBucket(rl.invRate, rl.invBurst, now),
+		}
+		rl.peers[addr] = pl
+	}
+	return pl
+}
+
+// allow 判断节点的消息是否超过了限速 只限制交易 区块和通告消息
+// 紧凑区块和补充交易与完整区块一样需要验证和执行 和区块消息共用一个令牌桶
+func (rl *rateLimiter) allow(addr net.Addr, msgType MessageType, now time.Time) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	switch msgType {
+	case MessageTypeTx:
+		return rl.peer(addr, now).tx.allow(now)
+	case MessageTypeBlock, MessageTypeCompactBlock, MessageTypeBlockTxn:
+		return rl.peer(addr, now).block.allow(now)
+	case MessageTypeInv, MessageTypeGetData:
+		return rl.peer(addr, now).inv.allow(now)
+	default:
+		return true
+	}
+}
+
+// remove 删除已断开节点的限速记录
+func (rl *rateLimiter) remove(addr net.Addr) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	delete(rl.peers, addr)
+}
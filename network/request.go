@@ -0,0 +1,157 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"go-chain/inter"
+	"net"
+	"sync"
+	"time"
+)
+
+// 请求没有设置截止时间时默认的超时时间
+const defaultRequestTimeout = 10 * time.Second
+
+var (
+	ErrRequestTimeout     = errors.New("等待响应超时")
+	ErrUnexpectedResponse = errors.New("响应消息类型不匹配")
+)
+
+type pendingRequest struct {
+	peer string
+	ch   chan *Message
+}
+
+// requestManager 为发出的请求分配编号 并把带有相同编号的响应交给等待的请求
+type requestManager struct {
+	mu      sync.Mutex
+	nextID  uint64
+	pending map[uint64]*pendingRequest
+}
+
+func newRequestManager() *requestManager {
+	return &requestManager{
+		pending: make(map[uint64]*pendingRequest),
+	}
+}
+
+// register 登记一个等待响应的请求 返回请求编号和接收响应的通道
+func (rm *requestManager) register(peer net.Addr) (uint64, chan *Message) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	rm.nextID++
+	ch := make(chan *Message, 1)
+	rm.pending[rm.nextID] = &pendingRequest{
+		peer: peer.String(),
+		ch:   ch,
+	}
+	return rm.nextID, ch
+}
+
+// deliver 把响应交给对应的请求 返回false表示没有请求在等待这个响应
+// 只接受被请求节点发回的响应
+func (rm *requestManager) deliver(from net.Addr, msg *Message) bool {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	req, ok := rm.pending[msg.ID]
+	if !ok || req.peer != from.String() {
+		return false
+	}
+	delete(rm.pending, msg.ID)
+	req.ch <- msg
+	return true
+}
+
+func (rm *requestManager) cancel(id uint64) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	delete(rm.pending, id)
+}
+
+// Request 向节点发送请求并等待指定类型的响应 响应的内容解码到resp中
+// ctx没有截止时间时使用默认的超时时间
+func (s *Server) Request(ctx context.Context, to net.Addr, msgType MessageType, req inter.Codable, respType MessageType, resp inter.Codable) error {
+	// 默认的超时使用节点的时钟计时 模拟网络中按虚拟时间超时
+	var timeout <-chan time.Time
+	if _, ok := ctx.Deadline(); !ok {
+		timeout = s.opts.clock.After(defaultRequestTimeout)
+	}
+
+	id, ch := s.requests.register(to)
+	defer s.requests.cancel(id)
+
+	data, err := EncodeMessageWithID(msgType, id, req)
+	if err != nil {
+		return err
+	}
+	if err := s.send(to, data); err != nil {
+		return err
+	}
+
+	select {
+	case msg := <-ch:
+		if msg.Type != respType {
+			return ErrUnexpectedResponse
+		}
+		return DecodeExact(bytes.NewBuffer(msg.Body), resp)
+	case <-timeout:
+		return ErrRequestTimeout
+	case <-s.quitCh:
+		return ErrServerStopped
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return ErrRequestTimeout
+		}
+		return ctx.Err()
+	}
+}
+
+// requestOnce 临时连接addr发送一个请求 收到响应或者超时后关闭连接
+// 临时连接不登记为节点 对方在连接上发送的其他消息都被忽略 用于询问还没有建立连接的节点
+func (s *Server) requestOnce(addr string, msgType MessageType, req inter.Codable, respType MessageType, resp inter.Codable) error {
+	if s.IsBanned(addr) {
+		return ErrPeerBanned
+	}
+	// 临时连接上只有这一个请求 编号固定
+	const id = 1
+	data, err := EncodeMessageWithID(msgType, id, req)
+	if err != nil {
+		return err
+	}
+	peer, err := s.transport.Dial(addr)
+	if err != nil {
+		return err
+	}
+	defer peer.Close()
+
+	rpcCh := make(chan RPC, 8)
+	closed := make(chan struct{})
+	go func() {
+		peer.ReceiveLoop(rpcCh)
+		close(closed)
+	}()
+	if err := peer.Send(data); err != nil {
+		return err
+	}
+
+	timeout := s.opts.clock.After(defaultRequestTimeout)
+	for {
+		select {
+		case rpc := <-rpcCh:
+			msg := new(Message)
+			if err := DecodeExact(rpc.Payload, msg); err != nil || msg.ID != id || msg.Type != respType {
+				continue
+			}
+			return DecodeExact(bytes.NewBuffer(msg.Body), resp)
+		case <-closed:
+			return ErrPeerClosed
+		case <-timeout:
+			return ErrRequestTimeout
+		case <-s.quitCh:
+			return ErrServerStopped
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package network
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// 握手协议的版本
+	handshakeVersion = 1
+	// 握手必须在这个时间内完成 避免半开的连接占用资源
+	handshakeTimeout = 10 * time.Second
+	// 握手第一条消息的长度 版本 + 长期公钥 + 临时公钥
+	handshakeHelloSize = 1 + ed25519.PublicKeySize + 32
+	// 握手签名的前缀 避免签名被用在其他地方
+	handshakeLabel = "go-chain handshake v1"
+)
+
+// 发起方和接收方的角色 签名和派生密钥时区分两个方向
+const (
+	roleInitiator byte = 'I'
+	roleResponder byte = 'R'
+)
+
+var (
+	ErrHandshakeVersion   = errors.New("不支持的握手版本")
+	ErrHandshakeSignature = errors.New("握手签名无效")
+	ErrBadNodeKey         = errors.New("节点密钥文件格式错误")
+)
+
+// NodeIdentity 节点的长期身份密钥 节点ID为公钥的十六进制 建立连接时用它签名握手
+type NodeIdentity struct {
+	priv ed25519.PrivateKey
+}
+
+func GenerateNodeIdentity() (*NodeIdentity, error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("生成节点密钥失败: %v", err)
+	}
+	return &NodeIdentity{priv: priv}, nil
+}
+
+// LoadNodeIdentity 从文件读取节点密钥 文件不存在时生成新的密钥并保存 重启后节点ID不变
+// path为空时生成临时密钥
+func LoadNodeIdentity(path string) (*NodeIdentity, error) {
+	if path == "" {
+		return GenerateNodeIdentity()
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		identity, err := GenerateNodeIdentity()
+		if err != nil {
+			return nil, err
+		}
+		seed := hex.EncodeToString(identity.priv.Seed())
+		if err := os.WriteFile(path, []byte(seed+"\n"), 0600); err != nil {
+			return nil, err
+		}
+		return identity, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, ErrBadNodeKey
+	}
+	return &NodeIdentity{priv: ed25519.NewKeyFromSeed(seed)}, nil
+}
+
+func (id *NodeIdentity) PublicKey() ed25519.PublicKey {
+	return id.priv.Public().(ed25519.PublicKey)
+}
+
+// ID 返回由公钥得到的节点ID
+func (id *NodeIdentity) ID() string {
+	return hex.EncodeToString(id.PublicKey())
+}
+
+// authenticatedPeer 握手时验证过对方身份的连接
+type authenticatedPeer interface {
+	// RemoteID 返回对方的节点ID
+	RemoteID() string
+}
+
+// secureSession 握手之后两个方向各自的AES-GCM密钥和计数器 计数器作为nonce 每一帧加一
+type secureSession struct {
+	sendMu    sync.Mutex
+	send      cipher.AEAD
+	sendNonce uint64
+	recv      cipher.AEAD
+	recvNonce uint64
+}
+
+// handshake 在conn上完成握手 返回会话密钥和对方的节点ID
+// 双方先交换长期公钥和临时公钥 再用长期私钥对整个握手记录签名
+// 签名覆盖了双方的临时公钥 重放旧的握手消息无法通过验证 会话密钥由临时密钥的ECDH得到
+func handshake(conn net.Conn, identity *NodeIdentity, initiator bool) (*secureSession, string, error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, "", err
+	}
+	local := make([]byte, 0, handshakeHelloSize)
+	local = append(local, handshakeVersion)
+	local = append(local, identity.PublicKey()...)
+	local = append(local, ephemeral.PublicKey().Bytes()...)
+	if _, err := conn.Write(local); err != nil {
+		return nil, "", err
+	}
+	remote := make([]byte, handshakeHelloSize)
+	if _, err := io.ReadFull(conn, remote); err != nil {
+		return nil, "", err
+	}
+	if remote[0] != handshakeVersion {
+		return nil, "", ErrHandshakeVersion
+	}
+	remoteStatic := ed25519.PublicKey(remote[1 : 1+ed25519.PublicKeySize])
+	remoteEphemeral, err := ecdh.X25519().NewPublicKey(remote[1+ed25519.PublicKeySize:])
+	if err != nil {
+		return nil, "", err
+	}
+
+	localRole, remoteRole := roleInitiator, roleResponder
+	transcript := handshakeTranscript(local, remote)
+	if !initiator {
+		localRole, remoteRole = roleResponder, roleInitiator
+		transcript = handshakeTranscript(remote, local)
+	}
+
+	sig := ed25519.Sign(identity.priv, signedTranscript(transcript, localRole))
+	if _, err := conn.Write(sig); err != nil {
+		return nil, "", err
+	}
+	remoteSig := make([]byte, ed25519.SignatureSize)
+	if _, err := io.ReadFull(conn, remoteSig); err != nil {
+		return nil, "", err
+	}
+	if !ed25519.Verify(remoteStatic, signedTranscript(transcript, remoteRole), remoteSig) {
+		return nil, "", ErrHandshakeSignature
+	}
+
+	shared, err := ephemeral.ECDH(remoteEphemeral)
+	if err != nil {
+		return nil, "", err
+	}
+	send, err := sessionCipher(shared, transcript, localRole)
+	if err != nil {
+		return nil, "", err
+	}
+	recv, err := sessionCipher(shared, transcript, remoteRole)
+	if err != nil {
+		return nil, "", err
+	}
+	return &secureSession{send: send, recv: recv}, hex.EncodeToString(remoteStatic), nil
+}
+
+// handshakeTranscript 握手记录的哈希 按发起方在前的顺序拼接双方的第一条消息
+func handshakeTranscript(initiatorHello []byte, responderHello []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte(handshakeLabel))
+	h.Write(initiatorHello)
+	h.Write(responderHello)
+	return h.Sum(nil)
+}
+
+// signedTranscript 签名的内容为握手记录加上签名方的角色 一方的签名不能冒充另一方
+func signedTranscript(transcript []byte, role byte) []byte {
+	msg := make([]byte, 0, len(transcript)+1)
+	msg = append(msg, transcript...)
+	return append(msg, role)
+}
+
+// sessionCipher 从共享密钥派生role一方发送数据使用的AES-256-GCM
+func sessionCipher(shared []byte, transcript []byte, role byte) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, shared)
+	mac.Write(transcript)
+	mac.Write([]byte{role})
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func gcmNonce(aead cipher.AEAD, counter uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], counter)
+	return nonce
+}
+
+// writeFrame 加密payload并作为一帧写出 加密和写出在同一把锁内 保证nonce的顺序和帧的顺序一致
+func (s *secureSession) writeFrame(w io.Writer, payload []byte) error {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+
+	frame := make([]byte, 4, 4+len(payload)+s.send.Overhead())
+	frame = s.send.Seal(frame, gcmNonce(s.send, s.sendNonce), payload, nil)
+	s.sendNonce++
+	binary.LittleEndian.PutUint32(frame, uint32(len(frame)-4))
+	_, err := w.Write(frame)
+	return err
+}
+
+// readFrame 读取并解密一帧 只在接收循环中调用
+func (s *secureSession) readFrame(r io.Reader) ([]byte, error) {
+	frame, err := readFrame(r, MaxMessageSize+s.recv.Overhead())
+	if err != nil {
+		return nil, err
+	}
+	payload, err := s.recv.Open(frame[:0], gcmNonce(s.recv, s.recvNonce), frame, nil)
+	if err != nil {
+		return nil, err
+	}
+	s.recvNonce++
+	return payload, nil
+}
@@ -2,12 +2,11 @@ package network
 
 import (
 	"bytes"
-	"encoding/gob"
+	"context"
 	"errors"
 	"fmt"
 	"go-chain/core"
 	"go-chain/cryptoo"
-	"go-chain/utils"
 	"log"
 	"net"
 	"os"
@@ -17,19 +16,56 @@ import (
 )
 
 var (
-	ErrNoSeedNodes = errors.New("no seed nodes provided")
+	ErrNoSeedNodes   = errors.New("no seed nodes provided")
+	ErrServerStopped = errors.New("服务器已停止")
+)
+
+const (
+	// 默认每100秒挖一个区块
+	defaultBlockTime = 100 * time.Second
+	// 向所有节点查询状态的间隔
+	statusInterval = 30 * time.Second
 )
 
 type Server struct {
-	opts         ServerOpts
-	chain        *core.Blockchain
-	mu           sync.RWMutex
-	rpcCh        chan RPC
-	quitCh       chan struct{}
-	peerMap      map[net.Addr]*TCPPeer
-	tcpTransport *TCPTransport
-	priv         *cryptoo.PrivateKey
-	pool         *core.TxPool
+	opts      ServerOpts
+	chain     *core.Blockchain
+	mu        sync.RWMutex
+	rpcCh     chan RPC
+	quitCh    chan struct{}
+	peerMap   map[net.Addr]Peer
+	transport Transport
+	priv      *cryptoo.PrivateKey
+	pool      *core.TxPool
+	snapSync  *snapshotSync
+	// 本地交易日志 未配置日志路径时为nil
+	journal *core.TxJournal
+	limiter *rateLimiter
+	// 节点评分和禁止连接的节点
+	scores *peerScores
+	// 已知的节点地址
+	addrBook *AddrBook
+	// 按节点ID组织的Kademlia路由表
+	dht *RoutingTable
+	// 每个连接的方向 监听地址和节点ID 键为连接的远端地址 由mu保护
+	peerInfo map[string]*peerInfo
+	// 维持连接数量并重连断开的节点
+	connMgr *connManager
+	builder *core.BlockBuilder
+	// 最近收到过的交易 重复的交易不再处理和广播
+	seenTxs *hashCache
+	// 每个节点已经拥有的交易和区块
+	inventory *peerInventory
+	// 等待对方补齐交易的紧凑区块
+	compactBlocks *compactBlocks
+	// 先同步区块头再下载区块的同步状态
+	headerSync *headerSync
+	// 等待响应的请求
+	requests *requestManager
+	// Server启动的所有协程 Stop时等待它们退出
+	wg       sync.WaitGroup
+	stopMu   sync.Mutex
+	stopping bool
 }
 
 type ServerOpts struct {
@@ -40,6 +76,51 @@ type ServerOpts struct {
 	privKey          string
 	allPoolLimit     uint32
 	pendingPoolLimit uint32
+	// 是否开启快照快速同步
+	fastSync bool
+	// 快速同步时至少需要多少个不同的节点确认快照的区块头 为0时使用默认值
+	snapshotQuorum int
+	// 区块链存储的裁剪配置
+	pruneConfig core.PruneConfig
+	// 替换交易时手续费需要提高的百分比
+	priceBump uint64
+	chainID   uint32
+	// 交易在交易池中的最长存活时间
+	txLifetime time.Duration
+	// 每隔多少个区块生成一次状态快照
+	snapshotInterval uint32
+	// 本地交易日志文件的路径 为空时不保存本地交易
+	journalPath string
+	// 每个节点交易 区块和通告消息的限速 为0时使用默认值
+	txRate     float64
+	txBurst    int
+	blockRate  float64
+	blockBurst int
+	invRate    float64
+	invBurst   int
+	// 评分过低的节点被禁止连接的时长 为0时使用默认值
+	banDuration time.Duration
+	// 地址簿文件的路径 为空时不保存地址簿
+	addrBookPath string
+	// 节点密钥文件的路径 为空时每次启动生成新的节点ID
+	nodeKeyPath string
+	// 主动连接数量的下限和上限 被动连接数量的上限 为0时使用默认值
+	minOutbound int
+	maxOutbound int
+	maxInbound  int
+	// 交易池中每个发送者最多可以占用的交易数量
+	accountSlots int
+	// 出块时区块的最大字节数和最大执行额度 为0时使用默认值
+	maxBlockBytes int
+	maxBlockGas   uint64
+	// 节点使用的传输层 为nil时在listenAddr上使用TCP
+	transport Transport
+	// 定时任务使用的时钟 为nil时使用真实时间
+	clock Clock
+	// 出块间隔 为0时使用默认值
+	blockTime time.Duration
+	// 为true时节点只同步和转发区块 不参与出块
+	disableMining bool
 }
 
 type ServerOption func(*ServerOpts)
@@ -50,6 +131,13 @@ func WithListenAddr(addr string) ServerOption {
 	}
 }
 
+// WithTransport 使用指定的传输层代替TCP 监听地址由传输层决定
+func WithTransport(transport Transport) ServerOption {
+	return func(opts *ServerOpts) {
+		opts.transport = transport
+	}
+}
+
 func WithLogger(logger *log.Logger) ServerOption {
 	return func(opts *ServerOpts) {
 		opts.log = logger
@@ -80,6 +168,158 @@ func WithPendingPoolLimit(size uint32) ServerOption {
 	}
 }
 
+func WithFastSync(enable bool) ServerOption {
+	return func(opts *ServerOpts) {
+		opts.fastSync = enable
+	}
+}
+
+// WithSnapshotQuorum 设置快速同步时至少需要多少个不同的节点确认快照的区块头
+func WithSnapshotQuorum(n int) ServerOption {
+	return func(opts *ServerOpts) {
+		opts.snapshotQuorum = n
+	}
+}
+
+func WithSnapshotInterval(interval uint32) ServerOption {
+	return func(opts *ServerOpts) {
+		opts.snapshotInterval = interval
+	}
+}
+
+func WithPruneConfig(config core.PruneConfig) ServerOption {
+	return func(opts *ServerOpts) {
+		opts.pruneConfig = config
+	}
+}
+
+func WithPriceBump(percent uint64) ServerOption {
+	return func(opts *ServerOpts) {
+		opts.priceBump = percent
+	}
+}
+
+func WithChainID(chainID uint32) ServerOption {
+	return func(opts *ServerOpts) {
+		opts.chainID = chainID
+	}
+}
+
+func WithTxLifetime(lifetime time.Duration) ServerOption {
+	return func(opts *ServerOpts) {
+		opts.txLifetime = lifetime
+	}
+}
+
+func WithJournalPath(path string) ServerOption {
+	return func(opts *ServerOpts) {
+		opts.journalPath = path
+	}
+}
+
+// WithTxRateLimit 设置每个节点每秒可以发送的交易消息数量和突发上限
+func WithTxRateLimit(rate float64, burst int) ServerOption {
+	return func(opts *ServerOpts) {
+		opts.txRate = rate
+		opts.txBurst = burst
+	}
+}
+
+// WithBlockRateLimit 设置每个节点每秒可以发送的区块消息数量和突发上限
+func WithBlockRateLimit(rate float64, burst int) ServerOption {
+	return func(opts *ServerOpts) {
+		opts.blockRate = rate
+		opts.blockBurst = burst
+	}
+}
+
+// WithInvRateLimit 设置每个节点每秒可以发送的通告和数据请求消息数量和突发上限
+func WithInvRateLimit(rate float64, burst int) ServerOption {
+	return func(opts *ServerOpts) {
+		opts.invRate = rate
+		opts.invBurst = burst
+	}
+}
+
+// WithAddrBookPath 设置地址簿文件的路径 节点重启后可以直接连接上次运行时知道的节点
+func WithAddrBookPath(path string) ServerOption {
+	return func(opts *ServerOpts) {
+		opts.addrBookPath = path
+	}
+}
+
+// WithBanDuration 设置评分过低的节点被禁止连接的时长
+func WithBanDuration(d time.Duration) ServerOption {
+	return func(opts *ServerOpts) {
+		opts.banDuration = d
+	}
+}
+
+// WithNodeKeyPath 设置节点密钥文件的路径 节点ID由密钥的公钥得到 文件不存在时生成新的密钥
+// 使用自己创建的TCP传输层时节点密钥以传输层的为准
+func WithNodeKeyPath(path string) ServerOption {
+	return func(opts *ServerOpts) {
+		opts.nodeKeyPath = path
+	}
+}
+
+// WithOutboundPeers 设置主动连接数量的下限和上限
+// 主动连接少于min时从地址簿中选择新的节点连接 断开的节点在不超过max时重连
+func WithOutboundPeers(min int, max int) ServerOption {
+	return func(opts *ServerOpts) {
+		opts.minOutbound = min
+		opts.maxOutbound = max
+	}
+}
+
+// WithMaxInboundPeers 设置最多接受的被动连接数量
+func WithMaxInboundPeers(n int) ServerOption {
+	return func(opts *ServerOpts) {
+		opts.maxInbound = n
+	}
+}
+
+func WithAccountSlots(slots int) ServerOption {
+	return func(opts *ServerOpts) {
+		opts.accountSlots = slots
+	}
+}
+
+// WithMaxBlockBytes 设置出块时区块的最大字节数
+func WithMaxBlockBytes(size int) ServerOption {
+	return func(opts *ServerOpts) {
+		opts.maxBlockBytes = size
+	}
+}
+
+// WithClock 使用指定的时钟计时 模拟网络中使用虚拟时钟
+func WithClock(clock Clock) ServerOption {
+	return func(opts *ServerOpts) {
+		opts.clock = clock
+	}
+}
+
+// WithBlockTime 设置出块间隔
+func WithBlockTime(d time.Duration) ServerOption {
+	return func(opts *ServerOpts) {
+		opts.blockTime = d
+	}
+}
+
+// WithMining 设置节点是否参与出块 默认参与
+func WithMining(enable bool) ServerOption {
+	return func(opts *ServerOpts) {
+		opts.disableMining = !enable
+	}
+}
+
+// WithMaxBlockGas 设置出块时区块的最大执行额度
+func WithMaxBlockGas(gas uint64) ServerOption {
+	return func(opts *ServerOpts) {
+		opts.maxBlockGas = gas
+	}
+}
+
 func NewServerOpts(options ...ServerOption) *ServerOpts {
 	opts := &ServerOpts{}
 	for _, option := range options {
@@ -90,12 +330,12 @@ func NewServerOpts(options ...ServerOption) *ServerOpts {
 
 // NewServer 只是做一个初始化配置的操作 不做启动
 func NewServer(opts ServerOpts) (s *Server, err error) {
-	if opts.id == "" {
-		opts.id = utils.RandID()
-	}
 	if opts.log == nil {
 		opts.log = log.New(os.Stdout, "", log.LstdFlags)
 	}
+	if opts.transport != nil {
+		opts.listenAddr = string(opts.transport.Addr())
+	}
 	if opts.listenAddr == "" {
 		opts.listenAddr = ":9977"
 	}
@@ -108,60 +348,270 @@ func NewServer(opts ServerOpts) (s *Server, err error) {
 	if opts.pendingPoolLimit == 0 {
 		opts.pendingPoolLimit = 4096
 	}
+	if opts.chainID == 0 {
+		opts.chainID = core.DefaultChainID
+	}
+	if opts.snapshotQuorum <= 0 {
+		opts.snapshotQuorum = defaultSnapshotQuorum
+	}
+	if opts.clock == nil {
+		opts.clock = realClock{}
+	}
+	if opts.blockTime == 0 {
+		opts.blockTime = defaultBlockTime
+	}
 	// 使用传递的私钥或者生成新私钥
 	priv, err := cryptoo.UseOrGenPrivateKey(opts.privKey)
 	if err != nil {
 		return nil, err
 	}
 
-	tcpT, err := NewTCPTransport(opts.listenAddr)
-	if err != nil {
+	// 节点ID由节点公钥得到 加密连接握手时对方可以验证
+	var identity *NodeIdentity
+	if t, ok := opts.transport.(interface{ Identity() *NodeIdentity }); ok {
+		identity = t.Identity()
+	} else if identity, err = LoadNodeIdentity(opts.nodeKeyPath); err != nil {
 		return nil, err
 	}
+	opts.id = identity.ID()
+
+	transport := opts.transport
+	if transport == nil {
+		if transport, err = NewTCPTransport(opts.listenAddr, identity, WithTCPLogger(opts.log)); err != nil {
+			return nil, err
+		}
+	}
+
+	chainOpts := []core.BlockchainOption{
+		core.WithPruneConfig(opts.pruneConfig),
+		core.WithChainID(opts.chainID),
+	}
+	if opts.snapshotInterval != 0 {
+		chainOpts = append(chainOpts, core.WithSnapshotInterval(opts.snapshotInterval))
+	}
+	chain := core.NewBlockchain(chainOpts...)
+	chain.AddBlockWithoutValidation(core.NewGenesisBlock())
+
+	// 交易池通过链上最新的账户状态判断交易的nonce
+	poolOpts := []core.TxPoolOption{
+		core.WithPoolChainID(opts.chainID),
+		core.WithStateProvider(func() core.StateReader {
+			return chain.GetAccountState()
+		}),
+		core.WithHeightProvider(chain.Height),
+		core.WithTxIndex(chain.HasTransaction),
+		core.WithPoolClock(opts.clock.Now),
+	}
+	if opts.txLifetime != 0 {
+		poolOpts = append(poolOpts, core.WithTxLifetime(opts.txLifetime))
+	}
+	if opts.priceBump != 0 {
+		poolOpts = append(poolOpts, core.WithPriceBump(opts.priceBump))
+	}
+	if opts.accountSlots != 0 {
+		poolOpts = append(poolOpts, core.WithAccountSlots(opts.accountSlots))
+	}
+	pool := core.NewTxPool(int(opts.allPoolLimit), int(opts.pendingPoolLimit), poolOpts...)
+
+	var builderOpts []core.BlockBuilderOption
+	if opts.maxBlockBytes != 0 {
+		builderOpts = append(builderOpts, core.WithMaxBlockBytes(opts.maxBlockBytes))
+	}
+	if opts.maxBlockGas != 0 {
+		builderOpts = append(builderOpts, core.WithMaxBlockGas(opts.maxBlockGas))
+	}
+	builder := core.NewBlockBuilder(chain, pool, builderOpts...)
+
+	var journal *core.TxJournal
+	if opts.journalPath != "" {
+		journal = core.NewTxJournal(opts.journalPath)
+	}
 
 	return &Server{
-		opts:         opts,
-		mu:           sync.RWMutex{},
-		rpcCh:        make(chan RPC),
-		quitCh:       make(chan struct{}),
-		peerMap:      make(map[net.Addr]*TCPPeer),
-		chain:        core.NewBlockchain(),
-		tcpTransport: tcpT,
-		priv:         priv,
-		pool:         core.NewTxPool(int(opts.allPoolLimit), int(opts.pendingPoolLimit)),
+		opts:          opts,
+		mu:            sync.RWMutex{},
+		rpcCh:         make(chan RPC),
+		quitCh:        make(chan struct{}),
+		peerMap:       make(map[net.Addr]Peer),
+		chain:         chain,
+		transport:     transport,
+		priv:          priv,
+		pool:          pool,
+		snapSync:      newSnapshotSync(),
+		journal:       journal,
+		limiter:       newRateLimiter(opts),
+		scores:        newPeerScores(opts.banDuration),
+		addrBook:      NewAddrBook(opts.addrBookPath),
+		dht:           NewRoutingTable(opts.id),
+		peerInfo:      make(map[string]*peerInfo),
+		connMgr:       newConnManager(opts),
+		builder:       builder,
+		seenTxs:       newHashCache(defaultSeenTxsCapacity),
+		inventory:     newPeerInventory(),
+		compactBlocks: newCompactBlocks(),
+		headerSync:    newHeaderSync(),
+		requests:      newRequestManager(),
 	}, nil
 }
 
 // Start 启动服务器
 func (s *Server) Start() error {
-	// 启动TCP传输层
-	if err := s.tcpTransport.Start(); err != nil {
-		return fmt.Errorf("启动TCP传输层失败: %v", err)
+	// 启动传输层
+	if err := s.transport.Start(); err != nil {
+		return fmt.Errorf("启动传输层失败: %v", err)
 	}
 
 	// 启动接受循环
-	go s.acceptLoop()
+	s.spawn(s.acceptLoop)
 
-	// 连接种子节点
+	// 加载上次运行时保存的地址簿
+	if err := s.addrBook.Load(); err != nil {
+		s.logf("加载地址簿失败: %v", err)
+	}
+
+	// 连接种子节点和地址簿中的节点 之后由connectLoop维持连接数量
 	for _, addr := range s.opts.seedNodes {
-		if err := s.connectToNode(addr); err != nil {
-			s.logf("连接种子节点 %s 失败: %v", addr, err)
-		}
+		s.addrBook.Add(addr, "")
 	}
+	s.maintainPeers()
+	s.spawn(s.connectLoop)
+	s.spawn(s.dhtLoop)
+	s.spawn(s.pingLoop)
 
 	s.opts.log.Printf("服务器已在 %s 启动", s.opts.listenAddr)
 
+	// 从日志中恢复上次运行时提交的本地交易 并重新广播
+	s.loadJournal()
+
 	// 启动每隔一段时间挖出区块并打包交易的逻辑
-	go s.mineLoop()
+	if !s.opts.disableMining {
+		s.spawn(s.mineLoop)
+	}
 
 	// 启动同步块协程
-	go s.syncBlocksLoop()
+	s.spawn(s.syncBlocksLoop)
+
+	s.spawn(s.syncMorePeers)
 
-	go s.syncMorePeers()
+	// 启动定期清理过期交易的协程
+	s.spawn(s.sweepPoolLoop)
+
+	if s.journal != nil {
+		s.spawn(s.journalLoop)
+	}
 
 	return nil
 }
 
+// Stop 停止服务器 关闭监听和所有连接 等待所有协程退出后保存本地交易日志和地址簿
+// ctx结束时还有协程在处理消息 此时直接返回ctx的错误 日志和地址簿在这些协程退出后由后台保存
+func (s *Server) Stop(ctx context.Context) error {
+	s.stopMu.Lock()
+	if s.stopping {
+		s.stopMu.Unlock()
+		return ErrServerStopped
+	}
+	s.stopping = true
+	close(s.quitCh)
+	s.stopMu.Unlock()
+
+	if err := s.transport.Close(); err != nil {
+		s.logf("关闭传输层失败: %v", err)
+	}
+	// 关闭连接后ReceiveLoop返回 handlePeer随之退出
+	s.mu.RLock()
+	for _, peer := range s.peerMap {
+		peer.Close()
+	}
+	s.mu.RUnlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		// 处理器还可能写入交易池和地址簿 这时保存会丢失之后的修改
+		s.logf("等待协程退出超时: %v", ctx.Err())
+		go func() {
+			<-done
+			if err := s.flush(); err != nil {
+				s.logf("保存交易日志和地址簿失败: %v", err)
+			}
+		}()
+		return ctx.Err()
+	}
+
+	err := s.flush()
+	s.opts.log.Printf("服务器 %s 已停止", s.opts.listenAddr)
+	return err
+}
+
+// flush 重写本地交易日志并保存地址簿 只在所有协程退出后调用
+func (s *Server) flush() error {
+	var err error
+	if s.journal != nil {
+		if rerr := s.journal.Rotate(s.pool.Locals()); rerr != nil {
+			s.logf("重写交易日志失败: %v", rerr)
+		}
+		err = s.journal.Close()
+	}
+	if serr := s.addrBook.Save(); serr != nil && err == nil {
+		err = serr
+	}
+	return err
+}
+
+// spawn 在新的协程中执行f Stop会等待这些协程全部退出 停止后不再启动新的协程
+func (s *Server) spawn(f func()) {
+	s.stopMu.Lock()
+	if s.stopping {
+		s.stopMu.Unlock()
+		return
+	}
+	s.wg.Add(1)
+	s.stopMu.Unlock()
+
+	go func() {
+		defer s.wg.Done()
+		f()
+	}()
+}
+
+// stopped 服务器是否已经开始停止
+func (s *Server) stopped() bool {
+	select {
+	case <-s.quitCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// Chain 返回节点的区块链
+func (s *Server) Chain() *core.Blockchain {
+	return s.chain
+}
+
+// RoutingTable 返回节点的Kademlia路由表
+func (s *Server) RoutingTable() *RoutingTable {
+	return s.dht
+}
+
+// Pool 返回节点的交易池
+func (s *Server) Pool() *core.TxPool {
+	return s.pool
+}
+
+// PeerCount 返回当前连接的节点数量
+func (s *Server) PeerCount() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.peerMap)
+}
+
 // logf 封装打印server日志的函数
 func (s *Server) logf(format string, v ...interface{}) {
 	if s.opts.log != nil {
@@ -171,30 +621,79 @@ func (s *Server) logf(format string, v ...interface{}) {
 
 // connectToNode 连接到指定地址的节点
 func (s *Server) connectToNode(addr string) error {
-	conn, err := net.Dial("tcp", addr)
+	if s.IsBanned(addr) {
+		return ErrPeerBanned
+	}
+	peer, err := s.transport.Dial(addr)
 	if err != nil {
+		s.addrBook.Attempt(addr, s.opts.clock.Now())
+		s.dht.RemoveAddr(addr)
 		return err
 	}
+	s.addrBook.Good(addr, s.opts.clock.Now())
+	if err := s.addPeer(peer, addr); err != nil {
+		return err
+	}
+	// 向新连接的节点请求它知道的地址 并查询离本节点最近的节点
+	s.requestPeers(peer.RemoteAddr())
+	s.spawn(func() {
+		if _, err := s.requestNodes(peer.RemoteAddr(), NodeKey(s.opts.id)); err != nil {
+			s.logf("向 %s 查询节点失败: %v", peer.RemoteAddr(), err)
+		}
+	})
+	return nil
+}
 
-	peer := NewTCPPeer(conn, true)
-	s.mu.Lock()
-	s.peerMap[conn.RemoteAddr()] = peer
-	s.mu.Unlock()
-
-	go s.handlePeer(peer)
+// addPeer 登记新的连接并开始接收消息 服务器已经停止 节点被禁止连接或者连接数量已满时关闭连接
+// listenAddr为主动连接时使用的地址 被动连接时为空
+func (s *Server) addPeer(peer Peer, listenAddr string) error {
+	if s.IsBanned(peer.RemoteAddr().String()) {
+		s.logf("拒绝被禁止的节点 %s 的连接", peer.RemoteAddr())
+		peer.Close()
+		return ErrPeerBanned
+	}
 
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Stop在关闭quitCh之后才关闭登记过的连接 这里检查过的连接不会被遗漏
+	if s.stopped() {
+		peer.Close()
+		return ErrServerStopped
+	}
+	outbound := listenAddr != ""
+	key := peer.RemoteAddr().String()
+	// 本地传输层的连接使用节点地址作为远端地址 双方同时连接对方时两个连接的远端地址相同
+	// 双方都保留由地址较小的节点发起的连接
+	if existing, ok := s.peerInfo[key]; ok {
+		if existing.outbound == outbound || outbound != (string(s.transport.Addr()) < key) {
+			peer.Close()
+			return ErrDuplicatePeer
+		}
+		existing.duplicate = true
+		existing.peer.Close()
+	}
+	outCount, inCount := s.peerCountsLocked()
+	if (outbound && outCount >= s.connMgr.maxOutbound) || (!outbound && inCount >= s.connMgr.maxInbound) {
+		s.logf("连接数量已达上限, 关闭与 %s 的连接", peer.RemoteAddr())
+		peer.Close()
+		return ErrTooManyPeers
+	}
+	s.peerMap[peer.RemoteAddr()] = peer
+	s.peerInfo[key] = &peerInfo{
+		peer:       peer,
+		outbound:   outbound,
+		listenAddr: listenAddr,
+		connected:  s.opts.clock.Now(),
+	}
+	s.spawn(func() { s.handlePeer(peer) })
 	return nil
 }
 
 func (s *Server) acceptLoop() {
 	for {
 		select {
-		case peer := <-s.tcpTransport.peerCh:
-			s.mu.Lock()
-			s.peerMap[peer.conn.RemoteAddr()] = peer
-			s.mu.Unlock()
-
-			go s.handlePeer(peer)
+		case peer := <-s.transport.Accept():
+			s.addPeer(peer, "")
 		case rpc := <-s.rpcCh:
 			// 处理接收到的RPC请求
 			s.handleRPCRequest(rpc)
@@ -204,13 +703,31 @@ func (s *Server) acceptLoop() {
 	}
 }
 
-func (s *Server) handlePeer(peer *TCPPeer) {
+func (s *Server) handlePeer(peer Peer) {
 	defer func() {
 		s.mu.Lock()
-		delete(s.peerMap, peer.conn.RemoteAddr())
+		// 远端地址相同的新连接已经替换了这个连接时不删除新连接的记录
+		info, ok := s.peerInfo[peer.RemoteAddr().String()]
+		if ok && info.peer == peer {
+			delete(s.peerMap, peer.RemoteAddr())
+			delete(s.peerInfo, peer.RemoteAddr().String())
+		} else {
+			info = nil
+		}
 		s.mu.Unlock()
+		// 主动连接断开后由connectLoop按退避时间重连
+		if info != nil && info.outbound && !info.duplicate {
+			now := s.opts.clock.Now()
+			s.connMgr.dropped(info.listenAddr, now.Sub(info.connected), now)
+		}
+		s.limiter.remove(NetAddr(peer.RemoteAddr().String()))
+		s.scores.remove(NetAddr(peer.RemoteAddr().String()))
+		s.inventory.remove(peer.RemoteAddr())
 	}()
 
+	s.sendHello(peer)
+	// 立即测量一次RTT 同步时可以马上使用
+	s.sendPing(peer.RemoteAddr())
 	peer.ReceiveLoop(s.rpcCh)
 }
 
@@ -219,27 +736,78 @@ func (s *Server) handleRPCRequest(rpc RPC) {
 
 	// 解码RPC请求
 	var req Message
-	if err := gob.NewDecoder(rpc.Payload).Decode(&req); err != nil {
+	if err := DecodeExact(rpc.Payload, &req); err != nil {
 		s.logf("解码RPC请求失败: %v", err)
+		s.misbehave(rpc.From, misbehaviorBadMessage)
 		return
 	}
 
-	// 根据请求类型处理
+	// 带有编号的响应交给等待这个响应的请求
+	if req.ID != 0 && s.requests.deliver(rpc.From, &req) {
+		return
+	}
+
+	// 超过限速的交易 区块和通告消息直接丢弃
+	if !s.limiter.allow(rpc.From, req.Type, s.opts.clock.Now()) {
+		s.logf("来自 %s 的消息超过限速, 丢弃类型为 %v 的消息", rpc.From, req.Type)
+		s.misbehave(rpc.From, misbehaviorSpam)
+		return
+	}
+
+	// 每条消息在单独的协程中处理 不阻塞接收循环
+	s.spawn(func() { s.handleMessage(rpc.From, &req) })
+}
+
+// handleMessage 根据消息类型处理消息
+func (s *Server) handleMessage(from NetAddr, req *Message) {
 	switch req.Type {
 	case MessageTypeTx:
-		go s.handleTxMessage(rpc.From, req.Body)
+		s.handleTxMessage(from, req.Body)
 	case MessageTypeBlock:
-		go s.handleBlockMessage(rpc.From, req.Body)
+		s.handleBlockMessage(from, req.Body)
 	case MessageTypeGetBlocks:
-		go s.handleGetBlocksMessage(rpc.From, req.Body)
+		s.handleGetBlocksMessage(from, req.ID, req.Body)
 	case MessageTypeStatus:
-		go s.handleStatusMessage(rpc.From, req.Body)
+		s.handleStatusMessage(from, req.Body)
 	case MessageTypeGetStatus:
-		go s.handleGetStatusMessage(rpc.From)
+		s.handleGetStatusMessage(from, req.ID)
 	case MessageTypeBlocks:
-		go s.handleBlocksMessage(rpc.From, req.Body)
+		s.handleBlocksMessage(from, req.Body)
+	case MessageTypeInv:
+		s.handleInvMessage(from, req.Body)
+	case MessageTypeGetData:
+		s.handleGetDataMessage(from, req.ID, req.Body)
+	case MessageTypeGetHeaders:
+		s.handleGetHeadersMessage(from, req.ID, req.Body)
+	case MessageTypeHeaders:
+		s.handleHeadersMessage(from, req.Body)
+	case MessageTypeGetSnapshot:
+		s.handleGetSnapshotMessage(from, req.ID, req.Body)
+	case MessageTypeSnapshot:
+		s.handleSnapshotMessage(from, req.Body)
+	case MessageTypeHello:
+		s.handleHelloMessage(from, req.Body)
+	case MessageTypeGetPeers:
+		s.handleGetPeersMessage(from)
+	case MessageTypePeers:
+		s.handlePeersMessage(from, req.Body)
+	case MessageTypeFindNode:
+		s.handleFindNodeMessage(from, req.ID, req.Body)
+	case MessageTypeNodes:
+		s.handleNodesMessage(from)
+	case MessageTypePing:
+		s.handlePingMessage(from, req.Body)
+	case MessageTypePong:
+		s.handlePongMessage(from, req.Body)
+	case MessageTypeCompactBlock:
+		s.handleCompactBlockMessage(from, req.Body)
+	case MessageTypeGetBlockTxn:
+		s.handleGetBlockTxnMessage(from, req.Body)
+	case MessageTypeBlockTxn:
+		s.handleBlockTxnMessage(from, req.Body)
 	default:
 		s.logf("未知的RPC请求类型: %v", req.Type)
+		s.misbehave(from, misbehaviorProtocol)
 	}
 }
 
@@ -247,56 +815,96 @@ func (s *Server) handleTxMessage(from net.Addr, body []byte) {
 	s.logf("处理来自 %s 的交易消息", from)
 	tx := new(core.Transaction)
 	b := bytes.NewBuffer(body)
-	if err := tx.Decode(b); err != nil {
+	if err := DecodeExact(b, tx); err != nil {
 		s.logf("解析交易消息失败: %v", err)
+		s.misbehave(from, misbehaviorBadMessage)
+		return
+	}
+	// 最近处理过或者已经上链的交易直接丢弃 不再加入池子和广播
+	// 交易哈希不包含签名 只有成功加入池子的交易才记为已处理 否则签名错误的副本先到达会挡住真正的交易
+	hash := tx.CalHash()
+	s.inventory.markKnown(from, hash)
+	if s.seenTxs.Contains(hash) {
+		return
+	}
+	if s.chain.HasTransaction(hash) {
 		return
 	}
-	// TODO: 处理交易逻辑
 	// 加入到池子里 然后广播这个交易
 	if err := s.pool.Add([]*core.Transaction{tx}); err != nil {
+		if core.IsInvalidTxErr(err) {
+			s.logf("来自 %s 的交易无效: %v", from, err)
+			if errors.Is(err, core.ErrInvalidSignature) {
+				s.misbehave(from, misbehaviorBadSignature)
+			} else {
+				s.misbehave(from, misbehaviorInvalidTx)
+			}
+			return
+		}
 		s.logf("加入交易到池子失败: %v", err)
 		return
 	}
-	// 广播交易
-	go s.broadcastTx(tx)
+	s.seenTxs.Add(hash)
+	// 广播交易 替换了旧交易时也会广播 让其他节点同样完成替换
+	s.spawn(func() { s.broadcastTx(tx, from) })
 }
 
 func (s *Server) handleBlockMessage(from net.Addr, body []byte) {
 	s.logf("处理来自 %s 的区块消息", from)
 	block := new(core.Block)
 	b := bytes.NewBuffer(body)
-	if err := block.Decode(b); err != nil {
+	if err := DecodeExact(b, block); err != nil {
 		s.logf("解析区块消息失败: %v", err)
+		s.misbehave(from, misbehaviorBadMessage)
+		return
+	}
+	s.inventory.markKnown(from, block.Hash())
+	// 区块本身无效说明对方在作恶 无法接到链上的区块可能只是乱序到达
+	if !block.Verify() {
+		s.logf("来自 %s 的区块无效", from)
+		s.misbehave(from, misbehaviorInvalidBlock)
 		return
 	}
-	// TODO: 处理区块逻辑
-	// 传递过来一个区块
+	s.processBlock(from, block)
+}
+
+// processBlock 把验证过的区块添加到链上 成功后更新交易池并广播
+func (s *Server) processBlock(from net.Addr, block *core.Block) {
 	// 校验并添加
 	if err := s.chain.AddBlock(block); err != nil {
 		s.logf("添加区块失败: %v", err)
 		return
 	}
 
-	// 从交易池中移除已确认的交易
-	s.pool.RemovePendingTxs(block.Transactions)
+	// 从交易池中移除已确认的交易 并按最新状态重新校验剩余的交易
+	s.resetPool()
 
 	// 广播新区块给其他节点
-	go s.broadcastBlock(block)
+	s.spawn(func() { s.broadcastBlock(block, from) })
 }
 
-func (s *Server) handleGetBlocksMessage(from net.Addr, body []byte) {
+func (s *Server) handleGetBlocksMessage(from net.Addr, id uint64, body []byte) {
 	s.logf("处理来自 %s 的获取区块消息", from)
 	getBs := new(GetBlocksMessage)
 	b := bytes.NewBuffer(body)
-	if err := getBs.Decode(b); err != nil {
+	if err := DecodeExact(b, getBs); err != nil {
 		s.logf("解析获取区块消息失败: %v", err)
+		s.misbehave(from, misbehaviorBadMessage)
 		return
 	}
-	// TODO: 处理获取区块逻辑
-	blocks := s.chain.GetRangeBlocks(getBs.From, getBs.To)
+	// 一条消息最多携带maxBlocksPerMessage个区块 超出的部分对方需要再次请求
+	if getBs.To >= getBs.From && getBs.To-getBs.From >= maxBlocksPerMessage {
+		getBs.To = getBs.From + maxBlocksPerMessage - 1
+	}
+	blocks, err := s.chain.GetRangeBlocks(getBs.From, getBs.To)
+	if err != nil {
+		s.logf("获取区块 [%d, %d] 失败: %v", getBs.From, getBs.To, err)
+	}
 	Bs := new(BlocksMessage)
 	Bs.Blocks = blocks
-	data, err := EncodeMessage(MessageTypeBlocks, Bs)
+	// 告诉对方本节点能提供的区块范围 区块被裁剪时对方可以换一个节点或者使用快照同步
+	Bs.Lowest, Bs.Highest = s.chain.ServableRange()
+	data, err := EncodeMessageWithID(MessageTypeBlocks, id, Bs)
 	if err != nil {
 		s.logf("编码区块消息失败: %v", err)
 		return
@@ -308,35 +916,41 @@ func (s *Server) handleStatusMessage(from net.Addr, body []byte) {
 	s.logf("处理来自 %s 的状态消息", from)
 	status := new(StatusMessage)
 	b := bytes.NewBuffer(body)
-	if err := status.Decode(b); err != nil {
+	if err := DecodeExact(b, status); err != nil {
 		s.logf("解析状态消息失败: %v", err)
+		s.misbehave(from, misbehaviorBadMessage)
 		return
 	}
 	// TODO: 处理状态消息逻辑
 	// 判断这个区块是不是领先自己
 	// todo 还需要判断版本号
-	if status.CurrentHeight > s.chain.Height() {
-		// 发送获取区块消息
-		getBs := new(GetBlocksMessage)
-		getBs.From = s.chain.Height() + 1
-		getBs.To = status.CurrentHeight
-		data, err := EncodeMessage(MessageTypeGetBlocks, getBs)
-		if err != nil {
-			s.logf("编码获取区块消息失败: %v", err)
+	// 新节点开启了快速同步时 先下载对方的状态快照
+	if s.opts.fastSync && s.chain.Height() == 0 && status.CurrentHeight > 0 {
+		if s.startSnapshotSync(from, status.CurrentHeight) {
 			return
 		}
-		s.send(from, data)
+	}
+	// 对方已经裁剪了我们需要的区块
+	if status.LowestHeight > s.chain.Height()+1 {
+		s.logf("节点 %s 只能提供从 %d 开始的区块, 当前高度 %d", from, status.LowestHeight, s.chain.Height())
+		return
+	}
+	if status.CurrentHeight > s.chain.Height() {
+		// 先获取区块头 选出最长链后再下载区块
+		s.requestHeaders(from, status.CurrentHeight)
 	}
 }
 
-func (s *Server) handleGetStatusMessage(from net.Addr) {
+func (s *Server) handleGetStatusMessage(from net.Addr, id uint64) {
 	s.logf("处理来自 %s 的获取状态消息", from)
 	// 将状态发送回去
+	lowest, _ := s.chain.ServableRange()
 	sm := &StatusMessage{
 		ID:            s.opts.id,
 		CurrentHeight: s.chain.Height(),
+		LowestHeight:  lowest,
 	}
-	data, err := EncodeMessage(MessageTypeStatus, sm)
+	data, err := EncodeMessageWithID(MessageTypeStatus, id, sm)
 	if err != nil {
 		s.logf("编码状态消息失败: %v", err)
 		return
@@ -348,15 +962,31 @@ func (s *Server) handleBlocksMessage(from net.Addr, body []byte) {
 	s.logf("处理来自 %s 的区块列表消息", from)
 	bm := new(BlocksMessage)
 	b := bytes.NewBuffer(body)
-	if err := bm.Decode(b); err != nil {
+	if err := DecodeExact(b, bm); err != nil {
 		s.logf("解析区块列表消息失败: %v", err)
+		s.misbehave(from, misbehaviorBadMessage)
 		return
 	}
-	// TODO: 处理区块列表逻辑
-	if len(bm.Blocks) == 0  || bm.FirstBlock().Height() > s.chain.Height() + 1 ||
-	bm.LastBlock().Height() <= s.chain.Height() {
+	// 区块头同步过程中的区块由同步流程请求和处理
+	if s.isSyncing() {
+		return
+	}
+	if len(bm.Blocks) == 0 && bm.Lowest > s.chain.Height()+1 {
+		s.logf("节点 %s 已裁剪所需区块, 可提供范围 [%d, %d]", from, bm.Lowest, bm.Highest)
+		return
+	}
+	if len(bm.Blocks) == 0 || bm.FirstBlock().Height() > s.chain.Height()+1 ||
+		bm.LastBlock().Height() <= s.chain.Height() {
 		s.logf("区块列表消息无效")
-		return 
+		return
+	}
+	// 在回滚本地区块之前检查每个区块本身是否有效
+	for _, block := range bm.Blocks {
+		if !block.Verify() {
+			s.logf("来自 %s 的区块 %d 无效", from, block.Height())
+			s.misbehave(from, misbehaviorInvalidBlock)
+			return
+		}
 	}
 	// 同步区块时考虑一种情况 那就是如果遇到更长的链 但是交集的有一部分是不同的 应该从最近的共同区块开始同步
 	// 找到最近的共同区块
@@ -378,63 +1008,66 @@ func (s *Server) handleBlocksMessage(from net.Addr, body []byte) {
 		block := bm.Blocks[i]
 		if err := s.chain.AddBlock(block); err != nil {
 			s.logf("添加区块失败: %v", err)
-			return
+			break
 		}
 	}
 	s.mu.Unlock()
 
-}
+	// 按最新状态重新校验交易池中的交易
+	s.resetPool()
 
-func (s *Server) broadcastTx(tx *core.Transaction) {
-	data, err := EncodeMessage(MessageTypeTx, tx)
-	if err != nil {
-		s.logf("编码交易失败: %v", err)
-		return
-	}
-	s.boardcast(data)
 }
 
-func (s *Server) boardcast(data []byte) {
-	for addr, peer := range s.peerMap {
-		s.logf("向 %s 广播消息", addr)
-		if err := peer.Send(data); err != nil {
-			s.logf("向 %s 发送消息失败: %v", addr, err)
+// disconnect 断开与指定节点的连接 连接关闭后handlePeer会清理节点信息
+func (s *Server) disconnect(addr net.Addr) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for peerAddr, peer := range s.peerMap {
+		if peerAddr.String() == addr.String() {
+			peer.Close()
+			return
 		}
 	}
 }
 
-func (s *Server) broadcastBlock(block *core.Block) {
-	data, err := EncodeMessage(MessageTypeBlock, block)
-	if err != nil {
-		s.logf("编码区块失败: %v", err)
-		return
-	}
-	s.boardcast(data)
-}
-
 func (s *Server) send(toAddr net.Addr, data []byte) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	peer, ok := s.peerMap[toAddr]
-	if !ok {
+	// 收到的消息中的地址是NetAddr 需要按地址字符串查找连接
+	// 发送可能阻塞 不能在持有锁时发送 否则Stop无法关闭连接
+	var target Peer
+	s.mu.RLock()
+	for addr, peer := range s.peerMap {
+		if addr.String() == toAddr.String() {
+			target = peer
+			break
+		}
+	}
+	s.mu.RUnlock()
+	if target == nil {
 		s.logf("未找到节点 %s", toAddr)
 		return nil
 	}
-	return peer.Send(data)
+	return target.Send(data)
 }
 
-func (s *Server) syncBlocksLoop() error {
-	ticker := time.NewTicker(30 * time.Second)
+func (s *Server) syncBlocksLoop() {
+	ticker := s.opts.clock.NewTicker(statusInterval)
 	defer ticker.Stop()
 
 	for {
 		select {
-		case <-ticker.C:
+		case <-ticker.C():
 			s.mu.RLock()
-			for addr, peer := range s.peerMap {
+			peers := make([]Peer, 0, len(s.peerMap))
+			for _, peer := range s.peerMap {
+				peers = append(peers, peer)
+			}
+			s.mu.RUnlock()
+
+			for _, peer := range peers {
+				addr := peer.RemoteAddr()
 				s.logf("向 %s 发送 GetStatus 消息", addr)
 
-				data, err := EncodeMessage(MessageTypeGetPeers, &GetStatusMessage{})
+				data, err := EncodeMessage(MessageTypeGetStatus, &GetStatusMessage{})
 				if err != nil {
 					s.logf("编码获取状态信息消息失败: %v", err)
 					continue
@@ -444,9 +1077,8 @@ func (s *Server) syncBlocksLoop() error {
 					continue
 				}
 			}
-			s.mu.RUnlock()
 		case <-s.quitCh:
-			return nil
+			return
 		}
 	}
 }
@@ -461,28 +1093,36 @@ func (s *Server) RollBlockRange(fromHeight uint32) {
 
 	rolledBackTxs := []*core.Transaction{}
 
-	removeBlocks := s.chain.GetRangeBlocks(fromHeight, s.chain.Height())
+	removeBlocks, err := s.chain.GetRangeBlocks(fromHeight, s.chain.Height())
+	if err != nil {
+		s.logf("获取需要回滚的区块失败: %v", err)
+		return
+	}
+
+	// 通过状态差异撤销这些区块对账户的改动 包括余额 手续费和nonce
+	if err := s.chain.RevertState(fromHeight); err != nil {
+		s.logf("回滚账户状态失败: %v", err)
+		return
+	}
 
 	for _, rmb := range lo.Reverse(removeBlocks) {
 		for _, tx := range rmb.Transactions {
-			err := s.chain.GetAccountState().Transfer(tx.To.Address(), tx.From.Address(), tx.Value)
-			// 回滚的时候应该不会有这个错误 但是这里还是检查一下
-			if err != nil {
-				s.logf("回滚交易失败: %v", err)
-				continue
-			}
 			// delete(bc.txStore, tx.CalHash())
 			s.chain.DeleteTxs([]*core.Transaction{tx})
 			rolledBackTxs = append(rolledBackTxs, tx)
 		}
-		// delete(bc.blockStore, rmb.GetDataHash())
-		s.chain.DeleteBlockStore(rmb.GetDataHash())
+		// delete(bc.blockStore, rmb.Hash())
+		s.chain.DeleteBlockStore(rmb.Hash())
 	}
 	// 从blocks中移除区块
 	s.chain.RemoveBlocks(fromHeight)
 
-	// 将回滚的交易重新放回池子里
-	
+	// 将回滚的交易重新放回池子里 账户nonce已经回退 需要先按最新状态整理池子
+	// 仍然保留在链上的交易不能放回池子
+	s.resetPool()
+	rolledBackTxs = lo.Filter(rolledBackTxs, func(tx *core.Transaction, _ int) bool {
+		return !s.chain.HasTransaction(tx.CalHash())
+	})
 	s.pool.Add(rolledBackTxs)
 
 
@@ -491,21 +1131,22 @@ func (s *Server) RollBlockRange(fromHeight uint32) {
 
 // mineLoop 每隔一定时间挖出一个区块，并打包交易，同步给其他节点
 func (s *Server) mineLoop() {
-	ticker := time.NewTicker(100 * time.Second) // 每100秒挖一个区块
+	ticker := s.opts.clock.NewTicker(s.opts.blockTime)
 	defer ticker.Stop()
 
 	for {
 		select {
-		case <-ticker.C:
-			// 从交易池中获取待打包的交易
-			txs := s.pool.GetPendingTxs()
-			if len(txs) == 0 {
+		case <-ticker.C():
+			// 从交易池中挑选能够成功执行并且不超过区块限制的交易
+			newBlock, err := s.builder.Build()
+			if err != nil {
+				s.logf("生成新区块失败: %v", err)
+				continue
+			}
+			if len(newBlock.Transactions) == 0 {
 				s.logf("当前没有待打包的交易，跳过本次挖矿")
 				continue
 			}
-			// 创建新区块
-			lastBlock := s.chain.GetLatestBlock()
-			newBlock := core.NewBlock(lastBlock.GetDataHash(), lastBlock.Height() + 1, txs)
 
 			// 将新区块添加到链上
 			if err := s.chain.AddBlock(newBlock); err != nil {
@@ -515,12 +1156,29 @@ func (s *Server) mineLoop() {
 
 			s.logf("成功挖出新区块，高度: %d, 包含 %d 笔交易", newBlock.Height(), len(newBlock.Transactions))
 
-			// 从交易池中移除已打包的交易
-			s.pool.ClearPending()
+			// 从交易池中移除已打包的交易 并按最新状态重新校验剩余的交易
+			s.resetPool()
 
 			// 广播新区块给其他节点
-			go s.broadcastBlock(newBlock)
+			s.spawn(func() { s.broadcastBlock(newBlock, nil) })
+
+		case <-s.quitCh:
+			return
+		}
+	}
+}
+
+// sweepPoolLoop 定期从交易池中删除过期的交易
+func (s *Server) sweepPoolLoop() {
+	ticker := s.opts.clock.NewTicker(time.Minute)
+	defer ticker.Stop()
 
+	for {
+		select {
+		case <-ticker.C():
+			if evicted := s.pool.EvictExpired(s.opts.clock.Now()); len(evicted) > 0 {
+				s.logf("从交易池中清理了 %d 笔过期交易", len(evicted))
+			}
 		case <-s.quitCh:
 			return
 		}
@@ -529,14 +1187,14 @@ func (s *Server) mineLoop() {
 
 // syncMorePeers 向现有的peers同步他们的连接信息，并建立新的连接
 func (s *Server) syncMorePeers() {
-	ticker := time.NewTicker(5 * time.Minute) // 每5分钟同步一次
+	ticker := s.opts.clock.NewTicker(5 * time.Minute) // 每5分钟同步一次
 	defer ticker.Stop()
 
 	for {
 		select {
-		case <-ticker.C:
+		case <-ticker.C():
 			s.mu.RLock()
-			peers := make([]*TCPPeer, 0, len(s.peerMap))
+			peers := make([]Peer, 0, len(s.peerMap))
 			for _, peer := range s.peerMap {
 				peers = append(peers, peer)
 			}
@@ -544,12 +1202,12 @@ func (s *Server) syncMorePeers() {
 
 			for _, peer := range peers {
 				// 向每个peer发送获取连接信息的请求
-				data, err := EncodeMessage(MessageTypeGetPeers, &GetPeersMessage{})
-				if err != nil {
-					s.logf("编码获取连接信息消息失败: %v", err)
-					continue
-				}
-				go s.send(peer.conn.RemoteAddr(), data)
+				s.spawn(func() { s.requestPeers(peer.RemoteAddr()) })
+			}
+
+			// 定期保存地址簿 进程意外退出时也不会全部丢失
+			if err := s.addrBook.Save(); err != nil {
+				s.logf("保存地址簿失败: %v", err)
 			}
 
 		case <-s.quitCh:
@@ -558,22 +1216,23 @@ func (s *Server) syncMorePeers() {
 	}
 }
 
+// requestPeers 向节点请求它知道的地址
+func (s *Server) requestPeers(to net.Addr) {
+	data, err := EncodeMessage(MessageTypeGetPeers, &GetPeersMessage{})
+	if err != nil {
+		s.logf("编码获取连接信息消息失败: %v", err)
+		return
+	}
+	s.send(to, data)
+}
 
-// handleGetPeersMessage 处理获取连接信息的请求
+// handleGetPeersMessage 处理获取连接信息的请求 返回地址簿中的监听地址
 func (s *Server) handleGetPeersMessage(from net.Addr) {
 	s.logf("处理来自 %s 的获取连接信息请求", from)
 
-	// 获取当前所有的peer连接信息
-	s.mu.RLock()
-	peers := make([]string, 0, len(s.peerMap))
-	for addr := range s.peerMap {
-		peers = append(peers, addr.String())
-	}
-	s.mu.RUnlock()
-
 	// 创建PeersMessage
 	peersMsg := &PeersMessage{
-		Peers: peers,
+		Peers: s.addrBook.Addresses(maxPeersPerMessage),
 	}
 
 	// 编码PeersMessage
@@ -587,38 +1246,169 @@ func (s *Server) handleGetPeersMessage(from net.Addr) {
 	s.send(from, data)
 }
 
-// handlePeersMessage 处理接收到的连接信息
+// handlePeersMessage 处理接收到的连接信息 新的地址加入地址簿并尝试连接
 func (s *Server) handlePeersMessage(from net.Addr, body []byte) {
 	s.logf("处理来自 %s 的连接信息", from)
 
 	peersMsg := new(PeersMessage)
 	b := bytes.NewBuffer(body)
-	if err := peersMsg.Decode(b); err != nil {
+	if err := DecodeExact(b, peersMsg); err != nil {
 		s.logf("解析连接信息消息失败: %v", err)
+		s.misbehave(from, misbehaviorBadMessage)
 		return
 	}
 
+	added := 0
 	for _, peerAddr := range peersMsg.Peers {
-		// 检查是否已经连接到该节点
-		s.mu.RLock()
-		_, exists := s.peerMap[NetAddr(peerAddr)]
-		if exists {
-			s.mu.RUnlock()
+		if s.isSelfAddr(peerAddr) {
 			continue
 		}
-		s.mu.RUnlock()
-
-		if !exists && peerAddr != s.opts.listenAddr {
-			// 尝试连接新的节点
-			go func(addr string) {
-				if err := s.connectToNode(addr); err != nil {
-					s.logf("连接到新节点 %s 失败: %v", addr, err)
-				} else {
-					s.logf("成功连接到新节点: %s", addr)
-				}
-			}(peerAddr)
+		if s.addrBook.Add(peerAddr, from.String()) {
+			added++
 		}
 	}
+	// 主动连接不足时连接新知道的节点
+	if added > 0 {
+		s.maintainPeers()
+	}
 }
 
+// sendHello 向新连接的节点宣布本节点的ID和监听地址
+func (s *Server) sendHello(peer Peer) {
+	data, err := EncodeMessage(MessageTypeHello, &HelloMessage{
+		ID:         s.opts.id,
+		ListenAddr: s.opts.listenAddr,
+	})
+	if err != nil {
+		s.logf("编码Hello消息失败: %v", err)
+		return
+	}
+	if err := peer.Send(data); err != nil {
+		s.logf("向 %s 发送Hello消息失败: %v", peer.RemoteAddr(), err)
+	}
+}
+
+// handleHelloMessage 记录节点的ID和被动连接的节点宣布的监听地址 主动连接时已经知道对方的地址
+// 确认在线的节点加入路由表 连接到自己或者与同一个节点重复连接时关闭多余的连接
+func (s *Server) handleHelloMessage(from net.Addr, body []byte) {
+	hello := new(HelloMessage)
+	if err := DecodeExact(bytes.NewBuffer(body), hello); err != nil {
+		s.logf("解析Hello消息失败: %v", err)
+		s.misbehave(from, misbehaviorBadMessage)
+		return
+	}
 
+	s.mu.Lock()
+	info, ok := s.peerInfo[from.String()]
+	if !ok || info.id != "" {
+		s.mu.Unlock()
+		return
+	}
+	// 加密连接在握手时已经验证了对方的节点ID Hello中的ID必须一致
+	if ap, ok := info.peer.(authenticatedPeer); ok && ap.RemoteID() != hello.ID {
+		s.mu.Unlock()
+		s.logf("%s 在Hello中宣布的节点ID与握手时不一致, 关闭连接", from)
+		info.peer.Close()
+		s.misbehave(from, misbehaviorProtocol)
+		return
+	}
+	if info.outbound {
+		s.connMgr.setID(info.listenAddr, hello.ID)
+	}
+	if hello.ID == s.opts.id {
+		info.duplicate = true
+		s.mu.Unlock()
+		s.logf("%s 是本节点自己, 关闭连接", from)
+		if info.outbound {
+			s.addrBook.Remove(info.listenAddr)
+		}
+		info.peer.Close()
+		return
+	}
+	info.id = hello.ID
+	if dup := s.duplicatePeerLocked(from.String(), info); dup != nil {
+		// 关闭的重复连接断开后不需要重连
+		dup.duplicate = true
+		s.logf("与节点 %s 重复连接, 关闭连接 %s", hello.ID, dup.peer.RemoteAddr())
+		dup.peer.Close()
+		if dup == info {
+			s.mu.Unlock()
+			return
+		}
+	}
+	outbound := info.outbound
+	if !outbound {
+		addr := resolveListenAddr(hello.ListenAddr, from)
+		if addr == "" || s.isSelfAddr(addr) {
+			s.mu.Unlock()
+			return
+		}
+		info.listenAddr = addr
+	}
+	addr := info.listenAddr
+	s.mu.Unlock()
+
+	// 主动连接时已经在connectToNode中记录过地址簿
+	now := s.opts.clock.Now()
+	if !outbound {
+		s.addrBook.Good(addr, now)
+	}
+	s.dht.Add(hello.ID, addr, now)
+}
+
+// duplicatePeerLocked 检查是否已经有连接到同一个节点的连接 返回需要关闭的连接
+// 双方同时连接对方时都保留由ID较小的节点发起的连接
+// 通过多个地址重复连接同一个节点时由发起连接的一方关闭新的连接 避免双方各自关闭不同的连接
+// 调用时需要持有s.mu
+func (s *Server) duplicatePeerLocked(remote string, info *peerInfo) *peerInfo {
+	for other, existing := range s.peerInfo {
+		if other == remote || existing.id != info.id || existing.duplicate {
+			continue
+		}
+		if info.outbound != existing.outbound {
+			if info.outbound == (s.opts.id < info.id) {
+				return existing
+			}
+			return info
+		}
+		if info.outbound {
+			return info
+		}
+	}
+	return nil
+}
+
+// isConnectedTo 是否已经与监听在addr上的节点建立了连接
+func (s *Server) isConnectedTo(addr string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for remote, info := range s.peerInfo {
+		if remote == addr || info.listenAddr == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// isSelfAddr 地址是否指向本节点 只监听端口时 本机回环地址上的相同端口也是本节点
+func (s *Server) isSelfAddr(addr string) bool {
+	if addr == s.opts.listenAddr {
+		return true
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	listenHost, listenPort, err := net.SplitHostPort(s.opts.listenAddr)
+	if err != nil || port != listenPort {
+		return false
+	}
+	if ip := net.ParseIP(listenHost); listenHost != "" && (ip == nil || !ip.IsUnspecified()) {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && (ip.IsLoopback() || ip.IsUnspecified())
+}
@@ -0,0 +1,234 @@
+package network
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// LinkConfig 描述两个节点之间链路的质量
+type LinkConfig struct {
+	// 消息的固定延迟
+	Latency time.Duration
+	// 每条消息额外增加[0, Jitter)的随机延迟 延迟不同的消息会乱序到达
+	Jitter time.Duration
+	// 消息的丢失概率
+	DropRate float64
+}
+
+type linkKey struct {
+	from NetAddr
+	to   NetAddr
+}
+
+// SimNetwork 模拟网络 所有消息都按虚拟时钟延迟投递
+// 可以为每条链路设置延迟 抖动和丢包率 也可以把节点划分到互不连通的分区中
+// 随机数使用固定的种子 相同的操作序列得到相同的丢包和延迟
+type SimNetwork struct {
+	mu          sync.Mutex
+	clock       *SimClock
+	rand        *rand.Rand
+	defaultLink LinkConfig
+	links       map[linkKey]LinkConfig
+	nodes       map[NetAddr]*SimTransport
+	// 每个节点所在的分区 为nil表示没有分区
+	groups map[NetAddr]int
+}
+
+func NewSimNetwork(clock *SimClock, seed int64, defaultLink LinkConfig) *SimNetwork {
+	return &SimNetwork{
+		clock:       clock,
+		rand:        rand.New(rand.NewSource(seed)),
+		defaultLink: defaultLink,
+		links:       make(map[linkKey]LinkConfig),
+		nodes:       make(map[NetAddr]*SimTransport),
+	}
+}
+
+func (n *SimNetwork) Clock() *SimClock {
+	return n.clock
+}
+
+// Transport 创建一个接入模拟网络的传输层
+func (n *SimNetwork) Transport(addr NetAddr) *SimTransport {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	t := &SimTransport{
+		network:  n,
+		addr:     addr,
+		acceptCh: make(chan Peer, localAcceptBacklog),
+		closed:   make(chan struct{}),
+	}
+	n.nodes[addr] = t
+	return t
+}
+
+// SetLink 设置两个节点之间双向链路的质量
+func (n *SimNetwork) SetLink(a NetAddr, b NetAddr, cfg LinkConfig) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.links[linkKey{a, b}] = cfg
+	n.links[linkKey{b, a}] = cfg
+}
+
+// SetDefaultLink 设置没有单独配置的链路的质量
+func (n *SimNetwork) SetDefaultLink(cfg LinkConfig) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.defaultLink = cfg
+}
+
+// Partition 把节点划分到互不连通的分区 没有列出的节点共同组成一个分区
+// 分区之间的消息全部丢失 也无法建立新的连接
+func (n *SimNetwork) Partition(groups ...[]NetAddr) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.groups = make(map[NetAddr]int)
+	for i, group := range groups {
+		for _, addr := range group {
+			n.groups[addr] = i + 1
+		}
+	}
+}
+
+// Heal 恢复所有节点之间的连通
+func (n *SimNetwork) Heal() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.groups = nil
+}
+
+// Run 让虚拟时间前进d 每前进step就让出一小段真实时间 使节点的协程有机会处理消息
+func (n *SimNetwork) Run(d time.Duration, step time.Duration) {
+	for elapsed := time.Duration(0); elapsed < d; elapsed += step {
+		n.clock.Advance(step)
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// reachableLocked 两个节点是否在同一个分区 调用时需要持有n.mu
+func (n *SimNetwork) reachableLocked(from NetAddr, to NetAddr) bool {
+	if n.groups == nil {
+		return true
+	}
+	return n.groups[from] == n.groups[to]
+}
+
+// send 按链路的配置决定消息是否丢失以及延迟多久投递 dst为接收方的连接
+func (n *SimNetwork) send(from NetAddr, to NetAddr, dst *LocalPeer, data []byte) {
+	n.mu.Lock()
+	if !n.reachableLocked(from, to) {
+		n.mu.Unlock()
+		return
+	}
+	cfg, ok := n.links[linkKey{from, to}]
+	if !ok {
+		cfg = n.defaultLink
+	}
+	if cfg.DropRate > 0 && n.rand.Float64() < cfg.DropRate {
+		n.mu.Unlock()
+		return
+	}
+	delay := cfg.Latency
+	if cfg.Jitter > 0 {
+		delay += time.Duration(n.rand.Int63n(int64(cfg.Jitter)))
+	}
+	n.mu.Unlock()
+
+	n.clock.AfterFunc(delay, func() {
+		// 消息在路上时发生了分区 同样丢失
+		n.mu.Lock()
+		reachable := n.reachableLocked(from, to)
+		n.mu.Unlock()
+		if !reachable {
+			return
+		}
+		// 接收方的缓存满了就丢弃 不能阻塞推进时钟的协程
+		select {
+		case dst.inbox <- data:
+		case <-dst.closed:
+		default:
+		}
+	})
+}
+
+// SimTransport 接入模拟网络的传输层 连接立即建立 消息按链路配置投递
+type SimTransport struct {
+	network  *SimNetwork
+	addr     NetAddr
+	started  bool
+	acceptCh chan Peer
+	// 关闭后不再接受新的连接
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+var _ Transport = new(SimTransport)
+var _ Peer = new(simPeer)
+
+func (t *SimTransport) Start() error {
+	t.network.mu.Lock()
+	defer t.network.mu.Unlock()
+	t.started = true
+	return nil
+}
+
+func (t *SimTransport) Dial(addr string) (Peer, error) {
+	n := t.network
+	n.mu.Lock()
+	remote, ok := n.nodes[NetAddr(addr)]
+	if !ok {
+		n.mu.Unlock()
+		return nil, fmt.Errorf("%w: %s", ErrTransportNotFound, addr)
+	}
+	if !remote.started || !n.reachableLocked(t.addr, remote.addr) {
+		n.mu.Unlock()
+		return nil, fmt.Errorf("无法连接节点 %s", addr)
+	}
+	n.mu.Unlock()
+
+	local, accepted := newLocalPeerPair(t.addr, remote.addr)
+	select {
+	case remote.acceptCh <- &simPeer{LocalPeer: accepted, network: n, local: remote.addr}:
+	case <-remote.closed:
+		return nil, fmt.Errorf("节点 %s 已经停止", addr)
+	}
+	return &simPeer{LocalPeer: local, network: n, local: t.addr}, nil
+}
+
+func (t *SimTransport) Accept() <-chan Peer {
+	return t.acceptCh
+}
+
+func (t *SimTransport) Addr() NetAddr {
+	return t.addr
+}
+
+// Close 停止接受新的连接 之后连接这个节点会失败
+func (t *SimTransport) Close() error {
+	t.network.mu.Lock()
+	defer t.network.mu.Unlock()
+	t.started = false
+	t.closeOnce.Do(func() {
+		close(t.closed)
+	})
+	return nil
+}
+
+// simPeer 模拟网络中的连接 发送的消息交给SimNetwork投递
+type simPeer struct {
+	*LocalPeer
+	network *SimNetwork
+	local   NetAddr
+}
+
+func (p *simPeer) Send(payload []byte) error {
+	select {
+	case <-p.closed:
+		return ErrPeerClosed
+	default:
+	}
+	p.network.send(p.local, p.remote, p.other, append([]byte(nil), payload...))
+	return nil
+}
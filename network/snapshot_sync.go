@@ -0,0 +1,278 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"go-chain/core"
+	"net"
+	"sync"
+)
+
+const (
+	// 每个快照分块包含的账户数量
+	snapshotChunkSize = 128
+	// 快照分块数量的上限 对方声明的分块数量超过上限时放弃快照同步
+	maxSnapshotChunks = 8192
+	// 默认至少需要多少个不同的节点对快照高度的区块头达成一致
+	defaultSnapshotQuorum = 2
+)
+
+var (
+	ErrSnapshotTooLarge  = errors.New("快照分块数量超过上限")
+	ErrSnapshotChunk     = errors.New("快照分块与快照信息不一致")
+	ErrSnapshotNoQuorum  = errors.New("没有足够多的节点确认快照的区块头")
+	ErrHeaderUnavailable = errors.New("节点没有返回请求的区块头")
+)
+
+// snapshotSync 记录快速同步的状态 同一时间只进行一次快照同步
+// 快照同步失败后不再尝试 之后都使用逐块同步 避免与已经开始的逐块同步互相干扰
+type snapshotSync struct {
+	mu     sync.Mutex
+	active bool
+	failed bool
+}
+
+func newSnapshotSync() *snapshotSync {
+	return &snapshotSync{}
+}
+
+// startSnapshotSync 开始从节点下载最新的快照 返回false时调用方应退回到逐块同步
+// 连接的不同节点数量不足以确认快照时不使用快照同步
+func (s *Server) startSnapshotSync(from net.Addr, targetHeight uint32) bool {
+	if s.isSyncing() || len(s.peerIDs()) < s.opts.snapshotQuorum {
+		return false
+	}
+	ss := s.snapSync
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.failed {
+		return false
+	}
+	if ss.active {
+		// 已经在同步快照了
+		return true
+	}
+	ss.active = true
+	s.logf("开始从 %s 快速同步快照, 对方高度 %d", from, targetHeight)
+	s.spawn(func() { s.runSnapshotSync(from, targetHeight) })
+	return true
+}
+
+// runSnapshotSync 下载 确认并应用快照 任何一步失败或者超时都退回到逐块同步
+func (s *Server) runSnapshotSync(from net.Addr, targetHeight uint32) {
+	snap, headers, anchor, err := s.downloadSnapshot(from)
+	if err == nil {
+		err = s.chain.ApplySnapshot(snap, headers, anchor)
+	}
+
+	ss := s.snapSync
+	ss.mu.Lock()
+	ss.active = false
+	ss.failed = err != nil
+	ss.mu.Unlock()
+
+	if err != nil {
+		if errors.Is(err, ErrServerStopped) {
+			return
+		}
+		s.logf("从 %s 快速同步快照失败: %v, 退回到逐块同步", from, err)
+		s.requestHeaders(from, targetHeight)
+		return
+	}
+	s.resetPool()
+	s.logf("快照同步完成, 高度 %d, 继续同步之后的区块", snap.Height)
+	if targetHeight > snap.Height {
+		s.requestHeaders(from, targetHeight)
+	}
+}
+
+// downloadSnapshot 从节点下载最新的快照 以及从高度1到快照高度的区块头
+// 快照高度的区块头需要得到足够多的不同节点确认 快照的状态根由这个区块头承诺
+// 每个请求都有超时时间 对方不响应时返回ErrRequestTimeout
+func (s *Server) downloadSnapshot(from net.Addr) (*core.StateSnapshot, []*core.BlockHeader, *core.Block, error) {
+	first := new(SnapshotMessage)
+	if err := s.Request(context.Background(), from, MessageTypeGetSnapshot, &GetSnapshotMessage{}, MessageTypeSnapshot, first); err != nil {
+		return nil, nil, nil, err
+	}
+	if first.Total == 0 {
+		return nil, nil, nil, core.ErrSnapshotNotFound
+	}
+	if first.Total > maxSnapshotChunks {
+		return nil, nil, nil, ErrSnapshotTooLarge
+	}
+	if first.Index != 0 || first.Height == 0 || first.Anchor == nil {
+		return nil, nil, nil, ErrSnapshotChunk
+	}
+
+	headers, err := s.downloadHeaders(from, first.Height)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if err := s.confirmSnapshotHeader(from, headers[len(headers)-1]); err != nil {
+		return nil, nil, nil, err
+	}
+
+	snap := &core.StateSnapshot{
+		Height:    first.Height,
+		BlockHash: first.BlockHash,
+		StateRoot: first.StateRoot,
+		Accounts:  first.Accounts,
+	}
+	for index := uint32(1); index < first.Total; index++ {
+		sm := new(SnapshotMessage)
+		err := s.Request(context.Background(), from, MessageTypeGetSnapshot, &GetSnapshotMessage{
+			Height: first.Height,
+			Index:  index,
+		}, MessageTypeSnapshot, sm)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if sm.Index != index || sm.Height != first.Height || sm.StateRoot != first.StateRoot || sm.Total != first.Total {
+			return nil, nil, nil, ErrSnapshotChunk
+		}
+		snap.Accounts = append(snap.Accounts, sm.Accounts...)
+	}
+	return snap, headers, first.Anchor, nil
+}
+
+// downloadHeaders 从节点下载[1, height]范围内的区块头 每个请求最多返回maxHeadersPerMessage个
+func (s *Server) downloadHeaders(from net.Addr, height uint32) ([]*core.BlockHeader, error) {
+	headers := make([]*core.BlockHeader, 0, height)
+	for next := uint32(1); next <= height; {
+		to := height
+		if to-next+1 > maxHeadersPerMessage {
+			to = next + maxHeadersPerMessage - 1
+		}
+		hm := new(HeadersMessage)
+		err := s.Request(context.Background(), from, MessageTypeGetHeaders, &GetHeadersMessage{From: next, To: to}, MessageTypeHeaders, hm)
+		if err != nil {
+			return nil, err
+		}
+		if len(hm.Headers) == 0 || uint32(len(hm.Headers)) > to-next+1 || hm.Headers[0].Height != next {
+			return nil, ErrHeaderUnavailable
+		}
+		headers = append(headers, hm.Headers...)
+		next += uint32(len(hm.Headers))
+	}
+	return headers, nil
+}
+
+// confirmSnapshotHeader 向其他节点询问快照高度的区块头
+// 连同提供快照的节点在内 至少snapshotQuorum个不同的节点返回相同的区块头才接受快照
+func (s *Server) confirmSnapshotHeader(from net.Addr, header *core.BlockHeader) error {
+	peers := s.peerIDs()
+	fromID := peers[from.String()]
+	confirmed := map[string]bool{fromID: true}
+	for key, id := range peers {
+		if len(confirmed) >= s.opts.snapshotQuorum {
+			break
+		}
+		if key == from.String() || confirmed[id] {
+			continue
+		}
+		addr := s.peerAddr(key)
+		if addr == nil {
+			continue
+		}
+		hm := new(HeadersMessage)
+		err := s.Request(context.Background(), addr, MessageTypeGetHeaders, &GetHeadersMessage{
+			From: header.Height,
+			To:   header.Height,
+		}, MessageTypeHeaders, hm)
+		if errors.Is(err, ErrServerStopped) {
+			return err
+		}
+		if err != nil || len(hm.Headers) != 1 || *hm.Headers[0] != *header {
+			s.logf("节点 %s 没有确认高度 %d 的快照区块头", addr, header.Height)
+			continue
+		}
+		confirmed[id] = true
+	}
+	if len(confirmed) < s.opts.snapshotQuorum {
+		return ErrSnapshotNoQuorum
+	}
+	return nil
+}
+
+// peerIDs 返回已经宣布了节点ID的连接 键为连接地址
+func (s *Server) peerIDs() map[string]string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ids := make(map[string]string, len(s.peerInfo))
+	for key, info := range s.peerInfo {
+		if info.id != "" {
+			ids[key] = info.id
+		}
+	}
+	return ids
+}
+
+func (s *Server) peerAddr(key string) net.Addr {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	info, ok := s.peerInfo[key]
+	if !ok {
+		return nil
+	}
+	return info.peer.RemoteAddr()
+}
+
+func (s *Server) handleGetSnapshotMessage(from net.Addr, id uint64, body []byte) {
+	s.logf("处理来自 %s 的获取快照消息", from)
+	getSnap := new(GetSnapshotMessage)
+	if err := DecodeExact(bytes.NewBuffer(body), getSnap); err != nil {
+		s.logf("解析获取快照消息失败: %v", err)
+		s.misbehave(from, misbehaviorBadMessage)
+		return
+	}
+
+	var (
+		snap *core.StateSnapshot
+		err  error
+	)
+	if getSnap.Height == 0 {
+		snap, err = s.chain.GetLatestSnapshot()
+	} else {
+		snap, err = s.chain.GetSnapshot(getSnap.Height)
+	}
+
+	// 没有快照时返回Total为0的消息 让对方退回到逐块同步
+	sm := &SnapshotMessage{}
+	if err == nil {
+		sm.Height = snap.Height
+		sm.BlockHash = snap.BlockHash
+		sm.StateRoot = snap.StateRoot
+		sm.Index = getSnap.Index
+		sm.Total = snap.ChunkCount(snapshotChunkSize)
+		sm.Accounts = snap.Chunk(getSnap.Index, snapshotChunkSize)
+		if getSnap.Index == 0 {
+			anchor, err := s.chain.GetBlock(snap.Height)
+			if err != nil {
+				s.logf("获取快照高度 %d 的区块失败: %v", snap.Height, err)
+				return
+			}
+			sm.Anchor = anchor
+		}
+	} else {
+		s.logf("获取快照失败: %v", err)
+	}
+
+	data, err := EncodeMessageWithID(MessageTypeSnapshot, id, sm)
+	if err != nil {
+		s.logf("编码快照消息失败: %v", err)
+		return
+	}
+	s.send(from, data)
+}
+
+// handleSnapshotMessage 处理没有对应请求的快照消息 快照分块只通过请求接收 超时之后才到达的响应直接丢弃
+func (s *Server) handleSnapshotMessage(from net.Addr, body []byte) {
+	sm := new(SnapshotMessage)
+	if err := DecodeExact(bytes.NewBuffer(body), sm); err != nil {
+		s.logf("解析快照消息失败: %v", err)
+		s.misbehave(from, misbehaviorBadMessage)
+		return
+	}
+	s.logf("忽略来自 %s 的快照消息", from)
+}
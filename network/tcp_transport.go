@@ -2,65 +2,163 @@ package network
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"go-chain/utils"
 	"io"
+	"log"
 	"net"
+	"os"
+	"sync"
 )
 
-
+// TCPPeer 握手之后的加密连接 每一帧都用会话密钥加密和认证
 type TCPPeer struct {
-	conn net.Conn
+	conn     net.Conn
 	Outgoing bool
+	session  *secureSession
+	// 握手时验证过的对方节点ID
+	remoteID string
+	// 连接关闭后ReceiveLoop不再等待Server接收消息
+	closed    chan struct{}
+	closeOnce sync.Once
+	logger    *log.Logger
 }
 
 // 接收连接对象
 type TCPTransport struct {
 	listenAddr string
+	identity   *NodeIdentity
 	listener   net.Listener
-	peerCh chan *TCPPeer
+	peerCh     chan Peer
+	quitCh     chan struct{}
+	closeOnce  sync.Once
+	logger     *log.Logger
 }
 
+type TCPTransportOption func(*TCPTransport)
+
+// WithTCPLogger 设置传输层输出日志使用的logger
+func WithTCPLogger(logger *log.Logger) TCPTransportOption {
+	return func(t *TCPTransport) {
+		t.logger = logger
+	}
+}
+
+var _ Transport = new(TCPTransport)
+var _ Peer = new(TCPPeer)
+var _ authenticatedPeer = new(TCPPeer)
+
+// Send 加密并发送一帧数据 每帧前面带有4字节小端序的密文长度
+// 长度和密文在一次Write中写出 多个协程同时发送时帧不会交错
 func (p *TCPPeer) Send(payload []byte) error {
-	_, err := p.conn.Write(payload)
-	return err
+	if len(payload) > MaxMessageSize {
+		return utils.ErrLengthExceeded
+	}
+	return p.session.writeFrame(p.conn, payload)
+}
+
+// readFrame 读取一帧完整的数据 长度超过max时返回错误
+func readFrame(r io.Reader, max int) ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	n := binary.LittleEndian.Uint32(header[:])
+	if n > uint32(max) {
+		return nil, utils.ErrLengthExceeded
+	}
+	frame := make([]byte, n)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
 }
 
 func (p *TCPPeer) ReceiveLoop(rpcCh chan<- RPC) {
 	defer p.conn.Close()
 
 	for {
-		buf := make([]byte, 4096)
-		n, err := p.conn.Read(buf)
-		if err == io.EOF {
-			continue
-		}
+		frame, err := p.session.readFrame(p.conn)
 		if err != nil {
-			continue
+			// 连接已经被主动关闭时不需要打印错误
+			if !errors.Is(err, net.ErrClosed) && err != io.EOF {
+				p.logger.Printf("读取 %s 的数据失败: %s", p.conn.RemoteAddr(), err)
+			}
+			return
 		}
 
 		rpc := RPC{
 			From:    NetAddr(p.conn.RemoteAddr().String()),
-			Payload: bytes.NewReader(buf[:n]),
+			Payload: bytes.NewReader(frame),
 		}
 
-		rpcCh <- rpc
+		select {
+		case rpcCh <- rpc:
+		case <-p.closed:
+			return
+		}
 	}
 }
 
+// RemoteID 返回握手时验证过的对方节点ID
+func (p *TCPPeer) RemoteID() string {
+	return p.remoteID
+}
+
+func (p *TCPPeer) RemoteAddr() net.Addr {
+	return p.conn.RemoteAddr()
+}
 
+func (p *TCPPeer) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.closed)
+	})
+	return p.conn.Close()
+}
 
-func NewTCPPeer(conn net.Conn, outgoing bool) *TCPPeer {
+// newTCPPeer 在conn上完成握手并创建连接 握手失败时关闭conn
+func newTCPPeer(conn net.Conn, outgoing bool, identity *NodeIdentity, logger *log.Logger) (*TCPPeer, error) {
+	session, remoteID, err := handshake(conn, identity, outgoing)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("与 %s 握手失败: %w", conn.RemoteAddr(), err)
+	}
 	return &TCPPeer{
 		conn:     conn,
 		Outgoing: outgoing,
-	}
+		session:  session,
+		remoteID: remoteID,
+		closed:   make(chan struct{}),
+		logger:   logger,
+	}, nil
 }
 
-func NewTCPTransport(listenAddr string) (*TCPTransport, error) {
-	return &TCPTransport{
+// NewTCPTransport 创建TCP传输层 identity为握手时使用的节点密钥 为nil时生成临时密钥
+func NewTCPTransport(listenAddr string, identity *NodeIdentity, options ...TCPTransportOption) (*TCPTransport, error) {
+	if identity == nil {
+		var err error
+		if identity, err = GenerateNodeIdentity(); err != nil {
+			return nil, err
+		}
+	}
+	t := &TCPTransport{
 		listenAddr: listenAddr,
-		peerCh:     make(chan *TCPPeer),
-	}, nil
+		identity:   identity,
+		peerCh:     make(chan Peer),
+		quitCh:     make(chan struct{}),
+		logger:     log.New(os.Stdout, "", log.LstdFlags),
+	}
+	for _, option := range options {
+		option(t)
+	}
+	return t, nil
+}
+
+// Identity 返回传输层使用的节点密钥 节点ID必须和它一致
+func (t *TCPTransport) Identity() *NodeIdentity {
+	return t.identity
 }
 
 func (t *TCPTransport) Start() error {
@@ -79,13 +177,61 @@ func (t *TCPTransport) acceptLoop() {
 	for {
 		conn, err := t.listener.Accept()
 		if err != nil {
-			fmt.Printf("接受连接时发生错误: %s\n", err)
+			// 监听已经关闭
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			t.logger.Printf("接受连接时发生错误: %s", err)
 			continue
 		}
 
-		peer := NewTCPPeer(conn, false)
-		t.peerCh <- peer
+		// 握手可能很慢 不阻塞接受其他连接
+		go t.handshakeInbound(conn)
+	}
+}
+
+// handshakeInbound 与主动连接过来的节点握手 成功后交给Server
+func (t *TCPTransport) handshakeInbound(conn net.Conn) {
+	peer, err := newTCPPeer(conn, false, t.identity, t.logger)
+	if err != nil {
+		t.logger.Printf("接受连接失败: %v", err)
+		return
+	}
+	select {
+	case t.peerCh <- peer:
+	case <-t.quitCh:
+		peer.Close()
+	}
+}
+
+func (t *TCPTransport) Dial(addr string) (Peer, error) {
+	conn, err := net.DialTimeout("tcp", addr, handshakeTimeout)
+	if err != nil {
+		return nil, err
+	}
+	peer, err := newTCPPeer(conn, true, t.identity, t.logger)
+	if err != nil {
+		return nil, err
 	}
+	return peer, nil
 }
 
+func (t *TCPTransport) Accept() <-chan Peer {
+	return t.peerCh
+}
+
+func (t *TCPTransport) Addr() NetAddr {
+	return NetAddr(t.listenAddr)
+}
 
+// Close 关闭监听 acceptLoop随之退出
+func (t *TCPTransport) Close() error {
+	var err error
+	t.closeOnce.Do(func() {
+		close(t.quitCh)
+		if t.listener != nil {
+			err = t.listener.Close()
+		}
+	})
+	return err
+}
@@ -1,17 +1,20 @@
 package network
 
-import "io"
+import (
+	"io"
+	"net"
+)
 
 type NetAddr string
 
 // Network implements net.Addr.
 func (n NetAddr) Network() string {
-	panic("unimplemented")
+	return "tcp"
 }
 
 // String implements net.Addr.
 func (n NetAddr) String() string {
-	panic("unimplemented")
+	return string(n)
 }
 
 type RPC struct {
@@ -19,9 +22,24 @@ type RPC struct {
 	Payload io.Reader
 }
 
+// Peer 表示与另一个节点之间的一条连接 每次Send发送一条完整的消息
+type Peer interface {
+	Send(payload []byte) error
+	// ReceiveLoop 把收到的消息交给rpcCh 连接断开后返回
+	ReceiveLoop(rpcCh chan<- RPC)
+	RemoteAddr() net.Addr
+	Close() error
+}
+
+// Transport 负责建立节点之间的连接 Server只通过这个接口收发消息
+// TCPTransport 使用真实的网络连接 LocalTransport 在同一个进程内连接多个节点 用于测试
 type Transport interface {
-	Consume() <-chan RPC
-	Connect(transport Transport) error
-	SendMessage(to NetAddr, payload []byte) error
+	Start() error
+	// Dial 主动连接指定地址的节点
+	Dial(addr string) (Peer, error)
+	// Accept 返回其他节点主动连接时建立的连接
+	Accept() <-chan Peer
 	Addr() NetAddr
+	// Close 停止接受新的连接 已经建立的连接由Server负责关闭
+	Close() error
 }
@@ -0,0 +1,76 @@
+package network
+
+import (
+	"go-chain/core"
+	"time"
+)
+
+// 每隔多久用交易池中仍然有效的本地交易重写一次日志
+const journalRotateInterval = time.Hour
+
+// SubmitTx 提交一笔本地交易 加入交易池后写入日志并广播给其他节点
+func (s *Server) SubmitTx(tx *core.Transaction) error {
+	if err := s.pool.AddLocals([]*core.Transaction{tx}); err != nil {
+		return err
+	}
+	s.seenTxs.Add(tx.CalHash())
+	if s.journal != nil {
+		if err := s.journal.Insert(tx); err != nil {
+			s.logf("写入交易日志失败: %v", err)
+		}
+	}
+	s.spawn(func() { s.broadcastTx(tx, nil) })
+	return nil
+}
+
+// loadJournal 加载日志中的本地交易 重新校验后加入交易池并广播
+// 节点刚启动时账户状态还没有同步 余额暂时不足的交易保留在交易池的重试列表中 同步之后再加入交易池
+// 只有交易本身无效或者nonce已经被使用的交易会被丢弃
+func (s *Server) loadJournal() {
+	if s.journal == nil {
+		return
+	}
+	txs, err := s.journal.Load()
+	if err != nil {
+		s.logf("加载交易日志失败: %v", err)
+	}
+	if err := s.pool.RestoreLocals(txs); err != nil {
+		s.logf("丢弃日志中的无效交易: %v", err)
+	}
+	locals := s.pool.Locals()
+	if err := s.journal.Rotate(locals); err != nil {
+		s.logf("重写交易日志失败: %v", err)
+	}
+	s.logf("从交易日志中恢复了 %d 笔本地交易", len(locals))
+
+	// 还在等待重试的交易对方节点也无法接受 加入交易池之后再广播
+	for _, tx := range locals {
+		if s.pool.Get(tx.CalHash()) != nil {
+			s.broadcastTx(tx, nil)
+		}
+	}
+}
+
+// resetPool 按最新的账户状态整理交易池 之前暂时无法加入的本地交易加入交易池后广播给其他节点
+func (s *Server) resetPool() {
+	for _, tx := range s.pool.Reset(s.chain.GetAccountState()) {
+		s.spawn(func() { s.broadcastTx(tx, nil) })
+	}
+}
+
+// journalLoop 定期重写交易日志 去掉已经上链或者被淘汰的交易
+func (s *Server) journalLoop() {
+	ticker := s.opts.clock.NewTicker(journalRotateInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C():
+			if err := s.journal.Rotate(s.pool.Locals()); err != nil {
+				s.logf("重写交易日志失败: %v", err)
+			}
+		case <-s.quitCh:
+			return
+		}
+	}
+}
@@ -3,6 +3,7 @@ package test
 import (
 	"go-chain/core"
 	"go-chain/types"
+	"math"
 	"testing"
 )
 
@@ -132,3 +133,34 @@ func TestAccountStateIntegration(t *testing.T) {
 		t.Errorf("addr3最终余额不正确，期望300，实际%d", as.GetBalance(addr3))
 	}
 }
+
+func TestTransferWithNonce(t *testing.T) {
+	as := core.NewAccountState()
+	from := types.Address{0x1}
+	to := types.Address{0x2}
+	as.CreateAccount(from, &core.Account{Address: from, Balance: 100})
+
+	if err := as.TransferWithNonce(from, to, 10, 0, 1); err != core.InvalidNonceErr {
+		t.Errorf("nonce不匹配时应返回InvalidNonceErr错误")
+	}
+	if err := as.TransferWithNonce(from, to, 10, 0, 0); err != nil {
+		t.Errorf("正常转账应该成功：%v", err)
+	}
+	if as.GetNonce(from) != 1 {
+		t.Errorf("转账后nonce应为1，实际为%d", as.GetNonce(from))
+	}
+	// 余额不足时nonce不变
+	if err := as.TransferWithNonce(from, to, 1000, 0, 1); err != core.InsufficientBalance {
+		t.Errorf("余额不足时应返回InsufficientBalance错误")
+	}
+	if as.GetNonce(from) != 1 {
+		t.Errorf("转账失败后nonce不应改变，实际为%d", as.GetNonce(from))
+	}
+	// 金额和手续费之和溢出
+	if err := as.TransferWithNonce(from, to, 1, math.MaxUint64, 1); err != core.CostOverflowErr {
+		t.Errorf("金额和手续费之和溢出时应返回CostOverflowErr错误，实际为%v", err)
+	}
+	if as.GetBalance(from) != 90 {
+		t.Errorf("转账失败后余额不应改变，实际为%d", as.GetBalance(from))
+	}
+}
@@ -0,0 +1,92 @@
+package test
+
+import (
+	"go-chain/core"
+	"go-chain/cryptoo"
+	"testing"
+)
+
+func TestBlockBuilderSkipsFailingTxs(t *testing.T) {
+	bc := core.NewBlockchain()
+	pv1, pv2 := buildChain(t, bc, 1)
+	pv3, _ := cryptoo.GeneratePrivateKey()
+	bc.GetAccountState().CreateAccount(pv3.GetPublicKey().Address(), &core.Account{
+		Address: pv3.GetPublicKey().Address(),
+		Balance: 1000,
+	})
+
+	pool := core.NewTxPool(100, 50, core.WithStateProvider(func() core.StateReader {
+		return bc.GetAccountState()
+	}))
+	// 交易池没有检查过期 但是这笔交易无法进入下一个区块
+	expired := core.NewTransaction(pv3, pv2.GetPublicKey(), []byte("expired"), 100, 0)
+	expired.ValidUntilHeight = 1
+	expired.Sign(pv3)
+	ok1 := core.NewTransaction(pv1, pv2.GetPublicKey(), []byte("ok"), 100, 1)
+	ok2 := core.NewTransaction(pv1, pv2.GetPublicKey(), []byte("ok"), 100, 2)
+	if err := pool.Add([]*core.Transaction{expired, ok1, ok2}); err != nil {
+		t.Fatalf("添加交易失败：%v", err)
+	}
+
+	block, err := core.NewBlockBuilder(bc, pool).Build()
+	if err != nil {
+		t.Fatalf("生成区块失败：%v", err)
+	}
+	if len(block.Transactions) != 2 {
+		t.Fatalf("期望区块包含2笔交易，实际为%d", len(block.Transactions))
+	}
+	for _, tx := range block.Transactions {
+		if tx.CalHash() == expired.CalHash() {
+			t.Errorf("过期的交易不应该被打包")
+		}
+	}
+
+	// 模拟执行不应该修改链上的状态
+	if nonce := bc.GetAccountState().GetNonce(pv1.GetPublicKey().Address()); nonce != 1 {
+		t.Errorf("期望nonce为1，实际为%d", nonce)
+	}
+	if err := bc.AddBlock(block); err != nil {
+		t.Fatalf("添加生成的区块失败：%v", err)
+	}
+	if len(bc.GetLatestBlock().Transactions) != 2 {
+		t.Errorf("区块中的交易应该全部执行成功")
+	}
+	// 区块头承诺的状态根就是区块执行之后的状态根
+	if block.Header.StateRoot != bc.GetAccountState().StateRoot() {
+		t.Errorf("区块头中的状态根与执行结果不一致")
+	}
+}
+
+func TestBlockBuilderLimits(t *testing.T) {
+	bc := core.NewBlockchain()
+	pv1, pv2 := buildChain(t, bc, 1)
+
+	pool := core.NewTxPool(100, 50, core.WithStateProvider(func() core.StateReader {
+		return bc.GetAccountState()
+	}))
+	for i := 1; i <= 5; i++ {
+		tx := core.NewTransaction(pv1, pv2.GetPublicKey(), []byte("limit"), 100, int64(i))
+		if err := pool.Add([]*core.Transaction{tx}); err != nil {
+			t.Fatalf("添加交易失败：%v", err)
+		}
+	}
+
+	// 执行额度只够打包2笔交易
+	gasPerTx := core.TxBaseGas + uint64(len("limit"))*core.TxDataGas
+	block, err := core.NewBlockBuilder(bc, pool, core.WithMaxBlockGas(gasPerTx*2)).Build()
+	if err != nil {
+		t.Fatalf("生成区块失败：%v", err)
+	}
+	if len(block.Transactions) != 2 {
+		t.Errorf("期望区块包含2笔交易，实际为%d", len(block.Transactions))
+	}
+
+	// 字节数太小 一笔交易也放不下
+	block, err = core.NewBlockBuilder(bc, pool, core.WithMaxBlockBytes(1)).Build()
+	if err != nil {
+		t.Fatalf("生成区块失败：%v", err)
+	}
+	if len(block.Transactions) != 0 {
+		t.Errorf("期望区块不包含交易，实际为%d", len(block.Transactions))
+	}
+}
@@ -143,7 +143,7 @@ func TestBlockIntegration(t *testing.T) {
 		}
 		block := core.NewBlock(prevHash, i, transactions)
 		blocks = append(blocks, block)
-		prevHash = block.GetDataHash()
+		prevHash = block.Hash()
 
 		// 等待一小段时间，确保时间戳不同
 		time.Sleep(10 * time.Millisecond)
@@ -151,7 +151,7 @@ func TestBlockIntegration(t *testing.T) {
 
 	// 验证区块链的完整性
 	for i := 1; i < len(blocks); i++ {
-		if blocks[i].GetPrevBlockHash() != blocks[i-1].GetDataHash() {
+		if blocks[i].GetPrevBlockHash() != blocks[i-1].Hash() {
 			t.Errorf("区块 %d 的前一个区块哈希不正确", i)
 		}
 		if blocks[i].Height() != blocks[i-1].Height() + 1 {
@@ -186,3 +186,37 @@ func TestBlockIntegration(t *testing.T) {
 		}
 	}
 }
+
+func TestVerifyHeaderChain(t *testing.T) {
+	bc := core.NewBlockchain(core.WithPruneConfig(core.PruneConfig{Mode: core.PruneModeBlocks, KeepBlocks: 2}))
+	buildChain(t, bc, 5)
+
+	// 区块被裁剪后区块头仍然保留
+	headers, err := bc.GetHeaders(1, 5)
+	if err != nil {
+		t.Fatalf("获取区块头失败：%v", err)
+	}
+	if len(headers) != 5 {
+		t.Fatalf("期望获取5个区块头，实际为%d", len(headers))
+	}
+
+	genesis, _ := bc.GetHeader(0)
+	if err := core.VerifyHeaderChain(genesis, headers); err != nil {
+		t.Errorf("连续的区块头验证失败：%v", err)
+	}
+
+	// 缺少中间的区块头
+	broken := []*core.BlockHeader{headers[0], headers[2]}
+	if err := core.VerifyHeaderChain(nil, broken); err != core.ErrInvalidHeaderChain {
+		t.Errorf("期望错误 %v，实际为 %v", core.ErrInvalidHeaderChain, err)
+	}
+
+	// 与父区块头不相连
+	if err := core.VerifyHeaderChain(headers[1], headers[3:]); err != core.ErrInvalidHeaderChain {
+		t.Errorf("期望错误 %v，实际为 %v", core.ErrInvalidHeaderChain, err)
+	}
+
+	if _, err := bc.GetHeaders(4, 6); err != core.ErrBlockNotFound {
+		t.Errorf("期望错误 %v，实际为 %v", core.ErrBlockNotFound, err)
+	}
+}
@@ -47,7 +47,7 @@ func TestAddBlock(t *testing.T) {
 	bc.AddBlockWithoutValidation(genesisBlock)
 
 	tx := core.NewTransaction(pv1, pb2, []byte("test transaction"), 100, 0)
-	block := core.NewBlock(genesisBlock.GetDataHash(), 1, []*core.Transaction{tx})
+	block := core.NewBlock(genesisBlock.Hash(), 1, []*core.Transaction{tx})
 
 	err := bc.AddBlock(block)
 	if err != nil {
@@ -75,7 +75,7 @@ func TestGetBlock(t *testing.T) {
 	bc.AddBlockWithoutValidation(genesisBlock)
 
 	tx := core.NewTransaction(pv1, pb2, []byte("test transaction"), 100, 0)
-	block := core.NewBlock(genesisBlock.GetDataHash(), 1, []*core.Transaction{tx})
+	block := core.NewBlock(genesisBlock.Hash(), 1, []*core.Transaction{tx})
 
 	err := bc.AddBlock(block)
 	if err != nil {
@@ -110,7 +110,7 @@ func TestBlockchainIntegration(t *testing.T) {
 	// 添加多个区块
 	for i := 1; i <= 5; i++ {
 		tx := core.NewTransaction(pv1, pb2, []byte("transaction"), uint64(100*i), int64(i-1))
-		block := core.NewBlock(bc.GetLatestBlock().GetDataHash(), uint32(i), []*core.Transaction{tx})
+		block := core.NewBlock(bc.GetLatestBlock().Hash(), uint32(i), []*core.Transaction{tx})
 		err := bc.AddBlock(block)
 		if err != nil {
 			t.Fatalf("添加第%d个区块失败：%v", i, err)
@@ -133,9 +133,29 @@ func TestBlockchainIntegration(t *testing.T) {
 		}
 		if i > 1 {
 			prevBlock, _ := bc.GetBlock(uint32(i - 1))
-			if block.GetPrevBlockHash() != prevBlock.GetDataHash() {
+			if block.GetPrevBlockHash() != prevBlock.Hash() {
 				t.Errorf("第%d个区块的前一个区块哈希不正确", i)
 			}
 		}
 	}
 }
+
+func TestAddBlockChecksStateRoot(t *testing.T) {
+	bc := core.NewBlockchain()
+	pv1, pv2 := buildChain(t, bc, 1)
+	root := bc.GetAccountState().StateRoot()
+
+	// 区块头承诺的状态根与执行结果不一致时拒绝区块 并撤销已经执行的交易
+	tx := core.NewTransaction(pv1, pv2.GetPublicKey(), []byte("transaction"), 100, 1)
+	block := core.NewBlock(bc.GetLatestBlock().Hash(), 2, []*core.Transaction{tx})
+	block.Header.StateRoot = types.RandomHash()
+	if err := bc.AddBlock(block); err != core.ErrStateRoot {
+		t.Fatalf("期望返回ErrStateRoot，实际为%v", err)
+	}
+	if bc.Height() != 1 {
+		t.Errorf("被拒绝的区块不应该上链，高度为%d", bc.Height())
+	}
+	if bc.GetAccountState().StateRoot() != root {
+		t.Error("被拒绝的区块不应该修改账户状态")
+	}
+}
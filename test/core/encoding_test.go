@@ -0,0 +1,87 @@
+package test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"go-chain/core"
+	"go-chain/cryptoo"
+	"go-chain/types"
+	"go-chain/utils"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransactionBinaryEncoding(t *testing.T) {
+	fromPrivKey, _ := cryptoo.GeneratePrivateKey()
+	toPrivKey, _ := cryptoo.GeneratePrivateKey()
+	tx := core.NewTransactionWithFee(fromPrivKey, toPrivKey.GetPublicKey(), []byte("测试数据"), 100, 2, 1)
+
+	var buf bytes.Buffer
+	assert.NoError(t, tx.Encode(&buf))
+	data := append([]byte(nil), buf.Bytes()...)
+
+	// 相同的交易每次编码得到的字节完全一致
+	var again bytes.Buffer
+	assert.NoError(t, tx.Encode(&again))
+	assert.Equal(t, data, again.Bytes())
+
+	decoded := new(core.Transaction)
+	assert.NoError(t, decoded.Decode(&buf))
+	assert.Equal(t, tx.Hash, decoded.Hash)
+	assert.Equal(t, tx.Data, decoded.Data)
+	assert.Equal(t, tx.Fee, decoded.Fee)
+	assert.True(t, decoded.Verify())
+
+	// 数据不完整
+	truncated := new(core.Transaction)
+	assert.ErrorIs(t, truncated.Decode(bytes.NewReader(data[:len(data)-1])), io.ErrUnexpectedEOF)
+
+	// 空数据返回io.EOF 用于顺序读取多笔交易时判断结尾
+	assert.ErrorIs(t, new(core.Transaction).Decode(bytes.NewReader(nil)), io.EOF)
+
+	// 发送方公钥的长度超过上限
+	oversized := append([]byte(nil), data...)
+	binary.LittleEndian.PutUint32(oversized[4:], core.MaxPublicKeySize+1)
+	assert.ErrorIs(t, new(core.Transaction).Decode(bytes.NewReader(oversized)), utils.ErrLengthExceeded)
+
+	// S带有前导0时虽然数值相同 也不是唯一的编码 需要一个不足32字节的S才能补0
+	short := tx
+	for nonce := int64(0); len(short.Signature.S.Bytes()) == core.MaxSignatureScalarSize; nonce++ {
+		short = core.NewTransactionWithFee(fromPrivKey, toPrivKey.GetPublicKey(), nil, 100, 2, nonce)
+	}
+	buf.Reset()
+	assert.NoError(t, short.Encode(&buf))
+	data = buf.Bytes()
+	sBytes := short.Signature.S.Bytes()
+	padded := append([]byte(nil), data[:len(data)-len(sBytes)-4]...)
+	padded = binary.LittleEndian.AppendUint32(padded, uint32(len(sBytes)+1))
+	padded = append(append(padded, 0), sBytes...)
+	assert.ErrorIs(t, new(core.Transaction).Decode(bytes.NewReader(padded)), utils.ErrNonCanonical)
+}
+
+func TestBlockBinaryEncoding(t *testing.T) {
+	privKey, _ := cryptoo.GeneratePrivateKey()
+	txs := []*core.Transaction{
+		core.NewTransaction(privKey, privKey.GetPublicKey(), nil, 1, 1),
+		core.NewTransaction(privKey, privKey.GetPublicKey(), nil, 2, 2),
+	}
+	block := core.NewBlock(types.RandomHash(), 1, txs)
+
+	var buf bytes.Buffer
+	assert.NoError(t, block.Encode(&buf))
+
+	decoded := new(core.Block)
+	assert.NoError(t, decoded.Decode(&buf))
+	assert.Equal(t, block.Header, decoded.Header)
+	assert.Len(t, decoded.Transactions, 2)
+	assert.True(t, decoded.Verify())
+
+	// 交易数量超过上限时不会按声明的数量分配内存
+	var header bytes.Buffer
+	w := utils.NewBinaryWriter(&header)
+	core.WriteBlockHeader(w, block.Header)
+	w.WriteUint32(core.MaxBlockTransactions + 1)
+	assert.ErrorIs(t, new(core.Block).Decode(&header), utils.ErrLengthExceeded)
+}
@@ -0,0 +1,141 @@
+package test
+
+import (
+	"errors"
+	"go-chain/core"
+	"go-chain/cryptoo"
+	"path/filepath"
+	"testing"
+)
+
+func TestTxJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "txs.journal")
+	journal := core.NewTxJournal(path)
+
+	// 日志文件不存在时加载结果为空
+	txs, err := journal.Load()
+	if err != nil {
+		t.Fatalf("加载交易日志失败: %v", err)
+	}
+	if len(txs) != 0 {
+		t.Errorf("期望没有交易, 实际为 %d", len(txs))
+	}
+
+	pv1, _ := cryptoo.GeneratePrivateKey()
+	pv2, _ := cryptoo.GeneratePrivateKey()
+	tx1 := core.NewTransaction(pv1, pv2.GetPublicKey(), []byte("tx1"), 100, 0)
+	tx2 := core.NewTransaction(pv1, pv2.GetPublicKey(), []byte("tx2"), 100, 1)
+
+	if err := journal.Insert(tx1); err != core.ErrJournalClosed {
+		t.Errorf("期望错误 %v, 实际为 %v", core.ErrJournalClosed, err)
+	}
+	if err := journal.Rotate(nil); err != nil {
+		t.Fatalf("重写交易日志失败: %v", err)
+	}
+	if err := journal.Insert(tx1); err != nil {
+		t.Fatalf("写入交易日志失败: %v", err)
+	}
+	if err := journal.Insert(tx2); err != nil {
+		t.Fatalf("写入交易日志失败: %v", err)
+	}
+	journal.Close()
+
+	// 模拟重启 重新加载日志
+	journal = core.NewTxJournal(path)
+	txs, err = journal.Load()
+	if err != nil {
+		t.Fatalf("加载交易日志失败: %v", err)
+	}
+	if len(txs) != 2 {
+		t.Fatalf("期望加载 2 笔交易, 实际为 %d", len(txs))
+	}
+	if txs[0].CalHash() != tx1.CalHash() || txs[1].CalHash() != tx2.CalHash() {
+		t.Errorf("加载的交易与写入的交易不一致")
+	}
+
+	// 重写后只保留仍然有效的交易
+	if err := journal.Rotate([]*core.Transaction{tx2}); err != nil {
+		t.Fatalf("重写交易日志失败: %v", err)
+	}
+	journal.Close()
+	txs, _ = core.NewTxJournal(path).Load()
+	if len(txs) != 1 || txs[0].CalHash() != tx2.CalHash() {
+		t.Errorf("重写后期望只剩下 tx2")
+	}
+}
+
+func TestTxPoolLocals(t *testing.T) {
+	pv1, _ := cryptoo.GeneratePrivateKey()
+	pv2, _ := cryptoo.GeneratePrivateKey()
+	pool := core.NewTxPool(100, 50)
+
+	local := core.NewTransaction(pv1, pv2.GetPublicKey(), []byte("local"), 100, 0)
+	remote := core.NewTransaction(pv2, pv1.GetPublicKey(), []byte("remote"), 100, 0)
+	if err := pool.AddLocals([]*core.Transaction{local}); err != nil {
+		t.Fatalf("添加本地交易失败: %v", err)
+	}
+	if err := pool.Add([]*core.Transaction{remote}); err != nil {
+		t.Fatalf("添加交易失败: %v", err)
+	}
+
+	locals := pool.Locals()
+	if len(locals) != 1 || locals[0].CalHash() != local.CalHash() {
+		t.Fatalf("期望只有 1 笔本地交易")
+	}
+
+	// 本地交易上链后不再属于本地交易
+	pool.RemovePendingTxs([]*core.Transaction{local})
+	if len(pool.Locals()) != 0 {
+		t.Errorf("交易离开交易池后不应该再是本地交易")
+	}
+}
+
+func TestTxPoolRestoreLocals(t *testing.T) {
+	pv1, _ := cryptoo.GeneratePrivateKey()
+	pv2, _ := cryptoo.GeneratePrivateKey()
+	from := pv1.GetPublicKey().Address()
+
+	// 节点刚启动 账户状态还没有同步 发送者暂时没有余额
+	state := core.NewAccountState()
+	pool := core.NewTxPool(100, 50, core.WithStateProvider(func() core.StateReader {
+		return state
+	}))
+
+	unfunded := core.NewTransaction(pv1, pv2.GetPublicKey(), []byte("unfunded"), 100, 0)
+	forged := core.NewTransaction(pv1, pv2.GetPublicKey(), []byte("forged"), 100, 1)
+	forged.Value = 200
+	if err := pool.RestoreLocals([]*core.Transaction{unfunded, forged}); !errors.Is(err, core.ErrInvalidSignature) {
+		t.Errorf("期望丢弃签名无效的交易, 实际为 %v", err)
+	}
+	if pool.Get(unfunded.CalHash()) != nil {
+		t.Error("余额不足的交易不应该进入交易池")
+	}
+	locals := pool.Locals()
+	if len(locals) != 1 || locals[0].CalHash() != unfunded.CalHash() {
+		t.Fatalf("余额不足的交易应该保留在本地交易中等待重试")
+	}
+
+	// 同步之后余额足够 Reset时重新加入交易池
+	state = core.NewAccountState()
+	state.CreateAccount(from, &core.Account{Address: from, Balance: 1000})
+	restored := pool.Reset(state)
+	if len(restored) != 1 || restored[0].CalHash() != unfunded.CalHash() {
+		t.Fatalf("期望重新加入 1 笔本地交易, 实际为 %d", len(restored))
+	}
+	if pool.Get(unfunded.CalHash()) == nil {
+		t.Error("余额足够后交易应该进入交易池")
+	}
+
+	// 余额再次不足时本地交易不会被删除 nonce被使用之后才删除
+	state = core.NewAccountState()
+	pool.Reset(state)
+	if pool.Get(unfunded.CalHash()) != nil || len(pool.Locals()) != 1 {
+		t.Error("余额不足的本地交易应该等待重试")
+	}
+	state = core.NewAccountState()
+	state.CreateAccount(from, &core.Account{Address: from, Balance: 1000, Nonce: 1})
+	pool.Reset(state)
+	if len(pool.Locals()) != 0 {
+		t.Error("nonce已经被使用的本地交易应该被删除")
+	}
+}
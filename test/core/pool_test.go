@@ -1,10 +1,13 @@
 package test
 
 import (
+	"errors"
 	"fmt"
 	"go-chain/core"
 	"go-chain/cryptoo"
+	"math"
 	"testing"
+	"time"
 )
 
 func TestNewTxPool(t *testing.T) {
@@ -74,6 +77,42 @@ func TestGetPendingTxsForPacking(t *testing.T) {
 	}
 }
 
+func TestGetPendingTxsForPackingRecovery(t *testing.T) {
+	pv1, _ := cryptoo.GeneratePrivateKey()
+	pv2, _ := cryptoo.GeneratePrivateKey()
+	pb2 := pv2.GetPublicKey()
+	from := pv1.GetPublicKey().Address()
+
+	state := core.NewAccountState()
+	state.CreateAccount(from, &core.Account{Address: from, Balance: 1000})
+	pool := core.NewTxPool(100, 50, core.WithStateProvider(func() core.StateReader {
+		return state
+	}))
+	tx0 := core.NewTransaction(pv1, pb2, []byte("test0"), 100, 0)
+	tx1 := core.NewTransaction(pv1, pb2, []byte("test1"), 100, 1)
+	pool.Add([]*core.Transaction{tx0, tx1})
+
+	if _, err := pool.GetPendingTxsForPacking(); err != nil {
+		t.Fatalf("获取待打包交易失败：%v", err)
+	}
+
+	// 打包后nonce停留在打包的交易之后 新交易直接进入pending
+	tx2 := core.NewTransaction(pv1, pb2, []byte("test2"), 100, 2)
+	if err := pool.Add([]*core.Transaction{tx2}); err != nil {
+		t.Fatalf("添加交易失败：%v", err)
+	}
+	if pool.GetPendingSize() != 1 {
+		t.Errorf("期望待处理交易数量为1，实际为%d", pool.GetPendingSize())
+	}
+
+	// 区块没有上链 按链上的状态重置后打包的交易回到pending
+	pool.Reset(state)
+	pendingTxs := pool.GetPendingTxs()
+	if len(pendingTxs) != 3 || pendingTxs[0] != tx0 || pendingTxs[1] != tx1 || pendingTxs[2] != tx2 {
+		t.Errorf("重置后期望待处理交易为tx0 tx1 tx2，实际包含%d个交易", len(pendingTxs))
+	}
+}
+
 func TestRemovePendingTxs(t *testing.T) {
 
 	pv1, _ := cryptoo.GeneratePrivateKey()
@@ -188,3 +227,464 @@ func TestTxPoolEvictionAndSorting(t *testing.T) {
 		}
 	}
 }
+
+func TestTxPoolNonceQueue(t *testing.T) {
+	pool := core.NewTxPool(100, 50)
+
+	pv1, _ := cryptoo.GeneratePrivateKey()
+	pv2, _ := cryptoo.GeneratePrivateKey()
+	pb2 := pv2.GetPublicKey()
+
+	tx0 := core.NewTransaction(pv1, pb2, []byte("test0"), 100, 0)
+	tx1 := core.NewTransaction(pv1, pb2, []byte("test1"), 500, 1)
+	tx2 := core.NewTransaction(pv1, pb2, []byte("test2"), 300, 2)
+
+	// nonce不连续的交易只能进入queue
+	pool.Add([]*core.Transaction{tx2, tx1})
+	if pool.GetPendingSize() != 0 {
+		t.Errorf("nonce不连续时pending应为空，实际为%d", pool.GetPendingSize())
+	}
+	if pool.GetAllSize() != 2 {
+		t.Errorf("期望交易池中有2个交易，实际为%d", pool.GetAllSize())
+	}
+
+	// nonce 0到达后 之后的交易都可以执行
+	pool.Add([]*core.Transaction{tx0})
+	pendingTxs := pool.GetPendingTxs()
+	if len(pendingTxs) != 3 {
+		t.Fatalf("期望待处理交易数量为3，实际为%d", len(pendingTxs))
+	}
+	for i, tx := range pendingTxs {
+		if tx.Nonce != int64(i) {
+			t.Errorf("同一发送者的交易应该按nonce排列，第%d个交易nonce为%d", i, tx.Nonce)
+		}
+	}
+
+	// 手续费没有提高的相同nonce交易会被拒绝
+	dup := core.NewTransaction(pv1, pb2, []byte("dup"), 50, 1)
+	if err := pool.Add([]*core.Transaction{dup}); !errors.Is(err, core.ErrReplaceUnderpriced) {
+		t.Errorf("期望返回ErrReplaceUnderpriced，实际为%v", err)
+	}
+}
+
+func TestTxPoolPackingOrderAcrossSenders(t *testing.T) {
+	pool := core.NewTxPool(100, 50)
+
+	pv1, _ := cryptoo.GeneratePrivateKey()
+	pv2, _ := cryptoo.GeneratePrivateKey()
+	pv3, _ := cryptoo.GeneratePrivateKey()
+	pb3 := pv3.GetPublicKey()
+
+	// 发送者1的第一笔交易value很低 但第二笔很高 手续费都为0时按value排序
+	a0 := core.NewTransaction(pv1, pb3, []byte("a0"), 10, 0)
+	a1 := core.NewTransaction(pv1, pb3, []byte("a1"), 1000, 1)
+	b0 := core.NewTransaction(pv2, pb3, []byte("b0"), 200, 0)
+	b1 := core.NewTransaction(pv2, pb3, []byte("b1"), 100, 1)
+
+	pool.Add([]*core.Transaction{a1, a0, b1, b0})
+
+	packed, err := pool.GetPendingTxsForPacking()
+	if err != nil {
+		t.Fatalf("获取待打包交易失败：%v", err)
+	}
+	expected := []*core.Transaction{b0, b1, a0, a1}
+	if len(packed) != len(expected) {
+		t.Fatalf("期望打包%d个交易，实际为%d", len(expected), len(packed))
+	}
+	for i := range expected {
+		if packed[i] != expected[i] {
+			t.Errorf("第%d个打包的交易不正确", i)
+		}
+	}
+}
+
+func TestTxPoolReset(t *testing.T) {
+	pv1, _ := cryptoo.GeneratePrivateKey()
+	pv2, _ := cryptoo.GeneratePrivateKey()
+	pb2 := pv2.GetPublicKey()
+	from := pv1.GetPublicKey().Address()
+
+	state := core.NewAccountState()
+	state.CreateAccount(from, &core.Account{Address: from, Balance: 1000})
+	pool := core.NewTxPool(100, 50, core.WithStateProvider(func() core.StateReader {
+		return state
+	}))
+
+	tx0 := core.NewTransaction(pv1, pb2, []byte("test0"), 100, 0)
+	tx1 := core.NewTransaction(pv1, pb2, []byte("test1"), 100, 1)
+	pool.Add([]*core.Transaction{tx0, tx1})
+
+	// nonce 0的交易在链上执行后 重置交易池
+	if err := state.TransferWithNonce(from, pb2.Address(), 100, 0, 0); err != nil {
+		t.Fatalf("转账失败：%v", err)
+	}
+	pool.Reset(state)
+
+	if pool.Get(tx0.CalHash()) != nil {
+		t.Error("已经执行的交易应该从交易池中删除")
+	}
+	pendingTxs := pool.GetPendingTxs()
+	if len(pendingTxs) != 1 || pendingTxs[0] != tx1 {
+		t.Error("剩余的待处理交易应为tx1")
+	}
+
+	// nonce过低的交易不能再加入
+	if err := pool.Add([]*core.Transaction{tx0}); !errors.Is(err, core.ErrNonceTooLow) {
+		t.Errorf("期望返回ErrNonceTooLow，实际为%v", err)
+	}
+}
+
+func TestTxPoolReplaceByFee(t *testing.T) {
+	pool := core.NewTxPool(100, 50, core.WithPriceBump(10))
+
+	pv1, _ := cryptoo.GeneratePrivateKey()
+	pv2, _ := cryptoo.GeneratePrivateKey()
+	pb2 := pv2.GetPublicKey()
+
+	tx0 := core.NewTransactionWithFee(pv1, pb2, []byte("test0"), 100, 10, 0)
+	tx1 := core.NewTransactionWithFee(pv1, pb2, []byte("test1"), 100, 100, 1)
+	pool.Add([]*core.Transaction{tx0, tx1})
+
+	// 手续费只提高了5% 不足以替换
+	low := core.NewTransactionWithFee(pv1, pb2, []byte("low"), 100, 105, 1)
+	if err := pool.Add([]*core.Transaction{low}); !errors.Is(err, core.ErrReplaceUnderpriced) {
+		t.Errorf("期望返回ErrReplaceUnderpriced，实际为%v", err)
+	}
+
+	// 手续费提高10%可以替换
+	bumped := core.NewTransactionWithFee(pv1, pb2, []byte("bumped"), 100, 110, 1)
+	if err := pool.Add([]*core.Transaction{bumped}); err != nil {
+		t.Fatalf("替换交易失败：%v", err)
+	}
+	if pool.Get(tx1.CalHash()) != nil {
+		t.Error("被替换的交易应该从交易池中删除")
+	}
+	if pool.Get(bumped.CalHash()) == nil {
+		t.Error("替换后的交易应该在交易池中")
+	}
+	if pool.GetAllSize() != 2 || pool.GetPendingSize() != 2 {
+		t.Errorf("替换后交易数量不应改变，all为%d，pending为%d", pool.GetAllSize(), pool.GetPendingSize())
+	}
+	pendingTxs := pool.GetPendingTxs()
+	if pendingTxs[0] != tx0 || pendingTxs[1] != bumped {
+		t.Error("替换后的交易应该保持原来的nonce顺序")
+	}
+}
+
+func TestTxPoolReplaceFeeOverflow(t *testing.T) {
+	pool := core.NewTxPool(100, 50, core.WithPriceBump(10))
+
+	pv1, _ := cryptoo.GeneratePrivateKey()
+	pv2, _ := cryptoo.GeneratePrivateKey()
+	pb2 := pv2.GetPublicKey()
+
+	// 原交易的手续费乘以110会溢出 新交易只多了1 仍然不足以替换
+	fee := uint64(math.MaxUint64 / 105)
+	tx := core.NewTransactionWithFee(pv1, pb2, []byte("test"), 0, fee, 0)
+	if err := pool.Add([]*core.Transaction{tx}); err != nil {
+		t.Fatalf("添加交易失败：%v", err)
+	}
+	low := core.NewTransactionWithFee(pv1, pb2, []byte("low"), 0, fee+1, 0)
+	if err := pool.Add([]*core.Transaction{low}); !errors.Is(err, core.ErrReplaceUnderpriced) {
+		t.Errorf("期望返回ErrReplaceUnderpriced，实际为%v", err)
+	}
+	if pool.Get(tx.CalHash()) == nil {
+		t.Error("原交易不应该被替换")
+	}
+}
+
+func TestTxPoolReplaceChecksPendingCost(t *testing.T) {
+	pv1, _ := cryptoo.GeneratePrivateKey()
+	pv2, _ := cryptoo.GeneratePrivateKey()
+	pb2 := pv2.GetPublicKey()
+	from := pv1.GetPublicKey().Address()
+
+	state := core.NewAccountState()
+	state.CreateAccount(from, &core.Account{Address: from, Balance: 1000})
+	pool := core.NewTxPool(100, 50, core.WithStateProvider(func() core.StateReader {
+		return state
+	}))
+
+	tx0 := core.NewTransactionWithFee(pv1, pb2, []byte("test0"), 100, 10, 0)
+	tx1 := core.NewTransactionWithFee(pv1, pb2, []byte("test1"), 100, 100, 1)
+	if err := pool.Add([]*core.Transaction{tx0, tx1}); err != nil {
+		t.Fatalf("添加交易失败：%v", err)
+	}
+
+	// 替换交易本身付得起 但加上pending中的其他交易之后超过余额
+	expensive := core.NewTransactionWithFee(pv1, pb2, []byte("expensive"), 100, 900, 0)
+	if err := pool.Add([]*core.Transaction{expensive}); !errors.Is(err, core.ErrInsufficientFunds) {
+		t.Errorf("期望返回ErrInsufficientFunds，实际为%v", err)
+	}
+	if pool.Get(tx0.CalHash()) == nil || pool.GetPendingSize() != 2 {
+		t.Error("替换失败时原交易应该保留在pending中")
+	}
+
+	// 替换后总花费不超过余额时可以替换
+	bumped := core.NewTransactionWithFee(pv1, pb2, []byte("bumped"), 100, 500, 0)
+	if err := pool.Add([]*core.Transaction{bumped}); err != nil {
+		t.Errorf("替换交易失败：%v", err)
+	}
+}
+
+func TestTxPoolAdmissionChecks(t *testing.T) {
+	pv1, _ := cryptoo.GeneratePrivateKey()
+	pv2, _ := cryptoo.GeneratePrivateKey()
+	pb2 := pv2.GetPublicKey()
+	from := pv1.GetPublicKey().Address()
+
+	state := core.NewAccountState()
+	state.CreateAccount(from, &core.Account{Address: from, Balance: 1000, Nonce: 1})
+	pool := core.NewTxPool(100, 50, core.WithStateProvider(func() core.StateReader {
+		return state
+	}))
+
+	// 签名无效
+	badSig := core.NewTransaction(pv1, pb2, []byte("bad"), 100, 1)
+	badSig.Value = 200
+	if err := pool.Add([]*core.Transaction{badSig}); !errors.Is(err, core.ErrInvalidSignature) {
+		t.Errorf("期望返回ErrInvalidSignature，实际为%v", err)
+	}
+
+	// 链ID不匹配
+	otherChain := &core.Transaction{ChainID: 2, From: pv1.GetPublicKey(), To: pb2, Value: 100, Nonce: 1}
+	if err := pool.Add([]*core.Transaction{otherChain}); !errors.Is(err, core.ErrInvalidChainID) {
+		t.Errorf("期望返回ErrInvalidChainID，实际为%v", err)
+	}
+
+	// 余额不足以支付金额和手续费
+	tooExpensive := core.NewTransactionWithFee(pv1, pb2, []byte("expensive"), 1000, 1, 1)
+	if err := pool.Add([]*core.Transaction{tooExpensive}); !errors.Is(err, core.ErrInsufficientFunds) {
+		t.Errorf("期望返回ErrInsufficientFunds，实际为%v", err)
+	}
+
+	// nonce过低
+	stale := core.NewTransaction(pv1, pb2, []byte("stale"), 100, 0)
+	if err := pool.Add([]*core.Transaction{stale}); !errors.Is(err, core.ErrNonceTooLow) {
+		t.Errorf("期望返回ErrNonceTooLow，实际为%v", err)
+	}
+
+	for _, err := range []error{core.ErrInvalidSignature, core.ErrInvalidChainID, core.ErrInsufficientFunds, core.ErrNonceTooLow} {
+		if !core.IsInvalidTxErr(err) {
+			t.Errorf("%v应该被认为是无效交易错误", err)
+		}
+	}
+	if core.IsInvalidTxErr(core.ErrPoolIsFull) {
+		t.Error("交易池已满不应该被认为是无效交易错误")
+	}
+
+	// 正常交易
+	valid := core.NewTransactionWithFee(pv1, pb2, []byte("valid"), 500, 10, 1)
+	if err := pool.Add([]*core.Transaction{valid}); err != nil {
+		t.Fatalf("添加有效交易失败：%v", err)
+	}
+	// 余额只够支付第一笔交易 第二笔只能留在queue中
+	next := core.NewTransactionWithFee(pv1, pb2, []byte("next"), 500, 10, 2)
+	if err := pool.Add([]*core.Transaction{next}); err != nil {
+		t.Fatalf("添加交易失败：%v", err)
+	}
+	if pool.GetPendingSize() != 1 {
+		t.Errorf("余额不足以支付所有交易时pending应为1，实际为%d", pool.GetPendingSize())
+	}
+
+	// 新区块上链后余额减少 重新校验时删除无法支付的交易
+	if err := state.Transfer(from, pb2.Address(), 600); err != nil {
+		t.Fatalf("转账失败：%v", err)
+	}
+	pool.Reset(state)
+	if pool.GetAllSize() != 0 {
+		t.Errorf("余额不足的交易应该被删除，剩余%d个交易", pool.GetAllSize())
+	}
+}
+
+func TestTxPoolRejectsCostOverflow(t *testing.T) {
+	funded, _ := cryptoo.GeneratePrivateKey()
+	attacker, _ := cryptoo.GeneratePrivateKey()
+	to, _ := cryptoo.GeneratePrivateKey()
+	from := funded.GetPublicKey().Address()
+
+	state := core.NewAccountState()
+	state.CreateAccount(from, &core.Account{Address: from, Balance: 1000})
+	pool := core.NewTxPool(1, 1, core.WithStateProvider(func() core.StateReader {
+		return state
+	}))
+
+	tx := core.NewTransactionWithFee(funded, to.GetPublicKey(), nil, 100, 10, 0)
+	if err := pool.Add([]*core.Transaction{tx}); err != nil {
+		t.Fatalf("添加交易失败：%v", err)
+	}
+
+	// 没有余额的账户构造金额和手续费之和溢出的交易 不能绕过余额检查挤掉已有的交易
+	overflow := core.NewTransactionWithFee(attacker, to.GetPublicKey(), nil, 1, math.MaxUint64, 0)
+	if overflow.Cost() != math.MaxUint64 {
+		t.Errorf("溢出的交易花费应为math.MaxUint64，实际为%d", overflow.Cost())
+	}
+	if err := pool.Add([]*core.Transaction{overflow}); !errors.Is(err, core.ErrCostOverflow) {
+		t.Errorf("期望返回ErrCostOverflow，实际为%v", err)
+	}
+	if !core.IsInvalidTxErr(core.ErrCostOverflow) {
+		t.Error("ErrCostOverflow应该被认为是无效交易错误")
+	}
+	if pool.Get(tx.CalHash()) == nil || pool.GetPendingSize() != 1 {
+		t.Error("有余额的交易不应该被挤出交易池")
+	}
+}
+
+func TestTxPoolEvictExpired(t *testing.T) {
+	// 到达时间使用交易池的时钟 与淘汰时传入的时间一致
+	now := time.Unix(1000, 0)
+	pool := core.NewTxPool(100, 50, core.WithTxLifetime(time.Minute), core.WithPoolClock(func() time.Time {
+		return now
+	}))
+
+	pv1, _ := cryptoo.GeneratePrivateKey()
+	pv2, _ := cryptoo.GeneratePrivateKey()
+	pb2 := pv2.GetPublicKey()
+
+	tx0 := core.NewTransaction(pv1, pb2, []byte("test0"), 100, 0)
+	tx1 := core.NewTransaction(pv1, pb2, []byte("test1"), 100, 1)
+	pool.Add([]*core.Transaction{tx0, tx1})
+
+	if evicted := pool.EvictExpired(now.Add(30 * time.Second)); len(evicted) != 0 {
+		t.Errorf("未过期的交易不应该被删除，删除了%d个", len(evicted))
+	}
+	evicted := pool.EvictExpired(now.Add(2 * time.Minute))
+	if len(evicted) != 2 {
+		t.Errorf("期望删除2个过期交易，实际为%d", len(evicted))
+	}
+	if pool.GetAllSize() != 0 || pool.GetPendingSize() != 0 {
+		t.Errorf("过期交易应该从all和pending中删除，all为%d，pending为%d", pool.GetAllSize(), pool.GetPendingSize())
+	}
+}
+
+func TestTxPoolValidUntilHeight(t *testing.T) {
+	height := uint32(5)
+	pool := core.NewTxPool(100, 50, core.WithHeightProvider(func() uint32 {
+		return height
+	}))
+
+	pv1, _ := cryptoo.GeneratePrivateKey()
+	pv2, _ := cryptoo.GeneratePrivateKey()
+	pb2 := pv2.GetPublicKey()
+
+	newTx := func(nonce int64, validUntil uint32) *core.Transaction {
+		tx := core.NewTransaction(pv1, pb2, []byte("test"), 100, nonce)
+		tx.ValidUntilHeight = validUntil
+		tx.Sign(pv1)
+		return tx
+	}
+
+	// 已经无法进入下一个区块的交易会被拒绝
+	if err := pool.Add([]*core.Transaction{newTx(0, 5)}); !errors.Is(err, core.ErrTxExpired) {
+		t.Errorf("期望返回ErrTxExpired，实际为%v", err)
+	}
+
+	tx0 := newTx(0, 6)
+	tx1 := newTx(1, 0)
+	if err := pool.Add([]*core.Transaction{tx0, tx1}); err != nil {
+		t.Fatalf("添加交易失败：%v", err)
+	}
+
+	// 链增长后tx0过期 tx1因为nonce不再连续退回queue
+	height = 6
+	evicted := pool.EvictExpired(time.Now())
+	if len(evicted) != 1 || evicted[0] != tx0 {
+		t.Fatal("期望只删除tx0")
+	}
+	if pool.GetPendingSize() != 0 {
+		t.Errorf("前面的交易过期后tx1不应该在pending中，pending为%d", pool.GetPendingSize())
+	}
+	if pool.Get(tx1.CalHash()) == nil {
+		t.Error("tx1应该仍然在交易池中")
+	}
+}
+
+func TestTxPoolAccountSlots(t *testing.T) {
+	pv1, _ := cryptoo.GeneratePrivateKey()
+	pv2, _ := cryptoo.GeneratePrivateKey()
+	pool := core.NewTxPool(100, 50, core.WithAccountSlots(3))
+
+	for i := 0; i < 3; i++ {
+		tx := core.NewTransaction(pv1, pv2.GetPublicKey(), []byte("slot"), 100, int64(i))
+		if err := pool.Add([]*core.Transaction{tx}); err != nil {
+			t.Fatalf("添加交易失败: %v", err)
+		}
+	}
+
+	// 超过发送者的交易数量上限
+	tx := core.NewTransaction(pv1, pv2.GetPublicKey(), []byte("slot"), 100, 3)
+	if err := pool.Add([]*core.Transaction{tx}); !errors.Is(err, core.ErrAccountSlotsFull) {
+		t.Errorf("期望错误 %v, 实际为 %v", core.ErrAccountSlotsFull, err)
+	}
+
+	// 替换已有交易不受上限影响
+	replacement := core.NewTransactionWithFee(pv1, pv2.GetPublicKey(), []byte("slot"), 100, 10, 2)
+	if err := pool.Add([]*core.Transaction{replacement}); err != nil {
+		t.Errorf("替换交易失败: %v", err)
+	}
+
+	// 其他发送者不受影响
+	other := core.NewTransaction(pv2, pv1.GetPublicKey(), []byte("slot"), 100, 0)
+	if err := pool.Add([]*core.Transaction{other}); err != nil {
+		t.Errorf("添加其他发送者的交易失败: %v", err)
+	}
+}
+
+func TestTxPoolRejectsConfirmedTxs(t *testing.T) {
+	bc := core.NewBlockchain()
+	pv1, pv2 := buildChain(t, bc, 1)
+	confirmed := bc.GetLatestBlock().Transactions[0]
+	if !bc.HasTransaction(confirmed.CalHash()) {
+		t.Fatalf("链上应该存在已打包的交易")
+	}
+
+	pool := core.NewTxPool(100, 50, core.WithTxIndex(bc.HasTransaction))
+	if err := pool.Add([]*core.Transaction{confirmed}); !errors.Is(err, core.ErrTxAlreadyKnown) {
+		t.Errorf("期望错误 %v, 实际为 %v", core.ErrTxAlreadyKnown, err)
+	}
+
+	tx := core.NewTransaction(pv1, pv2.GetPublicKey(), []byte("new"), 100, 0)
+	if bc.HasTransaction(tx.CalHash()) {
+		t.Errorf("未上链的交易不应该存在于链上")
+	}
+	if err := pool.Add([]*core.Transaction{tx}); err != nil {
+		t.Errorf("添加未上链的交易失败: %v", err)
+	}
+}
+
+func TestTxSortedStoreRemove(t *testing.T) {
+	pv1, _ := cryptoo.GeneratePrivateKey()
+	pb2 := pv1.GetPublicKey()
+	store := core.NewTxSortedStore(50)
+
+	txs := make([]*core.Transaction, 0, 50)
+	for i := 0; i < 50; i++ {
+		tx := core.NewTransactionWithFee(pv1, pb2, nil, 0, uint64(i), int64(i))
+		txs = append(txs, tx)
+		store.Add(tx)
+	}
+	// 删除手续费为偶数的交易 剩下的交易仍然保持堆的顺序
+	for i := 0; i < 50; i += 2 {
+		store.Remove(txs[i])
+	}
+	store.Remove(txs[0])
+	if store.Len() != 25 {
+		t.Fatalf("期望剩下25个交易，实际为%d", store.Len())
+	}
+	for i := 0; i < 50; i++ {
+		if (store.Get(txs[i].CalHash()) != nil) != (i%2 == 1) {
+			t.Errorf("交易%d的删除结果不正确", i)
+		}
+	}
+
+	// 填满之后淘汰的是剩下的交易中手续费最低的
+	for i := 50; i < 75; i++ {
+		if added, evicted := store.Add(core.NewTransactionWithFee(pv1, pb2, nil, 0, uint64(i), int64(i))); !added || evicted != nil {
+			t.Fatalf("存储未满时交易%d应该直接加入", i)
+		}
+	}
+	added, evicted := store.Add(core.NewTransactionWithFee(pv1, pb2, nil, 0, 100, 100))
+	if !added || evicted != txs[1] {
+		t.Errorf("期望淘汰手续费最低的交易")
+	}
+}
@@ -0,0 +1,82 @@
+package test
+
+import (
+	"go-chain/core"
+	"go-chain/cryptoo"
+	"testing"
+)
+
+// buildChain 在区块链上添加创世区块和n个转账区块 返回转账的双方
+func buildChain(t *testing.T, bc *core.Blockchain, n int) (*cryptoo.PrivateKey, *cryptoo.PrivateKey) {
+	pv1, _ := cryptoo.GeneratePrivateKey()
+	pv2, _ := cryptoo.GeneratePrivateKey()
+	bc.GetAccountState().CreateAccount(pv1.GetPublicKey().Address(), &core.Account{
+		Address: pv1.GetPublicKey().Address(),
+		Balance: 1000000,
+	})
+	bc.AddBlockWithoutValidation(core.NewGenesisBlock())
+
+	for i := 1; i <= n; i++ {
+		tx := core.NewTransaction(pv1, pv2.GetPublicKey(), []byte("transaction"), 100, int64(i-1))
+		block := core.NewBlock(bc.GetLatestBlock().Hash(), uint32(i), []*core.Transaction{tx})
+		if err := bc.AddBlock(block); err != nil {
+			t.Fatalf("添加第%d个区块失败：%v", i, err)
+		}
+	}
+	return pv1, pv2
+}
+
+func TestArchiveModeKeepsAllBlocks(t *testing.T) {
+	bc := core.NewBlockchain()
+	buildChain(t, bc, 5)
+
+	blocks, err := bc.GetRangeBlocks(1, 5)
+	if err != nil {
+		t.Fatalf("归档模式下获取区块失败：%v", err)
+	}
+	if len(blocks) != 5 {
+		t.Errorf("期望获取5个区块，实际为%d", len(blocks))
+	}
+}
+
+func TestPruneBlocks(t *testing.T) {
+	bc := core.NewBlockchain(
+		core.WithSnapshotInterval(0),
+		core.WithPruneConfig(core.PruneConfig{Mode: core.PruneModeBlocks, KeepBlocks: 2}),
+	)
+	buildChain(t, bc, 5)
+
+	if _, err := bc.GetBlock(3); err != core.ErrBlockPruned {
+		t.Errorf("期望返回ErrBlockPruned，实际为%v", err)
+	}
+	if _, err := bc.GetBlock(4); err != nil {
+		t.Errorf("最近的区块不应该被裁剪：%v", err)
+	}
+	if _, err := bc.GetRangeBlocks(1, 5); err != core.ErrBlockPruned {
+		t.Errorf("期望返回ErrBlockPruned，实际为%v", err)
+	}
+	if _, err := bc.GetBlock(10); err != core.ErrBlockNotFound {
+		t.Errorf("超出高度时期望返回ErrBlockNotFound，实际为%v", err)
+	}
+
+	from, to := bc.ServableRange()
+	if from != 4 || to != 5 {
+		t.Errorf("期望可提供范围为[4, 5]，实际为[%d, %d]", from, to)
+	}
+}
+
+func TestPruneKeepsSnapshotAnchor(t *testing.T) {
+	bc := core.NewBlockchain(
+		core.WithSnapshotInterval(3),
+		core.WithPruneConfig(core.PruneConfig{Mode: core.PruneModeBlocks, KeepBlocks: 1}),
+	)
+	buildChain(t, bc, 5)
+
+	snap, err := bc.GetLatestSnapshot()
+	if err != nil {
+		t.Fatalf("获取快照失败：%v", err)
+	}
+	if _, err := bc.GetBlock(snap.Height); err != nil {
+		t.Errorf("最新快照的锚定区块不应该被裁剪：%v", err)
+	}
+}
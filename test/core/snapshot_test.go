@@ -0,0 +1,184 @@
+package test
+
+import (
+	"go-chain/core"
+	"go-chain/cryptoo"
+	"go-chain/types"
+	"testing"
+)
+
+func TestStateRootDeterministic(t *testing.T) {
+	as1 := core.NewAccountState()
+	as2 := core.NewAccountState()
+	addr1 := types.Address{0x1}
+	addr2 := types.Address{0x2}
+
+	// 以不同的顺序创建账户 状态根应该一致
+	as1.CreateAccount(addr1, &core.Account{Address: addr1, Balance: 100})
+	as1.CreateAccount(addr2, &core.Account{Address: addr2, Balance: 200})
+	as2.CreateAccount(addr2, &core.Account{Address: addr2, Balance: 200})
+	as2.CreateAccount(addr1, &core.Account{Address: addr1, Balance: 100})
+
+	if as1.StateRoot() != as2.StateRoot() {
+		t.Error("相同的账户状态应该有相同的状态根")
+	}
+
+	if err := as1.Transfer(addr1, addr2, 10); err != nil {
+		t.Fatalf("转账失败：%v", err)
+	}
+	if as1.StateRoot() == as2.StateRoot() {
+		t.Error("账户状态变化后状态根应该改变")
+	}
+}
+
+func TestSnapshotChunks(t *testing.T) {
+	accounts := make([]*core.Account, 0)
+	for i := 0; i < 10; i++ {
+		accounts = append(accounts, &core.Account{Address: types.Address{byte(i + 1)}, Balance: uint64(i)})
+	}
+	snap := &core.StateSnapshot{
+		StateRoot: core.CalculateStateRoot(accounts),
+		Accounts:  accounts,
+	}
+
+	if snap.ChunkCount(4) != 3 {
+		t.Errorf("期望分块数量为3，实际为%d", snap.ChunkCount(4))
+	}
+	collected := make([]*core.Account, 0)
+	for i := uint32(0); i < snap.ChunkCount(4); i++ {
+		collected = append(collected, snap.Chunk(i, 4)...)
+	}
+	if core.CalculateStateRoot(collected) != snap.StateRoot {
+		t.Error("分块合并后的状态根应该与快照一致")
+	}
+	if err := snap.Verify(); err != nil {
+		t.Errorf("快照校验失败：%v", err)
+	}
+}
+
+func TestTakeAndApplySnapshot(t *testing.T) {
+	bc := core.NewBlockchain(core.WithSnapshotInterval(2))
+
+	pv1, _ := cryptoo.GeneratePrivateKey()
+	pv2, _ := cryptoo.GeneratePrivateKey()
+	pb2 := pv2.GetPublicKey()
+
+	bc.GetAccountState().CreateAccount(pv1.GetPublicKey().Address(), &core.Account{
+		Address: pv1.GetPublicKey().Address(),
+		Balance: 1000,
+	})
+	bc.AddBlockWithoutValidation(core.NewGenesisBlock())
+
+	// 通过BlockBuilder出块 区块头中承诺了状态根
+	pool := core.NewTxPool(100, 50, core.WithStateProvider(func() core.StateReader {
+		return bc.GetAccountState()
+	}))
+	builder := core.NewBlockBuilder(bc, pool)
+	for i := 1; i <= 3; i++ {
+		tx := core.NewTransaction(pv1, pb2, []byte("transaction"), 100, int64(i-1))
+		if err := pool.Add([]*core.Transaction{tx}); err != nil {
+			t.Fatalf("添加交易失败：%v", err)
+		}
+		block, err := builder.Build()
+		if err != nil {
+			t.Fatalf("生成第%d个区块失败：%v", i, err)
+		}
+		if err := bc.AddBlock(block); err != nil {
+			t.Fatalf("添加第%d个区块失败：%v", i, err)
+		}
+		pool.Reset(bc.GetAccountState())
+	}
+
+	// 高度2时应该生成快照
+	snap, err := bc.GetLatestSnapshot()
+	if err != nil {
+		t.Fatalf("获取快照失败：%v", err)
+	}
+	if snap.Height != 2 {
+		t.Errorf("期望快照高度为2，实际为%d", snap.Height)
+	}
+	anchor, _ := bc.GetBlock(snap.Height)
+	headers, err := bc.GetHeaders(1, snap.Height)
+	if err != nil {
+		t.Fatalf("获取区块头失败：%v", err)
+	}
+
+	// 新节点从快照恢复
+	fresh := core.NewBlockchain()
+	fresh.AddBlockWithoutValidation(core.NewGenesisBlock())
+	if err := fresh.ApplySnapshot(snap, headers, anchor); err != nil {
+		t.Fatalf("应用快照失败：%v", err)
+	}
+	if fresh.Height() != 2 {
+		t.Errorf("期望恢复后的高度为2，实际为%d", fresh.Height())
+	}
+	if fresh.GetAccountState().GetBalance(pb2.Address()) != 200 {
+		t.Errorf("恢复后的余额不正确，实际为%d", fresh.GetAccountState().GetBalance(pb2.Address()))
+	}
+	if _, err := fresh.GetBlock(1); err == nil {
+		t.Error("快照之前的区块不应该存在")
+	}
+	if header, err := fresh.GetHeader(1); err != nil || header.DataHash != headers[0].DataHash {
+		t.Error("快照之前的区块头应该保留")
+	}
+
+	// 快照之后的区块可以直接接上
+	block3, _ := bc.GetBlock(3)
+	if err := fresh.AddBlock(core.NewBlock(block3.GetPrevBlockHash(), 3, []*core.Transaction{})); err != nil {
+		t.Fatalf("快照之后添加区块失败：%v", err)
+	}
+
+	// 状态根不匹配时应该拒绝
+	bad := &core.StateSnapshot{
+		Height:    snap.Height,
+		BlockHash: snap.BlockHash,
+		StateRoot: types.RandomHash(),
+		Accounts:  snap.Accounts,
+	}
+	if err := newGenesisChain().ApplySnapshot(bad, headers, anchor); err != core.ErrSnapshotRootMismatch {
+		t.Errorf("期望返回ErrSnapshotRootMismatch，实际为%v", err)
+	}
+
+	// 账户和状态根自洽 但与区块头承诺的状态根不一致
+	forged := []*core.Account{{Address: pb2.Address(), Balance: 1 << 40}}
+	fake := &core.StateSnapshot{
+		Height:    snap.Height,
+		BlockHash: snap.BlockHash,
+		StateRoot: core.CalculateStateRoot(forged),
+		Accounts:  forged,
+	}
+	if err := newGenesisChain().ApplySnapshot(fake, headers, anchor); err != core.ErrSnapshotRootMismatch {
+		t.Errorf("期望返回ErrSnapshotRootMismatch，实际为%v", err)
+	}
+
+	// 区块头必须从创世区块开始首尾相连
+	if err := newGenesisChain().ApplySnapshot(snap, headers[1:], anchor); err != core.ErrInvalidHeaderChain {
+		t.Errorf("期望返回ErrInvalidHeaderChain，实际为%v", err)
+	}
+	tampered := *headers[0]
+	tampered.PrevBlockHash = types.RandomHash()
+	if err := newGenesisChain().ApplySnapshot(snap, []*core.BlockHeader{&tampered, headers[1]}, anchor); err != core.ErrInvalidHeaderChain {
+		t.Errorf("期望返回ErrInvalidHeaderChain，实际为%v", err)
+	}
+
+	// 区块头的哈希覆盖了状态根 修改中间区块头的状态根后无法与后面的区块头相连
+	rerooted := *headers[0]
+	rerooted.StateRoot = types.RandomHash()
+	if err := core.VerifyHeaderChain(nil, []*core.BlockHeader{&rerooted, headers[1]}); err != core.ErrInvalidHeaderChain {
+		t.Errorf("期望返回ErrInvalidHeaderChain，实际为%v", err)
+	}
+
+	// 修改最后一个区块头的状态根来匹配伪造的快照 区块哈希与快照记录的不一致
+	forgedTip := *headers[1]
+	forgedTip.StateRoot = fake.StateRoot
+	forgedAnchor := &core.Block{Header: &forgedTip, Transactions: anchor.Transactions}
+	if err := newGenesisChain().ApplySnapshot(fake, []*core.BlockHeader{headers[0], &forgedTip}, forgedAnchor); err != core.ErrSnapshotAnchorInvalid {
+		t.Errorf("期望返回ErrSnapshotAnchorInvalid，实际为%v", err)
+	}
+}
+
+func newGenesisChain() *core.Blockchain {
+	bc := core.NewBlockchain()
+	bc.AddBlockWithoutValidation(core.NewGenesisBlock())
+	return bc
+}
@@ -0,0 +1,136 @@
+package test
+
+import (
+	"go-chain/core"
+	"sync"
+	"testing"
+)
+
+func TestStateAt(t *testing.T) {
+	bc := core.NewBlockchain()
+	pv1, pv2 := buildChain(t, bc, 5)
+	from := pv1.GetPublicKey().Address()
+	to := pv2.GetPublicKey().Address()
+
+	for h := uint32(0); h <= 5; h++ {
+		state, err := bc.StateAt(h)
+		if err != nil {
+			t.Fatalf("获取高度%d的状态失败：%v", h, err)
+		}
+		if state.GetBalance(to) != uint64(100*h) {
+			t.Errorf("高度%d时接收方余额应为%d，实际为%d", h, 100*h, state.GetBalance(to))
+		}
+		if state.GetBalance(from) != 1000000-uint64(100*h) {
+			t.Errorf("高度%d时发送方余额不正确，实际为%d", h, state.GetBalance(from))
+		}
+	}
+
+	// 接收方账户在第一个区块之前不存在
+	state, _ := bc.StateAt(0)
+	if state.GetAccount(to) != nil {
+		t.Error("高度0时接收方账户不应该存在")
+	}
+
+	// 最新高度的状态与当前状态一致
+	state, _ = bc.StateAt(5)
+	if state.StateRoot() != bc.GetAccountState().StateRoot() {
+		t.Error("最新高度的状态根应该与当前状态一致")
+	}
+
+	if _, err := bc.StateAt(6); err != core.ErrBlockNotFound {
+		t.Errorf("超出高度时期望返回ErrBlockNotFound，实际为%v", err)
+	}
+}
+
+func TestStateAtPruned(t *testing.T) {
+	bc := core.NewBlockchain(core.WithPruneConfig(core.PruneConfig{
+		Mode:      core.PruneModeState,
+		KeepDiffs: 2,
+	}))
+	_, pv2 := buildChain(t, bc, 5)
+
+	if _, err := bc.StateAt(2); err != core.ErrStatePruned {
+		t.Errorf("期望返回ErrStatePruned，实际为%v", err)
+	}
+	state, err := bc.StateAt(3)
+	if err != nil {
+		t.Fatalf("获取保留高度的状态失败：%v", err)
+	}
+	if state.GetBalance(pv2.GetPublicKey().Address()) != 300 {
+		t.Errorf("高度3时接收方余额应为300，实际为%d", state.GetBalance(pv2.GetPublicKey().Address()))
+	}
+}
+
+func TestRevertState(t *testing.T) {
+	bc := core.NewBlockchain()
+	pv1, pv2 := buildChain(t, bc, 5)
+
+	expected, _ := bc.StateAt(2)
+	if err := bc.RevertState(3); err != nil {
+		t.Fatalf("回滚状态失败：%v", err)
+	}
+	if bc.GetAccountState().StateRoot() != expected.StateRoot() {
+		t.Error("回滚后的状态应该与高度2的状态一致")
+	}
+	if bc.GetAccountState().GetNonce(pv1.GetPublicKey().Address()) != 2 {
+		t.Errorf("回滚后发送方nonce应为2，实际为%d", bc.GetAccountState().GetNonce(pv1.GetPublicKey().Address()))
+	}
+	if bc.GetAccountState().GetBalance(pv2.GetPublicKey().Address()) != 200 {
+		t.Errorf("回滚后接收方余额应为200，实际为%d", bc.GetAccountState().GetBalance(pv2.GetPublicKey().Address()))
+	}
+}
+
+func TestStateAtDuringAddBlock(t *testing.T) {
+	bc := core.NewBlockchain(core.WithSnapshotInterval(0))
+	pv1, pv2 := buildChain(t, bc, 1)
+	to := pv2.GetPublicKey().Address()
+
+	// 提前生成区块 添加区块时不需要再签名
+	var blocks []*core.Block
+	prev := bc.GetLatestBlock()
+	for i := 2; i <= 500; i++ {
+		tx := core.NewTransaction(pv1, pv2.GetPublicKey(), []byte("transaction"), 100, int64(i-1))
+		prev = core.NewBlock(prev.Hash(), uint32(i), []*core.Transaction{tx})
+		blocks = append(blocks, prev)
+	}
+
+	// 一边添加区块一边读取最新高度的状态 读到的状态不能受到之后的新区块的影响
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(done)
+		for _, block := range blocks {
+			if err := bc.AddBlock(block); err != nil {
+				t.Errorf("添加第%d个区块失败：%v", block.Height(), err)
+				return
+			}
+		}
+	}()
+
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				h := bc.Height()
+				state, err := bc.StateAt(h)
+				if err != nil {
+					t.Errorf("获取高度%d的状态失败：%v", h, err)
+					return
+				}
+				if state.GetBalance(to) != uint64(100*h) {
+					t.Errorf("高度%d时接收方余额应为%d，实际为%d", h, 100*h, state.GetBalance(to))
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
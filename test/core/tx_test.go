@@ -89,3 +89,17 @@ func TestTransaction_VerifyTransaction(t *testing.T) {
 	assert.False(t, tx.Verify())
 }
 
+
+func TestTransaction_FeeInHash(t *testing.T) {
+	fromPrivKey, _ := cryptoo.GeneratePrivateKey()
+	toPrivKey, _ := cryptoo.GeneratePrivateKey()
+	toPubKey := toPrivKey.GetPublicKey()
+
+	tx := core.NewTransactionWithFee(fromPrivKey, toPubKey, []byte("测试数据"), 100, 5, 1)
+	assert.True(t, tx.Verify())
+	assert.Equal(t, uint64(105), tx.Cost())
+
+	// 修改手续费后签名失效
+	tx.Fee = 1
+	assert.False(t, tx.Verify())
+}
@@ -0,0 +1,99 @@
+package network
+
+import (
+	"context"
+	"go-chain/network"
+	"io"
+	"log"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddrBookPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peers.dat")
+	now := time.Unix(1700000000, 0)
+
+	book := network.NewAddrBook(path)
+	assert.True(t, book.Add("10.0.0.1:9977", "10.0.0.2:9977"))
+	assert.False(t, book.Add("10.0.0.1:9977", "10.0.0.3:9977"))
+	book.Good("10.0.0.2:9977", now)
+	book.Add("10.0.0.3:9977", "")
+	book.Attempt("10.0.0.3:9977", now)
+	assert.NoError(t, book.Save())
+
+	loaded := network.NewAddrBook(path)
+	assert.NoError(t, loaded.Load())
+	assert.Equal(t, 3, loaded.Size())
+	ka, ok := loaded.Get("10.0.0.1:9977")
+	assert.True(t, ok)
+	assert.Equal(t, "10.0.0.2:9977", ka.Source)
+	ka, _ = loaded.Get("10.0.0.2:9977")
+	assert.True(t, now.Equal(ka.LastSeen))
+	ka, _ = loaded.Get("10.0.0.3:9977")
+	assert.Equal(t, 1, ka.Attempts)
+
+	// 连接成功的地址排在前面 失败过的地址排在最后
+	assert.Equal(t, []string{"10.0.0.2:9977", "10.0.0.1:9977", "10.0.0.3:9977"}, loaded.Addresses(10))
+	assert.Len(t, loaded.Addresses(1), 1)
+
+	// 连续失败次数过多的地址被删除
+	for i := 0; i < 10; i++ {
+		loaded.Attempt("10.0.0.3:9977", now)
+	}
+	_, ok = loaded.Get("10.0.0.3:9977")
+	assert.False(t, ok)
+}
+
+func TestPeerExchange(t *testing.T) {
+	addrs := []network.NetAddr{"A", "B", "C"}
+	transports := make(map[network.NetAddr]*network.LocalTransport)
+	for _, addr := range addrs {
+		transports[addr] = network.NewLocalTransport(addr)
+	}
+	for i := range addrs {
+		for j := i + 1; j < len(addrs); j++ {
+			transports[addrs[i]].Connect(transports[addrs[j]])
+		}
+	}
+	bookPath := filepath.Join(t.TempDir(), "peers.dat")
+	newServer := func(addr network.NetAddr, seed string, opts ...network.ServerOption) *network.Server {
+		opts = append(opts,
+			network.WithTransport(transports[addr]),
+			network.WithSeedNodes([]string{seed}),
+			network.WithLogger(log.New(io.Discard, "", 0)),
+		)
+		s, err := network.NewServer(*network.NewServerOpts(opts...))
+		assert.NoError(t, err)
+		return s
+	}
+
+	// C只知道B 通过B交换地址后连接到A
+	a := newServer("A", "B")
+	b := newServer("B", "A")
+	c := newServer("C", "B", network.WithAddrBookPath(bookPath))
+	assert.NoError(t, a.Start())
+	assert.NoError(t, b.Start())
+	assert.NoError(t, c.Start())
+	defer a.Stop(context.Background())
+	defer b.Stop(context.Background())
+
+	assert.Eventually(t, func() bool {
+		return a.PeerCount() == 2 && b.PeerCount() == 2 && c.PeerCount() == 2
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// 停止时地址簿写入文件
+	assert.NoError(t, c.Stop(context.Background()))
+	book := network.NewAddrBook(bookPath)
+	assert.NoError(t, book.Load())
+	ka, ok := book.Get("A")
+	assert.True(t, ok)
+	assert.Equal(t, "B", ka.Source)
+	assert.False(t, ka.LastSeen.IsZero())
+	_, ok = book.Get("B")
+	assert.True(t, ok)
+	_, ok = book.Get("C")
+	assert.False(t, ok)
+}
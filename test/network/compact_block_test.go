@@ -0,0 +1,234 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"go-chain/core"
+	"go-chain/cryptoo"
+	"go-chain/inter"
+	"go-chain/network"
+	"go-chain/types"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// expectMessage 读取对方发来的消息 跳过其他类型 直到收到typ类型的消息 返回消息的请求编号
+func expectMessage(t *testing.T, rpcCh <-chan network.RPC, typ network.MessageType, body inter.Codable) uint64 {
+	t.Helper()
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case rpc := <-rpcCh:
+			msg := new(network.Message)
+			assert.NoError(t, msg.Decode(rpc.Payload))
+			if msg.Type != typ {
+				continue
+			}
+			assert.NoError(t, body.Decode(bytes.NewBuffer(msg.Body)))
+			return msg.ID
+		case <-timeout:
+			t.Fatalf("没有收到类型为 %v 的消息", typ)
+		}
+	}
+}
+
+func sendMessage(t *testing.T, peer network.Peer, typ network.MessageType, body inter.Codable) {
+	t.Helper()
+	data, err := network.EncodeMessage(typ, body)
+	assert.NoError(t, err)
+	assert.NoError(t, peer.Send(data))
+}
+
+func TestCompactBlockRelay(t *testing.T) {
+	transport := network.NewLocalTransport("A")
+	remote := network.NewLocalTransport("X")
+	transport.Connect(remote)
+	a := newConnTestServer(t, transport, network.NewSimClock(time.Now()), []string{"X"})
+	sender, _ := cryptoo.GeneratePrivateKey()
+	receiver, _ := cryptoo.GeneratePrivateKey()
+	addr := sender.GetPublicKey().Address()
+	a.Chain().GetAccountState().CreateAccount(addr, &core.Account{Address: addr, Balance: 1000})
+	assert.NoError(t, a.Start())
+	defer a.Stop(context.Background())
+
+	peer, err := remote.Dial("A")
+	assert.NoError(t, err)
+	rpcCh := make(chan network.RPC, 64)
+	go peer.ReceiveLoop(rpcCh)
+	assert.Eventually(t, func() bool {
+		return a.PeerCount() == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// A的交易池中只有第一笔交易
+	var txs []*core.Transaction
+	for nonce := int64(0); nonce < 3; nonce++ {
+		txs = append(txs, core.NewTransaction(sender, receiver.GetPublicKey(), nil, 10, nonce))
+	}
+	assert.NoError(t, a.SubmitTx(txs[0]))
+	expectMessage(t, rpcCh, network.MessageTypeInv, new(network.InvMessage))
+
+	// 区块通告之后A请求紧凑区块
+	block := core.NewBlock(a.Chain().GetLatestBlock().Hash(), 1, txs)
+	hash := block.Hash()
+	sendMessage(t, peer, network.MessageTypeInv, &network.InvMessage{
+		Items: []network.InvVector{{Type: network.InvTypeBlock, Hash: hash}},
+	})
+	getData := new(network.GetDataMessage)
+	expectMessage(t, rpcCh, network.MessageTypeGetData, getData)
+	assert.Equal(t, []network.InvVector{{Type: network.InvTypeCompactBlock, Hash: hash}}, getData.Items)
+
+	// 第二笔交易直接携带 第三笔交易不在交易池中 A只请求缺少的交易
+	sendMessage(t, peer, network.MessageTypeCompactBlock, &network.CompactBlockMessage{
+		Header:    block.Header,
+		ShortIDs:  []uint64{network.ShortTxID(hash, txs[0].CalHash()), network.ShortTxID(hash, txs[2].CalHash())},
+		Prefilled: []network.PrefilledTx{{Index: 1, Tx: txs[1]}},
+	})
+	getTxn := new(network.GetBlockTxnMessage)
+	expectMessage(t, rpcCh, network.MessageTypeGetBlockTxn, getTxn)
+	assert.Equal(t, hash, getTxn.BlockHash)
+	assert.Equal(t, []uint32{2}, getTxn.Indexes)
+
+	sendMessage(t, peer, network.MessageTypeBlockTxn, &network.BlockTxnMessage{
+		BlockHash:    hash,
+		Transactions: []*core.Transaction{txs[2]},
+	})
+	assert.Eventually(t, func() bool {
+		return a.Chain().Height() == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, hash, a.Chain().GetLatestBlock().Hash())
+
+	// A发送紧凑区块时 只有X已经知道的交易使用短ID
+	sendMessage(t, peer, network.MessageTypeGetData, &network.GetDataMessage{
+		Items: []network.InvVector{{Type: network.InvTypeCompactBlock, Hash: hash}},
+	})
+	compact := new(network.CompactBlockMessage)
+	expectMessage(t, rpcCh, network.MessageTypeCompactBlock, compact)
+	assert.Equal(t, hash, compact.Header.Hash())
+	assert.Equal(t, []uint64{network.ShortTxID(hash, txs[0].CalHash())}, compact.ShortIDs)
+	assert.Len(t, compact.Prefilled, 2)
+	assert.Equal(t, uint32(1), compact.Prefilled[0].Index)
+	assert.Equal(t, uint32(2), compact.Prefilled[1].Index)
+
+	sendMessage(t, peer, network.MessageTypeGetBlockTxn, &network.GetBlockTxnMessage{BlockHash: hash, Indexes: []uint32{0}})
+	blockTxn := new(network.BlockTxnMessage)
+	expectMessage(t, rpcCh, network.MessageTypeBlockTxn, blockTxn)
+	assert.Len(t, blockTxn.Transactions, 1)
+	assert.Equal(t, txs[0].CalHash(), blockTxn.Transactions[0].CalHash())
+}
+
+func TestCompactBlockFallsBackToFullBlock(t *testing.T) {
+	transport := network.NewLocalTransport("A")
+	remote := network.NewLocalTransport("X")
+	transport.Connect(remote)
+	a := newConnTestServer(t, transport, network.NewSimClock(time.Now()), []string{"X"})
+	assert.NoError(t, a.Start())
+	defer a.Stop(context.Background())
+
+	peer, err := remote.Dial("A")
+	assert.NoError(t, err)
+	rpcCh := make(chan network.RPC, 64)
+	go peer.ReceiveLoop(rpcCh)
+
+	sender, _ := cryptoo.GeneratePrivateKey()
+	tx := core.NewTransaction(sender, sender.GetPublicKey(), nil, 0, 0)
+	other := core.NewTransaction(sender, sender.GetPublicKey(), []byte("other"), 0, 0)
+	block := core.NewBlock(a.Chain().GetLatestBlock().Hash(), 1, []*core.Transaction{tx})
+	hash := block.Hash()
+
+	// 补齐的交易与区块头不符时 A不扣分 改为请求完整区块
+	sendMessage(t, peer, network.MessageTypeCompactBlock, &network.CompactBlockMessage{
+		Header:   block.Header,
+		ShortIDs: []uint64{network.ShortTxID(hash, tx.CalHash())},
+	})
+	expectMessage(t, rpcCh, network.MessageTypeGetBlockTxn, new(network.GetBlockTxnMessage))
+	sendMessage(t, peer, network.MessageTypeBlockTxn, &network.BlockTxnMessage{
+		BlockHash:    hash,
+		Transactions: []*core.Transaction{other},
+	})
+	getData := new(network.GetDataMessage)
+	id := expectMessage(t, rpcCh, network.MessageTypeGetData, getData)
+	assert.Equal(t, []network.InvVector{{Type: network.InvTypeBlock, Hash: hash}}, getData.Items)
+	assert.Equal(t, uint32(0), a.Chain().Height())
+	assert.Equal(t, float64(100), a.PeerScore("X"))
+
+	data, err := network.EncodeMessageWithID(network.MessageTypeBlock, id, block)
+	assert.NoError(t, err)
+	assert.NoError(t, peer.Send(data))
+	assert.Eventually(t, func() bool {
+		return a.Chain().Height() == 1
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestCompactBlockMismatchedFullBlockIsPenalized(t *testing.T) {
+	transport := network.NewLocalTransport("A")
+	remote := network.NewLocalTransport("X")
+	transport.Connect(remote)
+	a := newConnTestServer(t, transport, network.NewSimClock(time.Now()), []string{"X"})
+	assert.NoError(t, a.Start())
+	defer a.Stop(context.Background())
+
+	peer, err := remote.Dial("A")
+	assert.NoError(t, err)
+	rpcCh := make(chan network.RPC, 64)
+	go peer.ReceiveLoop(rpcCh)
+
+	sender, _ := cryptoo.GeneratePrivateKey()
+	tx := core.NewTransaction(sender, sender.GetPublicKey(), nil, 0, 0)
+	block := core.NewBlock(a.Chain().GetLatestBlock().Hash(), 1, []*core.Transaction{tx})
+
+	// 区块头承诺的交易与携带的交易不符 还原失败后请求完整区块
+	header := *block.Header
+	header.DataHash = types.RandomHash()
+	sendMessage(t, peer, network.MessageTypeCompactBlock, &network.CompactBlockMessage{
+		Header:    &header,
+		Prefilled: []network.PrefilledTx{{Index: 0, Tx: tx}},
+	})
+	id := expectMessage(t, rpcCh, network.MessageTypeGetData, new(network.GetDataMessage))
+
+	// 返回的完整区块与紧凑区块的区块头不一致
+	data, err := network.EncodeMessageWithID(network.MessageTypeBlock, id, block)
+	assert.NoError(t, err)
+	assert.NoError(t, peer.Send(data))
+	assert.Eventually(t, func() bool {
+		return a.PeerScore("X") == 50
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, uint32(0), a.Chain().Height())
+}
+
+func TestCompactBlockPendingLimit(t *testing.T) {
+	clock := network.NewSimClock(time.Now())
+	transport := network.NewLocalTransport("A")
+	remote := network.NewLocalTransport("X")
+	transport.Connect(remote)
+	a := newConnTestServer(t, transport, clock, []string{"X"})
+	assert.NoError(t, a.Start())
+	defer a.Stop(context.Background())
+
+	peer, err := remote.Dial("A")
+	assert.NoError(t, err)
+	rpcCh := make(chan network.RPC, 64)
+	go peer.ReceiveLoop(rpcCh)
+
+	// 每个紧凑区块都缺少交易 需要等待对方补齐
+	sendPartial := func() {
+		block := core.NewBlock(types.RandomHash(), 1, []*core.Transaction{})
+		sendMessage(t, peer, network.MessageTypeCompactBlock, &network.CompactBlockMessage{
+			Header:   block.Header,
+			ShortIDs: []uint64{1},
+		})
+		expectMessage(t, rpcCh, network.MessageTypeGetBlockTxn, new(network.GetBlockTxnMessage))
+	}
+
+	// 同一个节点等待中的区块数量有上限
+	for i := 0; i < 6; i++ {
+		sendPartial()
+	}
+	assert.Equal(t, 4, a.PendingCompactBlocks())
+
+	// 超时的区块被丢弃
+	clock.Advance(11 * time.Second)
+	sendPartial()
+	assert.Equal(t, 1, a.PendingCompactBlocks())
+}
@@ -0,0 +1,105 @@
+package network
+
+import (
+	"context"
+	"go-chain/network"
+	"io"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newConnTestServer(t *testing.T, transport network.Transport, clock network.Clock, seeds []string, opts ...network.ServerOption) *network.Server {
+	opts = append(opts,
+		network.WithTransport(transport),
+		network.WithClock(clock),
+		network.WithSeedNodes(seeds),
+		network.WithMining(false),
+		network.WithLogger(log.New(io.Discard, "", 0)),
+	)
+	s, err := network.NewServer(*network.NewServerOpts(opts...))
+	assert.NoError(t, err)
+	return s
+}
+
+func TestConnManagerReconnects(t *testing.T) {
+	simNet := network.NewSimNetwork(network.NewSimClock(time.Now()), 1, network.LinkConfig{Latency: 10 * time.Millisecond})
+	clock := simNet.Clock()
+
+	// 种子节点B还没有启动时连接失败 之后按退避时间重试
+	a := newConnTestServer(t, simNet.Transport("A"), clock, []string{"B"})
+	bTransport := simNet.Transport("B")
+	assert.NoError(t, a.Start())
+	defer a.Stop(context.Background())
+	simNet.Run(time.Second, simStep)
+	assert.Equal(t, 0, a.PeerCount())
+
+	b := newConnTestServer(t, bTransport, clock, []string{"Z"})
+	assert.NoError(t, b.Start())
+	simNet.Run(20*time.Second, simStep)
+	outbound, inbound := a.PeerCounts()
+	assert.Equal(t, 1, outbound)
+	assert.Equal(t, 0, inbound)
+
+	// B重启后A重新连接
+	assert.NoError(t, b.Stop(context.Background()))
+	simNet.Run(time.Second, simStep)
+	assert.Equal(t, 0, a.PeerCount())
+
+	b = newConnTestServer(t, simNet.Transport("B"), clock, []string{"Z"})
+	assert.NoError(t, b.Start())
+	defer b.Stop(context.Background())
+	simNet.Run(time.Minute, simStep)
+	outbound, _ = a.PeerCounts()
+	assert.Equal(t, 1, outbound)
+	_, inbound = b.PeerCounts()
+	assert.Equal(t, 1, inbound)
+}
+
+func TestConnManagerInboundLimit(t *testing.T) {
+	simNet := network.NewSimNetwork(network.NewSimClock(time.Now()), 1, network.LinkConfig{Latency: 10 * time.Millisecond})
+	clock := simNet.Clock()
+
+	a := newConnTestServer(t, simNet.Transport("A"), clock, []string{"Z"}, network.WithMaxInboundPeers(1))
+	b := newConnTestServer(t, simNet.Transport("B"), clock, []string{"A"})
+	c := newConnTestServer(t, simNet.Transport("C"), clock, []string{"A"})
+	for _, s := range []*network.Server{a, b, c} {
+		assert.NoError(t, s.Start())
+		defer s.Stop(context.Background())
+	}
+	simNet.Run(time.Minute, simStep)
+
+	// A只接受一个被动连接 被拒绝的节点按退避时间重试也不会超过上限
+	outbound, inbound := a.PeerCounts()
+	assert.Equal(t, 0, outbound)
+	assert.Equal(t, 1, inbound)
+}
+
+func TestConnManagerDeduplicatesNodeID(t *testing.T) {
+	clock := network.NewSimClock(time.Now())
+	aTransport, err := network.NewTCPTransport(":39781", nil)
+	assert.NoError(t, err)
+	bTransport, err := network.NewTCPTransport("127.0.0.1:39782", nil)
+	assert.NoError(t, err)
+	// A监听在所有网卡上 两个种子地址指向同一个节点
+	a := newConnTestServer(t, aTransport, clock, []string{"Z"})
+	b := newConnTestServer(t, bTransport, clock, []string{"127.0.0.1:39781", "127.0.0.2:39781"})
+	assert.NoError(t, a.Start())
+	defer a.Stop(context.Background())
+	assert.NoError(t, b.Start())
+	defer b.Stop(context.Background())
+
+	assert.Eventually(t, func() bool {
+		return a.PeerCount() == 1 && b.PeerCount() == 1
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// 重复的地址不再被连接
+	for i := 0; i < 5; i++ {
+		clock.Advance(10 * time.Second)
+		time.Sleep(20 * time.Millisecond)
+	}
+	assert.Equal(t, 1, a.PeerCount())
+	assert.Equal(t, 1, b.PeerCount())
+}
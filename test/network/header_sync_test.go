@@ -0,0 +1,107 @@
+package network
+
+import (
+	"context"
+	"go-chain/core"
+	"go-chain/network"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// extendChain 在parent之后生成n个空区块 nonce不同的区块哈希也不同 用来构造分叉
+func extendChain(parent *core.Block, n int, nonce uint32) []*core.Block {
+	blocks := make([]*core.Block, 0, n)
+	for i := 0; i < n; i++ {
+		block := core.NewBlock(parent.Hash(), parent.Height()+1, []*core.Transaction{})
+		block.Header.Nonce = nonce
+		blocks = append(blocks, block)
+		parent = block
+	}
+	return blocks
+}
+
+// startForkSync 让A的本地链有local个区块 再由X通告一条从创世区块分叉的更长的链
+func startForkSync(t *testing.T, local, remote int) (*network.Server, network.Peer, <-chan network.RPC, []*core.Block) {
+	transport := network.NewLocalTransport("A")
+	remoteTransport := network.NewLocalTransport("X")
+	transport.Connect(remoteTransport)
+	a := newConnTestServer(t, transport, network.NewSimClock(time.Now()), []string{"X"})
+	genesis := a.Chain().GetLatestBlock()
+	for _, block := range extendChain(genesis, local, 0) {
+		assert.NoError(t, a.Chain().AddBlock(block))
+	}
+	assert.NoError(t, a.Start())
+	t.Cleanup(func() { a.Stop(context.Background()) })
+
+	peer, err := remoteTransport.Dial("A")
+	assert.NoError(t, err)
+	rpcCh := make(chan network.RPC, 64)
+	go peer.ReceiveLoop(rpcCh)
+	assert.Eventually(t, func() bool {
+		return a.PeerCount() == 1
+	}, time.Second, 10*time.Millisecond)
+
+	fork := extendChain(genesis, remote, 1)
+	headers := make([]*core.BlockHeader, 0, len(fork))
+	for _, block := range fork {
+		headers = append(headers, block.Header)
+	}
+	sendMessage(t, peer, network.MessageTypeHeaders, &network.HeadersMessage{Headers: headers})
+	return a, peer, rpcCh, fork
+}
+
+// replyBlocks 回复A的区块请求 valid为false时返回与区块头不一致的区块
+func replyBlocks(t *testing.T, peer network.Peer, id uint64, req *network.GetBlocksMessage, fork []*core.Block, valid bool) {
+	t.Helper()
+	blocks := fork[req.From-1 : req.To]
+	if !valid {
+		blocks = blocks[1:]
+	}
+	data, err := network.EncodeMessageWithID(network.MessageTypeBlocks, id, &network.BlocksMessage{Blocks: blocks})
+	assert.NoError(t, err)
+	assert.NoError(t, peer.Send(data))
+}
+
+func TestHeaderSyncReorganizes(t *testing.T) {
+	a, peer, rpcCh, fork := startForkSync(t, 3, 20)
+
+	// 区块分两批下载 全部下载完成后才切换到新的链
+	for i := 0; i < 2; i++ {
+		req := new(network.GetBlocksMessage)
+		id := expectMessage(t, rpcCh, network.MessageTypeGetBlocks, req)
+		replyBlocks(t, peer, id, req, fork, true)
+	}
+	assert.Eventually(t, func() bool {
+		return a.Chain().Height() == 20
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, fork[19].Hash(), a.Chain().GetLatestBlock().Hash())
+}
+
+func TestHeaderSyncKeepsLocalChainOnFailure(t *testing.T) {
+	a, peer, rpcCh, fork := startForkSync(t, 3, 20)
+	tip := a.Chain().GetLatestBlock().Hash()
+
+	// 第一批区块正常返回 第二批与区块头不一致 同步被放弃
+	reqs := make([]*network.GetBlocksMessage, 2)
+	ids := make([]uint64, 2)
+	for i := range reqs {
+		reqs[i] = new(network.GetBlocksMessage)
+		ids[i] = expectMessage(t, rpcCh, network.MessageTypeGetBlocks, reqs[i])
+	}
+	if reqs[0].From != 1 {
+		reqs[0], reqs[1] = reqs[1], reqs[0]
+		ids[0], ids[1] = ids[1], ids[0]
+	}
+	replyBlocks(t, peer, ids[0], reqs[0], fork, true)
+	time.Sleep(50 * time.Millisecond)
+	replyBlocks(t, peer, ids[1], reqs[1], fork, false)
+	assert.Eventually(t, func() bool {
+		return a.PeerScore("X") < 100
+	}, time.Second, 10*time.Millisecond)
+
+	// 本地原来的区块没有被回滚
+	assert.Equal(t, uint32(3), a.Chain().Height())
+	assert.Equal(t, tip, a.Chain().GetLatestBlock().Hash())
+}
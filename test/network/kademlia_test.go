@@ -0,0 +1,197 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"go-chain/network"
+	"go-chain/types"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func xorDistance(a types.Hash, b types.Hash) types.Hash {
+	var d types.Hash
+	for i := range d {
+		d[i] = a[i] ^ b[i]
+	}
+	return d
+}
+
+func TestRoutingTable(t *testing.T) {
+	self := network.NodeKey("self")
+	assert.Equal(t, 0, network.LogDistance(self, self))
+	other := self
+	other[31] ^= 1
+	assert.Equal(t, 1, network.LogDistance(self, other))
+	other[0] ^= 0x80
+	assert.Equal(t, 256, network.LogDistance(self, other))
+
+	rt := network.NewRoutingTable("self")
+	now := time.Unix(1700000000, 0)
+	assert.False(t, rt.Add("self", "addr-self", now))
+
+	// 一半的节点落在最远的K桶中 K桶满了之后不再添加没有确认过的节点
+	var farthest []string
+	for i := 0; len(farthest) < 20; i++ {
+		id := fmt.Sprintf("node-%d", i)
+		if network.LogDistance(self, network.NodeKey(id)) == 256 {
+			farthest = append(farthest, id)
+		}
+	}
+	for i, id := range farthest[:16] {
+		assert.True(t, rt.Add(id, fmt.Sprintf("addr-%d", i), time.Time{}))
+	}
+	assert.False(t, rt.Add(farthest[16], "addr-16", time.Time{}))
+	assert.False(t, rt.Add(farthest[0], "addr-0", time.Time{}))
+	assert.Equal(t, 16, rt.Size())
+	// 确认在线的节点替换没有确认过的节点
+	assert.True(t, rt.Add(farthest[17], "addr-17", now))
+	assert.Equal(t, 16, rt.Size())
+	rt.RemoveAddr("addr-17")
+	assert.Equal(t, 15, rt.Size())
+
+	for i := 0; i < 200; i++ {
+		rt.Add(fmt.Sprintf("peer-%d", i), fmt.Sprintf("peer-addr-%d", i), now)
+	}
+
+	// Closest按异或距离从近到远排序
+	target := types.RandomHash()
+	closest := rt.Closest(target, 16)
+	assert.Len(t, closest, 16)
+	for i := 1; i < len(closest); i++ {
+		prev := xorDistance(target, network.NodeKey(closest[i-1].ID))
+		cur := xorDistance(target, network.NodeKey(closest[i].ID))
+		assert.LessOrEqual(t, string(prev[:]), string(cur[:]))
+	}
+
+	// Diverse先从不同的K桶中各取一个节点
+	diverse := rt.Diverse(4)
+	assert.Len(t, diverse, 4)
+	buckets := make(map[int]bool)
+	for _, node := range diverse {
+		buckets[network.LogDistance(self, network.NodeKey(node.ID))] = true
+	}
+	assert.Len(t, buckets, 4)
+}
+
+func TestDHTDiscovery(t *testing.T) {
+	simNet := network.NewSimNetwork(network.NewSimClock(time.Now()), 1, network.LinkConfig{Latency: 10 * time.Millisecond})
+	clock := simNet.Clock()
+
+	// 每个节点只知道前一个节点 通过FIND_NODE发现其他节点
+	const n = 6
+	servers := make([]*network.Server, n)
+	for i := range servers {
+		seed := "Z"
+		if i > 0 {
+			seed = fmt.Sprintf("N%d", i-1)
+		}
+		servers[i] = newConnTestServer(t, simNet.Transport(network.NetAddr(fmt.Sprintf("N%d", i))), clock, []string{seed}, network.WithOutboundPeers(3, 8))
+		assert.NoError(t, servers[i].Start())
+		defer servers[i].Stop(context.Background())
+		simNet.Run(time.Second, simStep)
+	}
+	simNet.Run(3*time.Minute, simStep)
+
+	for i, s := range servers {
+		assert.Equal(t, n-1, s.RoutingTable().Size(), "节点%d的路由表", i)
+		assert.GreaterOrEqual(t, s.PeerCount(), 3, "节点%d的连接", i)
+	}
+}
+
+// connectDHTPeer 让原始节点X连接A 并通过Hello告诉A自己的节点ID
+func connectDHTPeer(t *testing.T, transport *network.LocalTransport) (*network.Server, network.Peer, <-chan network.RPC) {
+	remote := network.NewLocalTransport("X")
+	transport.Connect(remote)
+	// 种子节点不存在 A连接种子失败时不会把X从路由表中删除
+	a := newConnTestServer(t, transport, network.NewSimClock(time.Now()), []string{"S"})
+	assert.NoError(t, a.Start())
+	t.Cleanup(func() { a.Stop(context.Background()) })
+
+	peer, err := remote.Dial("A")
+	assert.NoError(t, err)
+	rpcCh := make(chan network.RPC, 64)
+	go peer.ReceiveLoop(rpcCh)
+	sendMessage(t, peer, network.MessageTypeHello, &network.HelloMessage{ID: "x", ListenAddr: "X"})
+	assert.Eventually(t, func() bool {
+		return a.RoutingTable().Size() == 1
+	}, time.Second, 10*time.Millisecond)
+	return a, peer, rpcCh
+}
+
+func TestDHTDropsUnsolicitedNodes(t *testing.T) {
+	a, peer, _ := connectDHTPeer(t, network.NewLocalTransport("A"))
+
+	// 没有请求过的节点列表 以及编号对不上任何请求的节点列表都被丢弃
+	nodes := &network.NodesMessage{Nodes: []network.NodeRecord{{ID: "z", Addr: "Z"}}}
+	sendMessage(t, peer, network.MessageTypeNodes, nodes)
+	data, err := network.EncodeMessageWithID(network.MessageTypeNodes, 12345, nodes)
+	assert.NoError(t, err)
+	assert.NoError(t, peer.Send(data))
+
+	assert.Never(t, func() bool {
+		return a.RoutingTable().Size() > 1
+	}, 200*time.Millisecond, 10*time.Millisecond)
+}
+
+func TestDHTIterativeLookup(t *testing.T) {
+	transport := network.NewLocalTransport("A")
+	y := network.NewLocalTransport("Y")
+	transport.Connect(y)
+	assert.NoError(t, y.Start())
+	a, peer, rpcCh := connectDHTPeer(t, transport)
+	target := network.NodeKey("y")
+
+	// Y回复所有的FIND_NODE请求 不管A是临时连接还是由连接管理器连接
+	queried := make(chan struct{}, 8)
+	go func() {
+		for p := range y.Accept() {
+			ch := make(chan network.RPC, 64)
+			go p.ReceiveLoop(ch)
+			go func() {
+				for rpc := range ch {
+					msg := new(network.Message)
+					if msg.Decode(rpc.Payload) != nil || msg.Type != network.MessageTypeFindNode {
+						continue
+					}
+					req := new(network.FindNodeMessage)
+					if req.Decode(bytes.NewBuffer(msg.Body)) != nil || req.Target != target {
+						continue
+					}
+					queried <- struct{}{}
+					data, _ := network.EncodeMessageWithID(network.MessageTypeNodes, msg.ID, &network.NodesMessage{})
+					p.Send(data)
+				}
+			}()
+		}
+	}()
+
+	result := make(chan []network.NodeRecord, 1)
+	go func() { result <- a.FindNode(target) }()
+
+	// X只知道Y A接着询问离目标更近的Y
+	req := new(network.FindNodeMessage)
+	id := expectMessage(t, rpcCh, network.MessageTypeFindNode, req)
+	assert.Equal(t, target, req.Target)
+	data, err := network.EncodeMessageWithID(network.MessageTypeNodes, id, &network.NodesMessage{
+		Nodes: []network.NodeRecord{{ID: "y", Addr: "Y"}},
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, peer.Send(data))
+
+	select {
+	case <-queried:
+	case <-time.After(time.Second):
+		t.Fatal("A没有询问Y")
+	}
+	select {
+	case nodes := <-result:
+		assert.Len(t, nodes, 2)
+		assert.Equal(t, "y", nodes[0].ID)
+	case <-time.After(time.Second):
+		t.Fatal("查询没有结束")
+	}
+}
@@ -0,0 +1,109 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"go-chain/core"
+	"go-chain/cryptoo"
+	"go-chain/network"
+	"io"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocalTransport(t *testing.T) {
+	a := network.NewLocalTransport("A")
+	b := network.NewLocalTransport("B")
+	a.Connect(b)
+
+	// 目标节点没有启动时连接失败
+	_, err := a.Dial("B")
+	assert.Error(t, err)
+	_, err = a.Dial("C")
+	assert.ErrorIs(t, err, network.ErrTransportNotFound)
+
+	assert.NoError(t, b.Start())
+	peer, err := a.Dial("B")
+	assert.NoError(t, err)
+	assert.Equal(t, "B", peer.RemoteAddr().String())
+
+	accepted := <-b.Accept()
+	assert.Equal(t, "A", accepted.RemoteAddr().String())
+
+	rpcCh := make(chan network.RPC)
+	go accepted.ReceiveLoop(rpcCh)
+	assert.NoError(t, peer.Send([]byte("hello")))
+
+	rpc := <-rpcCh
+	assert.Equal(t, network.NetAddr("A"), rpc.From)
+	data, _ := io.ReadAll(rpc.Payload)
+	assert.Equal(t, []byte("hello"), data)
+
+	// 任意一端关闭后整条连接都不可用
+	assert.NoError(t, accepted.Close())
+	assert.ErrorIs(t, peer.Send([]byte("hello")), network.ErrPeerClosed)
+}
+
+func TestServersOverLocalTransport(t *testing.T) {
+	addrs := []network.NetAddr{"A", "B", "C"}
+	transports := make([]*network.LocalTransport, len(addrs))
+	for i, addr := range addrs {
+		transports[i] = network.NewLocalTransport(addr)
+	}
+	for i := range transports {
+		for j := i + 1; j < len(transports); j++ {
+			transports[i].Connect(transports[j])
+		}
+	}
+
+	sender, _ := cryptoo.GeneratePrivateKey()
+	receiver, _ := cryptoo.GeneratePrivateKey()
+	servers := make([]*network.Server, len(addrs))
+	for i, transport := range transports {
+		seeds := make([]string, 0, len(addrs)-1)
+		for j, addr := range addrs {
+			if j != i {
+				seeds = append(seeds, string(addr))
+			}
+		}
+		s, err := network.NewServer(*network.NewServerOpts(
+			network.WithTransport(transport),
+			network.WithSeedNodes(seeds),
+			network.WithLogger(log.New(io.Discard, "", 0)),
+		))
+		assert.NoError(t, err)
+		// 每个节点的交易池都会校验余额 给发送方预先准备余额
+		s.Chain().GetAccountState().CreateAccount(sender.GetPublicKey().Address(), &core.Account{
+			Address: sender.GetPublicKey().Address(),
+			Balance: 1000,
+		})
+		servers[i] = s
+	}
+	for _, s := range servers {
+		assert.NoError(t, s.Start())
+	}
+	defer func() {
+		for _, s := range servers {
+			assert.NoError(t, s.Stop(context.Background()))
+		}
+	}()
+	// 后启动的节点会连接先启动的节点 最终每个节点都与另外两个节点相连
+	for _, s := range servers {
+		assert.Eventually(t, func() bool {
+			return s.PeerCount() == len(addrs)-1
+		}, time.Second, 10*time.Millisecond)
+	}
+
+	// 交易通过通告和获取数据传播到所有节点
+	tx := core.NewTransaction(sender, receiver.GetPublicKey(), []byte("local"), 100, 1)
+	assert.NoError(t, servers[0].SubmitTx(tx))
+	for _, s := range servers[1:] {
+		assert.Eventually(t, func() bool {
+			got := s.Pool().Get(tx.CalHash())
+			return got != nil && bytes.Equal(got.Data, tx.Data)
+		}, 2*time.Second, 10*time.Millisecond)
+	}
+}
@@ -4,6 +4,9 @@ import (
 	"bytes"
 	"go-chain/core"
 	"go-chain/network"
+	"go-chain/types"
+	"go-chain/utils"
+	"io"
 	"testing"
 	"github.com/stretchr/testify/assert"
 )
@@ -80,3 +83,125 @@ func TestStatusMessage(t *testing.T) {
 	assert.Equal(t, msg.Version, decodedMsg.Version)
 	assert.Equal(t, msg.CurrentHeight, decodedMsg.CurrentHeight)
 }
+
+func TestSnapshotMessage(t *testing.T) {
+	msg := &network.SnapshotMessage{
+		Height:    10,
+		BlockHash: types.RandomHash(),
+		StateRoot: types.RandomHash(),
+		Index:     1,
+		Total:     3,
+		Accounts: []*core.Account{
+			{Address: types.Address{0x1}, Balance: 100},
+		},
+	}
+
+	var buf bytes.Buffer
+	err := msg.Encode(&buf)
+	assert.NoError(t, err)
+
+	decodedMsg := &network.SnapshotMessage{}
+	err = decodedMsg.Decode(&buf)
+	assert.NoError(t, err)
+
+	assert.Equal(t, msg.Height, decodedMsg.Height)
+	assert.Equal(t, msg.StateRoot, decodedMsg.StateRoot)
+	assert.Equal(t, msg.Total, decodedMsg.Total)
+	assert.Equal(t, msg.Accounts[0].Balance, decodedMsg.Accounts[0].Balance)
+	assert.Nil(t, decodedMsg.Anchor)
+}
+
+func TestInvMessage(t *testing.T) {
+	msg := &network.InvMessage{
+		Items: []network.InvVector{
+			{Type: network.InvTypeTx, Hash: types.RandomHash()},
+			{Type: network.InvTypeBlock, Hash: types.RandomHash()},
+		},
+	}
+
+	var buf bytes.Buffer
+	err := msg.Encode(&buf)
+	assert.NoError(t, err)
+
+	decodedMsg := &network.InvMessage{}
+	err = decodedMsg.Decode(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, msg.Items, decodedMsg.Items)
+
+	getData := &network.GetDataMessage{Items: msg.Items[:1]}
+	buf.Reset()
+	assert.NoError(t, getData.Encode(&buf))
+
+	decodedGetData := &network.GetDataMessage{}
+	assert.NoError(t, decodedGetData.Decode(&buf))
+	assert.Equal(t, network.InvTypeTx, decodedGetData.Items[0].Type)
+	assert.Equal(t, msg.Items[0].Hash, decodedGetData.Items[0].Hash)
+}
+
+func TestHeadersMessage(t *testing.T) {
+	block := core.NewBlock(types.RandomHash(), 1, []*core.Transaction{})
+	msg := &network.HeadersMessage{
+		Headers: []*core.BlockHeader{block.Header},
+	}
+
+	var buf bytes.Buffer
+	err := msg.Encode(&buf)
+	assert.NoError(t, err)
+
+	decodedMsg := &network.HeadersMessage{}
+	err = decodedMsg.Decode(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, block.Header, decodedMsg.Headers[0])
+}
+
+func TestEncodeMessageWithID(t *testing.T) {
+	data, err := network.EncodeMessageWithID(network.MessageTypeGetBlocks, 42, &network.GetBlocksMessage{From: 1, To: 5})
+	assert.NoError(t, err)
+
+	var msg network.Message
+	assert.NoError(t, msg.Decode(bytes.NewReader(data)))
+	assert.Equal(t, network.MessageTypeGetBlocks, msg.Type)
+	assert.Equal(t, uint64(42), msg.ID)
+
+	getBlocks := &network.GetBlocksMessage{}
+	assert.NoError(t, getBlocks.Decode(bytes.NewReader(msg.Body)))
+	assert.Equal(t, uint32(5), getBlocks.To)
+
+	// 不需要响应的消息编号为0
+	data, err = network.EncodeMessage(network.MessageTypeGetStatus, &network.GetStatusMessage{})
+	assert.NoError(t, err)
+	var status network.Message
+	assert.NoError(t, status.Decode(bytes.NewReader(data)))
+	assert.Equal(t, uint64(0), status.ID)
+}
+
+func TestMessageBounds(t *testing.T) {
+	// 声明的条目数量超过上限时直接返回错误
+	var buf bytes.Buffer
+	w := utils.NewBinaryWriter(&buf)
+	w.WriteUint32(1 << 20)
+	assert.ErrorIs(t, new(network.InvMessage).Decode(&buf), utils.ErrLengthExceeded)
+
+	// 截断的消息
+	data, err := network.EncodeMessage(network.MessageTypeStatus, &network.StatusMessage{ID: "node", CurrentHeight: 3})
+	assert.NoError(t, err)
+	var msg network.Message
+	assert.ErrorIs(t, msg.Decode(bytes.NewReader(data[:len(data)-2])), io.ErrUnexpectedEOF)
+}
+
+func TestDecodeExactRejectsTrailingData(t *testing.T) {
+	body := new(bytes.Buffer)
+	assert.NoError(t, (&network.PingMessage{Nonce: 7}).Encode(body))
+	ping := new(network.PingMessage)
+	assert.NoError(t, network.DecodeExact(bytes.NewReader(body.Bytes()), ping))
+	assert.Equal(t, uint64(7), ping.Nonce)
+
+	// 消息体后面附带了多余的字节
+	padded := append(append([]byte(nil), body.Bytes()...), 0)
+	assert.ErrorIs(t, network.DecodeExact(bytes.NewReader(padded), new(network.PingMessage)), network.ErrTrailingData)
+
+	// 消息外层后面附带了多余的字节
+	data, err := network.EncodeMessage(network.MessageTypePing, &network.PingMessage{Nonce: 7})
+	assert.NoError(t, err)
+	assert.ErrorIs(t, network.DecodeExact(bytes.NewReader(append(data, 1, 2)), new(network.Message)), network.ErrTrailingData)
+}
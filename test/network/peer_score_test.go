@@ -0,0 +1,110 @@
+package network
+
+import (
+	"context"
+	"go-chain/network"
+	"go-chain/types"
+	"io"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMisbehavingPeerIsBanned(t *testing.T) {
+	clock := network.NewSimClock(time.Now())
+	transport := network.NewLocalTransport("A")
+	attacker := network.NewLocalTransport("X")
+	transport.Connect(attacker)
+
+	s, err := network.NewServer(*network.NewServerOpts(
+		network.WithTransport(transport),
+		network.WithClock(clock),
+		network.WithSeedNodes([]string{"X"}),
+		network.WithBanDuration(time.Hour),
+		network.WithLogger(log.New(io.Discard, "", 0)),
+	))
+	assert.NoError(t, err)
+	assert.NoError(t, s.Start())
+	defer s.Stop(context.Background())
+
+	peer, err := attacker.Dial("A")
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return s.PeerCount() == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// 无法解码的消息每次扣除20分
+	assert.NoError(t, peer.Send([]byte{0xff}))
+	assert.Eventually(t, func() bool {
+		return s.PeerScore("X") == 80
+	}, time.Second, 10*time.Millisecond)
+	for i := 0; i < 4; i++ {
+		assert.NoError(t, peer.Send([]byte{0xff}))
+	}
+
+	// 评分降到0后断开连接并禁止再次连接
+	assert.Eventually(t, func() bool {
+		return s.PeerCount() == 0 && s.IsBanned("X")
+	}, time.Second, 10*time.Millisecond)
+	assert.ErrorIs(t, peer.Send([]byte{0xff}), network.ErrPeerClosed)
+
+	peer, err = attacker.Dial("A")
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return peer.Send([]byte{0xff}) != nil
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 0, s.PeerCount())
+
+	// 禁止时间结束后可以重新连接
+	clock.Advance(time.Hour)
+	assert.False(t, s.IsBanned("X"))
+	_, err = attacker.Dial("A")
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return s.PeerCount() == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// 手动禁止节点会立即断开连接
+	s.BanPeer("X", 0)
+	assert.True(t, s.IsBanned("X"))
+	assert.Eventually(t, func() bool {
+		return s.PeerCount() == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestRateLimitCoversCompactAndInvMessages(t *testing.T) {
+	transport := network.NewLocalTransport("A")
+	remote := network.NewLocalTransport("X")
+	transport.Connect(remote)
+	s := newConnTestServer(t, transport, network.NewSimClock(time.Now()), []string{"X"},
+		network.WithBlockRateLimit(1, 1),
+		network.WithInvRateLimit(1, 1),
+	)
+	assert.NoError(t, s.Start())
+	defer s.Stop(context.Background())
+
+	peer, err := remote.Dial("A")
+	assert.NoError(t, err)
+	go peer.ReceiveLoop(make(chan network.RPC, 64))
+	assert.Eventually(t, func() bool {
+		return s.PeerCount() == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// 补充交易消息和区块消息共用令牌桶 超过限速每次扣除1分
+	txn := &network.BlockTxnMessage{BlockHash: types.RandomHash()}
+	sendMessage(t, peer, network.MessageTypeBlockTxn, txn)
+	sendMessage(t, peer, network.MessageTypeBlockTxn, txn)
+	assert.Eventually(t, func() bool {
+		return s.PeerScore("X") == 99
+	}, time.Second, 10*time.Millisecond)
+
+	// 通告消息有单独的令牌桶
+	inv := &network.InvMessage{Items: []network.InvVector{}}
+	sendMessage(t, peer, network.MessageTypeInv, inv)
+	sendMessage(t, peer, network.MessageTypeInv, inv)
+	assert.Eventually(t, func() bool {
+		return s.PeerScore("X") == 98
+	}, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,39 @@
+package network
+
+import (
+	"context"
+	"go-chain/network"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPingMeasuresLatencyAndDropsDeadPeers(t *testing.T) {
+	simNet := network.NewSimNetwork(network.NewSimClock(time.Now()), 1, network.LinkConfig{Latency: 50 * time.Millisecond})
+	clock := simNet.Clock()
+
+	a := newConnTestServer(t, simNet.Transport("A"), clock, []string{"B"})
+	b := newConnTestServer(t, simNet.Transport("B"), clock, []string{"A"})
+	assert.NoError(t, b.Start())
+	defer b.Stop(context.Background())
+	assert.NoError(t, a.Start())
+	defer a.Stop(context.Background())
+	simNet.Run(time.Second, simStep)
+
+	// 往返时间至少是两倍的链路延迟
+	stats := a.PeerStats()
+	assert.Len(t, stats, 1)
+	assert.True(t, stats[0].Outbound)
+	assert.GreaterOrEqual(t, stats[0].RTT, 100*time.Millisecond)
+	assert.Less(t, stats[0].RTT, 500*time.Millisecond)
+	assert.False(t, stats[0].LastPong.IsZero())
+
+	// 消息全部丢失后 最多经过一次Ping间隔加上超时时间节点被断开
+	simNet.Partition([]network.NetAddr{"A"}, []network.NetAddr{"B"})
+	simNet.Run(10*time.Second, simStep)
+	assert.Equal(t, 1, a.PeerCount())
+	simNet.Run(50*time.Second, simStep)
+	assert.Equal(t, 0, a.PeerCount())
+	assert.Equal(t, 0, b.PeerCount())
+}
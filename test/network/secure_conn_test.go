@@ -0,0 +1,90 @@
+package network
+
+import (
+	"go-chain/network"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNodeIdentityPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "node.key")
+
+	identity, err := network.LoadNodeIdentity(path)
+	assert.NoError(t, err)
+	assert.Len(t, identity.ID(), 64)
+
+	// 重启后读取同一个密钥 节点ID不变
+	loaded, err := network.LoadNodeIdentity(path)
+	assert.NoError(t, err)
+	assert.Equal(t, identity.ID(), loaded.ID())
+
+	temp, err := network.LoadNodeIdentity("")
+	assert.NoError(t, err)
+	assert.NotEqual(t, identity.ID(), temp.ID())
+
+	assert.NoError(t, os.WriteFile(path, []byte("not a key"), 0600))
+	_, err = network.LoadNodeIdentity(path)
+	assert.ErrorIs(t, err, network.ErrBadNodeKey)
+}
+
+func TestEncryptedTCPConnection(t *testing.T) {
+	aIdentity, err := network.GenerateNodeIdentity()
+	assert.NoError(t, err)
+	bIdentity, err := network.GenerateNodeIdentity()
+	assert.NoError(t, err)
+
+	a, err := network.NewTCPTransport("127.0.0.1:39791", aIdentity)
+	assert.NoError(t, err)
+	b, err := network.NewTCPTransport("127.0.0.1:39792", bIdentity)
+	assert.NoError(t, err)
+	assert.NoError(t, a.Start())
+	defer a.Close()
+	assert.NoError(t, b.Start())
+	defer b.Close()
+
+	peer, err := a.Dial("127.0.0.1:39792")
+	assert.NoError(t, err)
+	defer peer.Close()
+	accepted := <-b.Accept()
+	defer accepted.Close()
+
+	// 双方在握手中验证了对方的节点ID
+	assert.Equal(t, bIdentity.ID(), peer.(*network.TCPPeer).RemoteID())
+	assert.Equal(t, aIdentity.ID(), accepted.(*network.TCPPeer).RemoteID())
+
+	rpcCh := make(chan network.RPC, 1)
+	go accepted.ReceiveLoop(rpcCh)
+	assert.NoError(t, peer.Send([]byte("hello")))
+	select {
+	case rpc := <-rpcCh:
+		payload, err := io.ReadAll(rpc.Payload)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("hello"), payload)
+	case <-time.After(time.Second):
+		t.Fatal("没有收到消息")
+	}
+
+	// 不进行握手直接发送明文的连接被关闭
+	conn, err := net.Dial("tcp", "127.0.0.1:39792")
+	assert.NoError(t, err)
+	defer conn.Close()
+	plain := make([]byte, 128)
+	plain[0] = 5
+	_, err = conn.Write(plain)
+	assert.NoError(t, err)
+	// 对方发送完握手消息后关闭连接 读取在超时之前结束
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = io.ReadAll(conn)
+	assert.False(t, os.IsTimeout(err))
+	select {
+	case <-b.Accept():
+		t.Fatal("明文连接不应该被接受")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
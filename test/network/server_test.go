@@ -1,9 +1,20 @@
 package network
 
 import (
+	"context"
 	"fmt"
+	"go-chain/core"
+	"go-chain/cryptoo"
 	"go-chain/network"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
 )
 
 
@@ -66,6 +77,195 @@ func TestNewServerAndStart(t *testing.T) {
 			}
 			// 打印服务器信息（可选）
 			fmt.Printf("服务器信息: %+v\n", s)
+			assert.NoError(t, s.Stop(context.Background()))
 		})
 	}
 }
+
+func TestServerStop(t *testing.T) {
+	addrA, addrB := "127.0.0.1:39771", "127.0.0.1:39772"
+	journalPath := filepath.Join(t.TempDir(), "transactions.rlp")
+	sender, _ := cryptoo.GeneratePrivateKey()
+	receiver, _ := cryptoo.GeneratePrivateKey()
+
+	a, err := network.NewServer(*network.NewServerOpts(
+		network.WithListenAddr(addrA),
+		network.WithSeedNodes([]string{addrB}),
+		network.WithJournalPath(journalPath),
+		network.WithLogger(log.New(io.Discard, "", 0)),
+	))
+	assert.NoError(t, err)
+	a.Chain().GetAccountState().CreateAccount(sender.GetPublicKey().Address(), &core.Account{
+		Address: sender.GetPublicKey().Address(),
+		Balance: 1000,
+	})
+	b, err := network.NewServer(*network.NewServerOpts(
+		network.WithListenAddr(addrB),
+		network.WithSeedNodes([]string{addrA}),
+		network.WithLogger(log.New(io.Discard, "", 0)),
+	))
+	assert.NoError(t, err)
+
+	assert.NoError(t, a.Start())
+	assert.NoError(t, b.Start())
+	assert.Eventually(t, func() bool {
+		return a.PeerCount() == 1 && b.PeerCount() == 1
+	}, time.Second, 10*time.Millisecond)
+
+	tx := core.NewTransaction(sender, receiver.GetPublicKey(), []byte("stop"), 10, 0)
+	assert.NoError(t, a.SubmitTx(tx))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, a.Stop(ctx))
+	assert.ErrorIs(t, a.Stop(ctx), network.ErrServerStopped)
+
+	// 连接断开后对方移除这个节点 监听的端口已经释放
+	assert.Eventually(t, func() bool {
+		return b.PeerCount() == 0
+	}, time.Second, 10*time.Millisecond)
+	ln, err := net.Listen("tcp", addrA)
+	assert.NoError(t, err)
+	ln.Close()
+
+	// 停止时本地交易已经写入日志
+	txs, err := core.NewTxJournal(journalPath).Load()
+	assert.NoError(t, err)
+	if assert.Len(t, txs, 1) {
+		assert.Equal(t, tx.CalHash(), txs[0].CalHash())
+	}
+
+	assert.NoError(t, b.Stop(ctx))
+}
+
+// stuckTransport 主动建立的连接关闭后 接收循环要等到release关闭才返回 模拟还没有退出的处理协程
+type stuckTransport struct {
+	*network.LocalTransport
+	dialed  chan struct{}
+	release chan struct{}
+}
+
+func (t *stuckTransport) Dial(addr string) (network.Peer, error) {
+	peer, err := t.LocalTransport.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case t.dialed <- struct{}{}:
+	default:
+	}
+	return &stuckPeer{Peer: peer, release: t.release}, nil
+}
+
+type stuckPeer struct {
+	network.Peer
+	release chan struct{}
+}
+
+func (p *stuckPeer) ReceiveLoop(rpcCh chan<- network.RPC) {
+	p.Peer.ReceiveLoop(rpcCh)
+	<-p.release
+}
+
+func TestServerStopTimeout(t *testing.T) {
+	dir := t.TempDir()
+	journalPath := filepath.Join(dir, "transactions.rlp")
+	addrBookPath := filepath.Join(dir, "peers.dat")
+	transport := &stuckTransport{LocalTransport: network.NewLocalTransport("A"), dialed: make(chan struct{}, 1), release: make(chan struct{})}
+	remote := network.NewLocalTransport("X")
+	assert.NoError(t, remote.Start())
+	transport.Connect(remote)
+	a := newConnTestServer(t, transport, network.NewSimClock(time.Now()), []string{"X"},
+		network.WithJournalPath(journalPath),
+		network.WithAddrBookPath(addrBookPath),
+	)
+	sender, _ := cryptoo.GeneratePrivateKey()
+	receiver, _ := cryptoo.GeneratePrivateKey()
+	addr := sender.GetPublicKey().Address()
+	a.Chain().GetAccountState().CreateAccount(addr, &core.Account{Address: addr, Balance: 1000})
+	assert.NoError(t, a.Start())
+	select {
+	case <-transport.dialed:
+	case <-time.After(time.Second):
+		t.Fatal("没有连接种子节点")
+	}
+	tx := core.NewTransaction(sender, receiver.GetPublicKey(), []byte("stop"), 10, 0)
+	assert.NoError(t, a.SubmitTx(tx))
+
+	// 处理协程没有退出 超时后直接返回 不保存地址簿
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, a.Stop(ctx), context.DeadlineExceeded)
+	_, err := os.Stat(addrBookPath)
+	assert.True(t, os.IsNotExist(err))
+
+	// 处理协程退出后在后台保存日志和地址簿
+	close(transport.release)
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(addrBookPath)
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		txs, err := core.NewTxJournal(journalPath).Load()
+		return err == nil && len(txs) == 1
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestServerSweepsExpiredTxsByClock(t *testing.T) {
+	clock := network.NewSimClock(time.Now())
+	s := newConnTestServer(t, network.NewLocalTransport("A"), clock, []string{"X"}, network.WithTxLifetime(time.Minute))
+	sender, _ := cryptoo.GeneratePrivateKey()
+	receiver, _ := cryptoo.GeneratePrivateKey()
+	addr := sender.GetPublicKey().Address()
+	s.Chain().GetAccountState().CreateAccount(addr, &core.Account{Address: addr, Balance: 1000})
+	assert.NoError(t, s.Start())
+	defer s.Stop(context.Background())
+
+	tx := core.NewTransaction(sender, receiver.GetPublicKey(), nil, 10, 0)
+	assert.NoError(t, s.SubmitTx(tx))
+
+	// 交易的存活时间按节点的时钟计算 虚拟时间超过存活时间后被清理
+	assert.Eventually(t, func() bool {
+		clock.Advance(time.Minute)
+		return s.Pool().Get(tx.CalHash()) == nil
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestServerAcceptsTxAfterBadSignatureCopy(t *testing.T) {
+	transport := network.NewLocalTransport("A")
+	remote := network.NewLocalTransport("X")
+	transport.Connect(remote)
+	s := newConnTestServer(t, transport, network.NewSimClock(time.Now()), []string{"X"})
+	sender, _ := cryptoo.GeneratePrivateKey()
+	receiver, _ := cryptoo.GeneratePrivateKey()
+	addr := sender.GetPublicKey().Address()
+	s.Chain().GetAccountState().CreateAccount(addr, &core.Account{Address: addr, Balance: 1000})
+	assert.NoError(t, s.Start())
+	defer s.Stop(context.Background())
+
+	peer, err := remote.Dial("A")
+	assert.NoError(t, err)
+	go peer.ReceiveLoop(make(chan network.RPC, 64))
+	assert.Eventually(t, func() bool {
+		return s.PeerCount() == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// 交易哈希不包含签名 换上另一笔交易的签名后哈希不变但签名无效
+	tx := core.NewTransaction(sender, receiver.GetPublicKey(), nil, 10, 0)
+	other := core.NewTransaction(sender, receiver.GetPublicKey(), nil, 20, 0)
+	forged := *tx
+	forged.Signature = other.Signature
+	assert.Equal(t, tx.CalHash(), forged.CalHash())
+
+	sendMessage(t, peer, network.MessageTypeTx, &forged)
+	assert.Eventually(t, func() bool {
+		return s.PeerScore("X") < 100
+	}, time.Second, 10*time.Millisecond)
+	assert.Nil(t, s.Pool().Get(tx.CalHash()))
+
+	// 签名错误的副本没有挡住真正的交易
+	sendMessage(t, peer, network.MessageTypeTx, tx)
+	assert.Eventually(t, func() bool {
+		return s.Pool().Get(tx.CalHash()) != nil
+	}, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,185 @@
+package network
+
+import (
+	"context"
+	"go-chain/core"
+	"go-chain/cryptoo"
+	"go-chain/network"
+	"io"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 每次推进虚拟时间的步长
+const simStep = 100 * time.Millisecond
+
+type simNode struct {
+	addr   network.NetAddr
+	mining bool
+	// 出块间隔 不同的间隔避免多个矿工在同一时刻出块
+	blockTime time.Duration
+}
+
+// startSimCluster 在模拟网络中启动一组节点 后启动的节点会连接所有先启动的节点
+// funded中的账户在每个节点的初始状态中都有余额
+func startSimCluster(t *testing.T, simNet *network.SimNetwork, nodes []simNode, funded ...*cryptoo.PrivateKey) []*network.Server {
+	servers := make([]*network.Server, len(nodes))
+	for i, node := range nodes {
+		seeds := make([]string, 0, len(nodes)-1)
+		for j, other := range nodes {
+			if j != i {
+				seeds = append(seeds, string(other.addr))
+			}
+		}
+		s, err := network.NewServer(*network.NewServerOpts(
+			network.WithTransport(simNet.Transport(node.addr)),
+			network.WithClock(simNet.Clock()),
+			network.WithSeedNodes(seeds),
+			network.WithMining(node.mining),
+			network.WithBlockTime(node.blockTime),
+			network.WithLogger(log.New(io.Discard, "", 0)),
+		))
+		if err != nil {
+			t.Fatalf("创建节点 %s 失败: %v", node.addr, err)
+		}
+		for _, priv := range funded {
+			addr := priv.GetPublicKey().Address()
+			s.Chain().GetAccountState().CreateAccount(addr, &core.Account{Address: addr, Balance: 1000})
+		}
+		servers[i] = s
+	}
+	for _, s := range servers {
+		if err := s.Start(); err != nil {
+			t.Fatalf("启动节点失败: %v", err)
+		}
+	}
+	t.Cleanup(func() {
+		for _, s := range servers {
+			assert.NoError(t, s.Stop(context.Background()))
+		}
+	})
+	simNet.Run(time.Second, simStep)
+	return servers
+}
+
+// assertConverged 检查所有节点的链高度和最新区块一致 并且包含所有交易
+func assertConverged(t *testing.T, servers []*network.Server, txs []*core.Transaction) {
+	t.Helper()
+	tip := servers[0].Chain().GetLatestBlock().Hash()
+	height := servers[0].Chain().Height()
+	for i, s := range servers {
+		assert.Equal(t, height, s.Chain().Height(), "节点%d的高度不一致", i)
+		assert.Equal(t, tip, s.Chain().GetLatestBlock().Hash(), "节点%d的最新区块不一致", i)
+		for _, tx := range txs {
+			assert.True(t, s.Chain().HasTransaction(tx.CalHash()), "节点%d缺少交易", i)
+		}
+	}
+}
+
+func TestSimClock(t *testing.T) {
+	clock := network.NewSimClock(time.Unix(0, 0))
+	ticker := clock.NewTicker(10 * time.Second)
+	var fired []string
+	clock.AfterFunc(15*time.Second, func() { fired = append(fired, "b") })
+	clock.AfterFunc(5*time.Second, func() { fired = append(fired, "a") })
+
+	clock.Advance(9 * time.Second)
+	assert.Equal(t, []string{"a"}, fired)
+	select {
+	case <-ticker.C():
+		t.Fatal("定时器不应该提前触发")
+	default:
+	}
+
+	clock.Advance(time.Second)
+	assert.Equal(t, time.Unix(10, 0), <-ticker.C())
+
+	clock.Advance(10 * time.Second)
+	assert.Equal(t, []string{"a", "b"}, fired)
+	assert.Equal(t, time.Unix(20, 0), <-ticker.C())
+
+	ticker.Stop()
+	clock.Advance(time.Minute)
+	select {
+	case <-ticker.C():
+		t.Fatal("停止后的定时器不应该触发")
+	default:
+	}
+}
+
+func TestSimNetworkConvergesAfterPartition(t *testing.T) {
+	clock := network.NewSimClock(time.Now())
+	simNet := network.NewSimNetwork(clock, 1, network.LinkConfig{
+		Latency:  50 * time.Millisecond,
+		Jitter:   100 * time.Millisecond,
+		DropRate: 0.05,
+	})
+	sender1, _ := cryptoo.GeneratePrivateKey()
+	sender2, _ := cryptoo.GeneratePrivateKey()
+	receiver, _ := cryptoo.GeneratePrivateKey()
+	servers := startSimCluster(t, simNet, []simNode{
+		{addr: "A", mining: true, blockTime: 5 * time.Second},
+		{addr: "B"},
+		{addr: "C", mining: true, blockTime: 7 * time.Second},
+		{addr: "D"},
+	}, sender1, sender2)
+	a, c := servers[0], servers[2]
+
+	// A和B C和D分别组成两个分区 40秒后恢复连通
+	simNet.Partition([]network.NetAddr{"A", "B"}, []network.NetAddr{"C", "D"})
+	clock.AfterFunc(40*time.Second, simNet.Heal)
+
+	// 两个分区各自出块 A所在的分区更长
+	var txs []*core.Transaction
+	forked := core.NewTransaction(sender2, receiver.GetPublicKey(), []byte("C"), 10, 0)
+	assert.NoError(t, c.SubmitTx(forked))
+	txs = append(txs, forked)
+	for nonce := int64(0); nonce < 3; nonce++ {
+		tx := core.NewTransaction(sender1, receiver.GetPublicKey(), []byte("A"), 10, nonce)
+		assert.NoError(t, a.SubmitTx(tx))
+		txs = append(txs, tx)
+		simNet.Run(10*time.Second, simStep)
+	}
+	assert.Equal(t, uint32(3), a.Chain().Height())
+	assert.Equal(t, uint32(1), c.Chain().Height())
+
+	// 恢复连通后C和D切换到更长的链 C被回滚的交易重新打包
+	// 丢失的区块头响应要等下一轮状态查询才会重新请求 留出足够的时间
+	simNet.Run(3*time.Minute, simStep)
+	assertConverged(t, servers, txs)
+	assert.Equal(t, uint32(4), a.Chain().Height())
+}
+
+func TestSimNetworkConvergesWithLossAndReordering(t *testing.T) {
+	clock := network.NewSimClock(time.Now())
+	simNet := network.NewSimNetwork(clock, 2, network.LinkConfig{
+		Latency:  20 * time.Millisecond,
+		Jitter:   time.Second,
+		DropRate: 0.1,
+	})
+	sender, _ := cryptoo.GeneratePrivateKey()
+	receiver, _ := cryptoo.GeneratePrivateKey()
+	servers := startSimCluster(t, simNet, []simNode{
+		{addr: "A", mining: true, blockTime: 5 * time.Second},
+		{addr: "B"},
+		{addr: "C"},
+	}, sender)
+	// B和C之间的链路质量更好
+	simNet.SetLink("B", "C", network.LinkConfig{Latency: 10 * time.Millisecond})
+
+	var txs []*core.Transaction
+	for nonce := int64(0); nonce < 5; nonce++ {
+		tx := core.NewTransaction(sender, receiver.GetPublicKey(), nil, 10, nonce)
+		assert.NoError(t, servers[0].SubmitTx(tx))
+		txs = append(txs, tx)
+		simNet.Run(6*time.Second, simStep)
+	}
+
+	// 乱序到达的区块无法直接添加 丢失的区块通告和请求由定期的状态查询补上
+	simNet.Run(3*time.Minute, simStep)
+	assertConverged(t, servers, txs)
+	assert.Equal(t, uint32(5), servers[0].Chain().Height())
+}
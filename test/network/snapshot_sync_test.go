@@ -0,0 +1,70 @@
+package network
+
+import (
+	"context"
+	"go-chain/network"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// connectSnapshotPeer 让原始节点X连接到开启了快速同步的A 并宣布自己的节点ID和高度
+func connectSnapshotPeer(t *testing.T, clock network.Clock, opts ...network.ServerOption) (*network.Server, network.Peer, chan network.RPC) {
+	t.Helper()
+	transport := network.NewLocalTransport("A")
+	remote := network.NewLocalTransport("X")
+	transport.Connect(remote)
+	opts = append(opts, network.WithFastSync(true))
+	a := newConnTestServer(t, transport, clock, []string{"X"}, opts...)
+	assert.NoError(t, a.Start())
+	t.Cleanup(func() { a.Stop(context.Background()) })
+
+	peer, err := remote.Dial("A")
+	assert.NoError(t, err)
+	rpcCh := make(chan network.RPC, 64)
+	go peer.ReceiveLoop(rpcCh)
+	assert.Eventually(t, func() bool {
+		return a.PeerCount() == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// 消息并发处理 等A记录了X的节点ID之后再发送状态
+	sendMessage(t, peer, network.MessageTypeHello, &network.HelloMessage{ID: "x", ListenAddr: "X"})
+	assert.Eventually(t, func() bool {
+		return a.RoutingTable().Size() == 1
+	}, time.Second, 10*time.Millisecond)
+	sendMessage(t, peer, network.MessageTypeStatus, &network.StatusMessage{ID: "x", CurrentHeight: 10})
+	return a, peer, rpcCh
+}
+
+func TestSnapshotSyncRequiresQuorum(t *testing.T) {
+	// 只连接了一个节点时无法确认快照 直接逐块同步
+	_, _, rpcCh := connectSnapshotPeer(t, network.NewSimClock(time.Now()))
+	getHeaders := new(network.GetHeadersMessage)
+	expectMessage(t, rpcCh, network.MessageTypeGetHeaders, getHeaders)
+	assert.Equal(t, uint32(1), getHeaders.From)
+}
+
+func TestSnapshotSyncTimesOut(t *testing.T) {
+	clock := network.NewSimClock(time.Now())
+	_, _, rpcCh := connectSnapshotPeer(t, clock, network.WithSnapshotQuorum(1))
+	expectMessage(t, rpcCh, network.MessageTypeGetSnapshot, new(network.GetSnapshotMessage))
+
+	// 对方不响应 请求超时之后退回到逐块同步
+	clock.Advance(10 * time.Second)
+	expectMessage(t, rpcCh, network.MessageTypeGetHeaders, new(network.GetHeadersMessage))
+}
+
+func TestSnapshotSyncRejectsTooManyChunks(t *testing.T) {
+	_, peer, rpcCh := connectSnapshotPeer(t, network.NewSimClock(time.Now()), network.WithSnapshotQuorum(1))
+	id := expectMessage(t, rpcCh, network.MessageTypeGetSnapshot, new(network.GetSnapshotMessage))
+
+	// 对方声明的分块数量超过上限 不再继续下载
+	data, err := network.EncodeMessageWithID(network.MessageTypeSnapshot, id, &network.SnapshotMessage{
+		Height: 10,
+		Total:  1 << 30,
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, peer.Send(data))
+	expectMessage(t, rpcCh, network.MessageTypeGetHeaders, new(network.GetHeadersMessage))
+}
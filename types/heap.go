@@ -8,16 +8,27 @@ import (
 type MinHeap[T any] struct {
 	items []T
 	less  func(T, T) bool
+	// 元素在堆中的位置变化时调用 离开堆时位置为-1 为nil时不记录位置
+	setIndex func(T, int)
 }
 
 func (h MinHeap[T]) Len() int { return len(h.items) }
 func (h MinHeap[T]) Less(i, j int) bool {
 	return h.less(h.items[i], h.items[j])
 }
-func (h MinHeap[T]) Swap(i, j int) { h.items[i], h.items[j] = h.items[j], h.items[i] }
+func (h MinHeap[T]) Swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+	if h.setIndex != nil {
+		h.setIndex(h.items[i], i)
+		h.setIndex(h.items[j], j)
+	}
+}
 
 func (h *MinHeap[T]) Push(x interface{}){
 	h.items = append(h.items, x.(T))
+	if h.setIndex != nil {
+		h.setIndex(x.(T), len(h.items)-1)
+	}
 }
 
 func (h *MinHeap[T]) Pop() interface{} {
@@ -25,6 +36,9 @@ func (h *MinHeap[T]) Pop() interface{} {
 	n := len(old)
 	x := old[len(old)-1]
 	h.items = old[:n-1]
+	if h.setIndex != nil {
+		h.setIndex(x, -1)
+	}
 	return x
 }
 
@@ -35,6 +49,21 @@ func NewMinHeap[T any](items []T, less func(T, T) bool) *MinHeap[T] {
 	return h
 }
 
+// NewIndexedMinHeap 创建一个记录元素位置的最小堆 通过setIndex记下的位置可以用Remove在O(log n)内删除元素
+func NewIndexedMinHeap[T any](items []T, less func(T, T) bool, setIndex func(T, int)) *MinHeap[T] {
+	h := &MinHeap[T]{less: less, items: items, setIndex: setIndex}
+	for i, item := range items {
+		setIndex(item, i)
+	}
+	heap.Init(h)
+	return h
+}
+
+// Remove 删除位置i上的元素
+func (h *MinHeap[T]) Remove(i int) T {
+	return heap.Remove(h, i).(T)
+}
+
 func (h *MinHeap[T]) GetAll() []T {
 	return h.items
 }
@@ -1,16 +1,198 @@
 package utils
 
 import (
-	"encoding/gob"
-	"go-chain/inter"
+	"encoding/binary"
+	"errors"
 	"io"
 )
 
-// 使用泛型实现通用的 Encode 和 Decode 函数
-func EncodeMessage[T inter.Codable](m T, w io.Writer) error {
-	return gob.NewEncoder(w).Encode(m)
+// 编码格式见项目根目录下的 编码格式.md
+// 所有整数都使用小端序 变长数据前面带有uint32长度 解码时按调用方给出的上限检查长度
+
+var (
+	ErrLengthExceeded = errors.New("数据长度超过上限")
+	ErrNonCanonical   = errors.New("整数编码带有前导0")
+)
+
+// BinaryWriter 按照固定格式写入数据 出现错误后后续的写入都会被忽略 最后通过Err获取错误
+type BinaryWriter struct {
+	w   io.Writer
+	err error
+	buf [8]byte
+}
+
+func NewBinaryWriter(w io.Writer) *BinaryWriter {
+	return &BinaryWriter{w: w}
+}
+
+func (bw *BinaryWriter) Err() error {
+	return bw.err
+}
+
+func (bw *BinaryWriter) write(b []byte) {
+	if bw.err != nil {
+		return
+	}
+	_, bw.err = bw.w.Write(b)
+}
+
+func (bw *BinaryWriter) WriteUint8(v uint8) {
+	bw.buf[0] = v
+	bw.write(bw.buf[:1])
+}
+
+func (bw *BinaryWriter) WriteBool(v bool) {
+	if v {
+		bw.WriteUint8(1)
+	} else {
+		bw.WriteUint8(0)
+	}
+}
+
+func (bw *BinaryWriter) WriteUint32(v uint32) {
+	binary.LittleEndian.PutUint32(bw.buf[:4], v)
+	bw.write(bw.buf[:4])
+}
+
+func (bw *BinaryWriter) WriteUint64(v uint64) {
+	binary.LittleEndian.PutUint64(bw.buf[:8], v)
+	bw.write(bw.buf[:8])
+}
+
+func (bw *BinaryWriter) WriteInt64(v int64) {
+	bw.WriteUint64(uint64(v))
+}
+
+// WriteFixed 写入固定长度的数据 不带长度前缀
+func (bw *BinaryWriter) WriteFixed(b []byte) {
+	bw.write(b)
+}
+
+// WriteBytes 写入uint32长度前缀和数据
+func (bw *BinaryWriter) WriteBytes(b []byte) {
+	bw.WriteUint32(uint32(len(b)))
+	bw.write(b)
+}
+
+func (bw *BinaryWriter) WriteString(s string) {
+	bw.WriteBytes([]byte(s))
+}
+
+// BinaryReader 按照固定格式读取数据 出现错误后后续的读取都返回零值 最后通过Err获取错误
+// 第一次读取时数据为空会得到io.EOF 数据不完整时得到io.ErrUnexpectedEOF
+type BinaryReader struct {
+	r    io.Reader
+	err  error
+	read bool
+	buf  [8]byte
+}
+
+func NewBinaryReader(r io.Reader) *BinaryReader {
+	return &BinaryReader{r: r}
+}
+
+func (br *BinaryReader) Err() error {
+	return br.err
+}
+
+func (br *BinaryReader) readFull(b []byte) {
+	if br.err != nil {
+		return
+	}
+	_, err := io.ReadFull(br.r, b)
+	// 已经读取过数据后遇到结尾说明数据不完整
+	if err == io.EOF && br.read {
+		err = io.ErrUnexpectedEOF
+	}
+	br.err = err
+	br.read = true
+}
+
+func (br *BinaryReader) ReadUint8() uint8 {
+	br.readFull(br.buf[:1])
+	if br.err != nil {
+		return 0
+	}
+	return br.buf[0]
+}
+
+func (br *BinaryReader) ReadBool() bool {
+	switch br.ReadUint8() {
+	case 0:
+		return false
+	case 1:
+		return true
+	default:
+		if br.err == nil {
+			br.err = errors.New("无效的布尔值")
+		}
+		return false
+	}
+}
+
+func (br *BinaryReader) ReadUint32() uint32 {
+	br.readFull(br.buf[:4])
+	if br.err != nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(br.buf[:4])
 }
 
-func DecodeMessage[T inter.Codable](m T, r io.Reader) error {
-	return gob.NewDecoder(r).Decode(m)
-}
\ No newline at end of file
+func (br *BinaryReader) ReadUint64() uint64 {
+	br.readFull(br.buf[:8])
+	if br.err != nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(br.buf[:8])
+}
+
+func (br *BinaryReader) ReadInt64() int64 {
+	return int64(br.ReadUint64())
+}
+
+// ReadFixed 读取固定长度的数据到b中
+func (br *BinaryReader) ReadFixed(b []byte) {
+	br.readFull(b)
+}
+
+// ReadLength 读取一个长度或者数量 超过max时返回ErrLengthExceeded
+func (br *BinaryReader) ReadLength(max uint32) uint32 {
+	n := br.ReadUint32()
+	if br.err != nil {
+		return 0
+	}
+	if n > max {
+		br.err = ErrLengthExceeded
+		return 0
+	}
+	return n
+}
+
+// ReadBytes 读取带长度前缀的数据 长度超过max时返回ErrLengthExceeded
+func (br *BinaryReader) ReadBytes(max uint32) []byte {
+	n := br.ReadLength(max)
+	if br.err != nil {
+		return nil
+	}
+	b := make([]byte, n)
+	br.readFull(b)
+	if br.err != nil {
+		return nil
+	}
+	return b
+}
+
+// ReadUnsigned 读取带长度前缀的大端序无符号整数 有前导0时返回ErrNonCanonical
+// 保证同一个值只有一种编码
+func (br *BinaryReader) ReadUnsigned(max uint32) []byte {
+	b := br.ReadBytes(max)
+	if len(b) > 0 && b[0] == 0 {
+		br.err = ErrNonCanonical
+		return nil
+	}
+	return b
+}
+
+func (br *BinaryReader) ReadString(max uint32) string {
+	return string(br.ReadBytes(max))
+}